@@ -0,0 +1,219 @@
+// Package apikey keeps the personal API keys of users. A key is sent in the
+// Authorization header instead of a session token and works until it expires
+// or is revoked. Only a hash of the secret part of a key is stored
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Prefix starts every key so keys can be told apart from session tokens
+const Prefix = "ak1."
+
+var (
+	ErrNotFound = errors.New("API key not found")
+	ErrExpired  = errors.New("the API key expired")
+	ErrInvalid  = errors.New("invalid API key")
+)
+
+type Access string
+
+const (
+	// Full lets the key do whatever the user can
+	Full Access = "full"
+	// Read lets the key only look at files
+	Read Access = "read"
+	// Upload lets the key only add and write files
+	Upload Access = "upload"
+)
+
+type Key struct {
+	// ID is the public part of the key
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	// zero means that the key never expires
+	Expires time.Time `json:"expires"`
+	Access  Access    `json:"access"`
+	// the key works only for this file and the tree under it, uuid.Nil
+	// means everywhere
+	Subtree uuid.UUID `json:"subtree"`
+	// sha256 of the secret part of the key, hex encoded
+	Hash string `json:"hash"`
+}
+
+type Store struct {
+	lock sync.Mutex
+	// id to the key
+	keys map[string]Key
+	path string
+}
+
+// Load reads the keys file. A missing file means no keys
+func Load(path string) (*Store, error) {
+	s := &Store{
+		keys: map[string]Key{},
+		path: path,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.keys); err != nil {
+			return nil, fmt.Errorf("decode API keys file: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// has to be called with s.lock held
+func (s *Store) syncToDisk() error {
+	b, err := json.Marshal(s.keys)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores the key and returns it together with the whole key string.
+// The string can't be recovered later
+func (s *Store) Create(k Key) (Key, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	secret := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	k.ID = hex.EncodeToString(randomBytes(8))
+	k.Created = time.Now().UTC()
+	k.Hash = hashSecret(secret)
+	s.keys[k.ID] = k
+
+	if err := s.syncToDisk(); err != nil {
+		delete(s.keys, k.ID)
+		return Key{}, "", err
+	}
+
+	return k, Prefix + k.ID + "." + secret, nil
+}
+
+// Check returns the key the string belongs to if it is still valid
+func (s *Store) Check(key string) (Key, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, Prefix), ".")
+	if !ok || !strings.HasPrefix(key, Prefix) {
+		return Key{}, ErrInvalid
+	}
+
+	s.lock.Lock()
+	k, found := s.keys[id]
+	s.lock.Unlock()
+
+	if !found {
+		return Key{}, ErrInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.Hash)) != 1 {
+		return Key{}, ErrInvalid
+	}
+	if !k.Expires.IsZero() && time.Now().After(k.Expires) {
+		return Key{}, ErrExpired
+	}
+
+	return k, nil
+}
+
+// List returns the keys of the user, the newest first
+func (s *Store) List(username string) []Key {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := []Key{}
+	for _, k := range s.keys {
+		if k.Username == username {
+			keys = append(keys, k)
+		}
+	}
+
+	slices.SortFunc(keys, func(a, b Key) int { return b.Created.Compare(a.Created) })
+	return keys
+}
+
+// Revoke deletes the key of the user
+func (s *Store) Revoke(username, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok || k.Username != username {
+		return ErrNotFound
+	}
+
+	delete(s.keys, id)
+
+	if err := s.syncToDisk(); err != nil {
+		s.keys[id] = k
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAll deletes all keys of the user
+func (s *Store) RevokeAll(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	removed := map[string]Key{}
+	for id, k := range s.keys {
+		if k.Username == username {
+			removed[id] = k
+			delete(s.keys, id)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if err := s.syncToDisk(); err != nil {
+		for id, k := range removed {
+			s.keys[id] = k
+		}
+		return err
+	}
+
+	return nil
+}
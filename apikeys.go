@@ -0,0 +1,260 @@
+package main
+
+// GET  /api/v1/keys              lists the API keys of the user
+// POST /api/v1/keys/create       creates one, the response has the key
+// POST /api/v1/keys/revoke/{id}  revokes it
+//
+// An API key is sent in the Authorization header like a session token. It
+// acts as its user but can be limited to reading, to uploading and to the
+// tree under one directory. Keys can't manage keys.
+
+import (
+	"archiiv/apikey"
+	"archiiv/fs"
+	"archiiv/user"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// keyAuth is what a request made with an API key may do
+type keyAuth struct {
+	key   apikey.Key
+	files *fs.Fs
+}
+
+// uuidPathValues are the names of path values that hold files in the routes
+var uuidPathValues = []string{"uuid", "parentUUID", "childUUID", "fromUUID", "toUUID"}
+
+// withoutFiles are routes that don't name a file but are fine for keys
+// limited to a subtree, because the handlers let such keys touch only the
+// uploads, jobs and leases they made themselves (see keyMayUse)
+var withoutFiles = []string{"/api/v1/whoami", "/api/v1/tus/", "/api/v1/jobs/", "/api/v1/locks/renew/", "/api/v1/locks/release/"}
+
+// uploadRoutes are the routes an upload-only key may use
+var uploadRoutes = []string{"/api/v1/whoami", "/api/v1/fs/upload/", "/api/v1/fs/touch/", "/api/v1/fs/mkdir/", "/api/v1/fs/path/upload/", "/api/v1/fs/tus/", "/api/v1/tus/"}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the key may be used for the routed request
+func (a keyAuth) allows(r *http.Request) bool {
+	switch a.key.Access {
+	case apikey.Read:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return false
+		}
+	case apikey.Upload:
+		if !hasAnyPrefix(r.URL.Path, uploadRoutes) {
+			return false
+		}
+	}
+
+	if a.key.Subtree == uuid.Nil {
+		return true
+	}
+
+	var ids []uuid.UUID
+	for _, name := range uuidPathValues {
+		if v := r.PathValue(name); v != "" {
+			id, e := uuid.Parse(v)
+			if e != nil {
+				return false
+			}
+			ids = append(ids, id)
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/v1/fs/path/") {
+		// the path is resolved later but it can't leave the start
+		start, e := startUUID(r)
+		if e != nil {
+			return false
+		}
+		ids = append(ids, start)
+	}
+
+	if len(ids) == 0 {
+		return hasAnyPrefix(r.URL.Path, withoutFiles)
+	}
+
+	for _, id := range ids {
+		if !inTree(a.files, a.key.Subtree, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func usedAPIKey(r *http.Request) bool {
+	_, ok := r.Context().Value(keyAuthKey).(keyAuth)
+	return ok
+}
+
+// apiKeyID returns the ID of the API key the request was made with, or ""
+func apiKeyID(r *http.Request) string {
+	a, _ := r.Context().Value(keyAuthKey).(keyAuth)
+	return a.key.ID
+}
+
+// keyMayUse reports whether the request may use an upload, a job or a lease
+// made with the API key keyID. Keys limited to a subtree may use only those
+// they made themselves
+func keyMayUse(r *http.Request, keyID string) bool {
+	a, ok := r.Context().Value(keyAuthKey).(keyAuth)
+	return !ok || a.key.Subtree == uuid.Nil || a.key.ID == keyID
+}
+
+// acceptAPIKeys authorizes requests with an API key in the Authorization
+// header as the owner of the key. What the key may do is checked by
+// requireLogin once the request is routed
+func acceptAPIKeys(log *slog.Logger, keys *apikey.Store, userStore *user.UserStore, files *fs.Fs, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getSessionToken(r)
+		if !strings.HasPrefix(token, apikey.Prefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		k, e := keys.Check(token)
+		if e != nil || (k.Username != fs.UserRoot && !userStore.Active(k.Username)) {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		r = withUsername(r, k.Username)
+		r = r.WithContext(context.WithValue(r.Context(), keyAuthKey, keyAuth{key: k, files: files}))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyInfo is a key as its owner sees it, without the hash
+type apiKeyInfo struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Created time.Time     `json:"created"`
+	Expires time.Time     `json:"expires"`
+	Access  apikey.Access `json:"access"`
+	Subtree uuid.UUID     `json:"subtree"`
+}
+
+func newAPIKeyInfo(k apikey.Key) apiKeyInfo {
+	return apiKeyInfo{
+		ID:      k.ID,
+		Name:    k.Name,
+		Created: k.Created,
+		Expires: k.Expires,
+		Access:  k.Access,
+		Subtree: k.Subtree,
+	}
+}
+
+// rejectAPIKeys answers 403 to requests made with an API key, so a leaked key
+// can't be used to make more keys
+func rejectAPIKeys(log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if usedAPIKey(r) {
+			sendError(log, w, http.StatusForbidden, "API keys can't manage API keys")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func handleAPIKeyList(secret []signingKey, log *slog.Logger, keys *apikey.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos := []apiKeyInfo{}
+		for _, k := range keys.List(getUsername(r, secret)) {
+			infos = append(infos, newAPIKeyInfo(k))
+		}
+		sendOK(log, w, infos)
+	})
+}
+
+func handleAPIKeyCreate(secret []signingKey, files *fs.Fs, log *slog.Logger, keys *apikey.Store) http.Handler {
+	type Request struct {
+		Name    string        `json:"name"`
+		Expires time.Time     `json:"expires"`
+		Access  apikey.Access `json:"access"`
+		Subtree uuid.UUID     `json:"subtree"`
+	}
+
+	type OkResponse struct {
+		apiKeyInfo
+		Key string `json:"key"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		if req.Name == "" {
+			sendError(log, w, http.StatusBadRequest, "name can't be empty")
+			return
+		}
+		if req.Access == "" {
+			req.Access = apikey.Full
+		}
+		if req.Access != apikey.Full && req.Access != apikey.Read && req.Access != apikey.Upload {
+			sendError(log, w, http.StatusBadRequest, "access must be full, read or upload")
+			return
+		}
+		if !req.Expires.IsZero() && req.Expires.Before(time.Now()) {
+			sendError(log, w, http.StatusBadRequest, "expires is in the past")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if req.Subtree != uuid.Nil {
+			if _, e = files.GetEntry(req.Subtree); e != nil {
+				sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+				return
+			}
+		}
+
+		k, key, e := keys.Create(apikey.Key{
+			Name:     req.Name,
+			Username: username,
+			Expires:  req.Expires.UTC(),
+			Access:   req.Access,
+			Subtree:  req.Subtree,
+		})
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("create API key: %v", e))
+			return
+		}
+
+		log.Info("Created API key", "user", username, "id", k.ID)
+		sendOK(log, w, OkResponse{apiKeyInfo: newAPIKeyInfo(k), Key: key})
+	})
+}
+
+func handleAPIKeyRevoke(secret []signingKey, log *slog.Logger, keys *apikey.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := keys.Revoke(getUsername(r, secret), r.PathValue("id"))
+		if errors.Is(e, apikey.ErrNotFound) {
+			sendError(log, w, http.StatusNotFound, e.Error())
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke API key: %v", e))
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type apiKeyResponse struct {
+	Ok   bool `json:"ok"`
+	Data struct {
+		apiKeyInfo
+		Key string `json:"key"`
+	} `json:"data"`
+}
+
+func createAPIKeyHelper(t *testing.T, srv http.Handler, token, body string) string {
+	res := hitAuth(srv, http.MethodPost, "/api/v1/keys/create", token, strings.NewReader(body))
+	expectStatusCode(t, res, http.StatusOK)
+	return decodeResponse[apiKeyResponse](t, res).Data.Key
+}
+
+func TestAPIKey(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	srv := env.srv
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/keys/create", token, strings.NewReader(`{"access":"write","name":"x"}`))
+	expectFail(t, res, http.StatusBadRequest, "access must be full, read or upload")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/keys/create", token, strings.NewReader(`{"name":"x","expires":"2001-01-01T00:00:00Z"}`))
+	expectFail(t, res, http.StatusBadRequest, "expires is in the past")
+
+	key := createAPIKeyHelper(t, srv, token, `{"name":"backup"}`)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/whoami", key, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	dir := mkdirHelper(t, srv, key, env.root, "zálohy")
+	expectEqual(t, len(lsHelper(t, srv, key, dir)), 0, "files in a new directory")
+
+	// keys can't make more keys
+	res = hitAuth(srv, http.MethodPost, "/api/v1/keys/create", key, strings.NewReader(`{"name":"more"}`))
+	expectFail(t, res, http.StatusForbidden, "API keys can't manage API keys")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/keys", token, nil)
+	keys := decodeResponse[struct {
+		Ok   bool         `json:"ok"`
+		Data []apiKeyInfo `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(keys), 1, "listed keys")
+	expectEqual(t, keys[0].Name, "backup", "key name")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/whoami", key[:len(key)-1]+"x", nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/keys/revoke/"+keys[0].ID, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/whoami", key, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	// deleting the user deletes the keys
+	key = createAPIKeyHelper(t, srv, token, `{"name":"backup"}`)
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = hitAuth(srv, http.MethodPost, "/api/v1/users/delete/marek", rootToken, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/users/create", rootToken, strings.NewReader(`{"name":"marek","password":"jiné"}`))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/whoami", key, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	backups := mkdirHelper(t, srv, token, root, "backups")
+	photos := mkdirHelper(t, srv, token, root, "photos")
+	photo := touchHelper(t, srv, token, photos, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("babička"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	readKey := createAPIKeyHelper(t, srv, token, `{"name":"read","access":"read"}`)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", readKey, nil)
+	expectBody(t, res, "babička")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+photos.String()+"/new.jpg", readKey, nil)
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+
+	uploadKey := createAPIKeyHelper(t, srv, token, fmt.Sprintf(`{"name":"upload","access":"upload","subtree":"%s"}`, backups))
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/path/upload/db.sql?from="+backups.String(), uploadKey, strings.NewReader("dump"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+backups.String(), uploadKey, nil)
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+photos.String()+"/new.jpg", uploadKey, nil)
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/path/upload/photos/new.jpg", uploadKey, strings.NewReader("x"))
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+
+	subtreeKey := createAPIKeyHelper(t, srv, token, fmt.Sprintf(`{"name":"photos","subtree":"%s"}`, photos))
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", subtreeKey, nil)
+	expectBody(t, res, "babička")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), subtreeKey, nil)
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+photos.String()+"/"+photo.String()+"/"+backups.String(), subtreeKey, nil)
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/trash", subtreeKey, nil)
+	expectFail(t, res, http.StatusForbidden, "the API key doesn't allow this")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/keys/create", token, strings.NewReader(fmt.Sprintf(`{"name":"x","subtree":"%s"}`, uuid.New())))
+	expectStatusCode(t, res, http.StatusNotFound)
+}
+
+func TestAPIKeySubtreeOwnRecords(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	photos := mkdirHelper(t, srv, token, root, "photos")
+	photo := touchHelper(t, srv, token, photos, "photo.jpg")
+	private := touchHelper(t, srv, token, root, "private.txt")
+	key := createAPIKeyHelper(t, srv, token, fmt.Sprintf(`{"name":"photos","subtree":"%s"}`, photos))
+
+	// what the user started outside the subtree stays out of reach
+	res := hitTus(srv, http.MethodPost, "/api/v1/fs/tus/"+private.String()+"/data", token, "", map[string]string{"Upload-Length": "3"})
+	expectStatusCode(t, res, http.StatusCreated)
+	location := res.Header.Get("Location")
+	expectStatusCode(t, hitTus(srv, http.MethodHead, location, key, "", nil), http.StatusNotFound)
+	expectStatusCode(t, hitTus(srv, http.MethodDelete, location, key, "", nil), http.StatusNotFound)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+private.String(), token, nil)
+	l := decodeResponse[leaseResponse](t, res).Data
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/renew/"+l.ID, key, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/release/"+l.ID, key, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+
+	// but the key can use what it made
+	res = hitTus(srv, http.MethodPost, "/api/v1/fs/tus/"+photo.String()+"/data", key, "", map[string]string{"Upload-Length": "3"})
+	expectStatusCode(t, res, http.StatusCreated)
+	expectStatusCode(t, hitTus(srv, http.MethodHead, res.Header.Get("Location"), key, "", nil), http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+photo.String(), key, nil)
+	l = decodeResponse[leaseResponse](t, res).Data
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/release/"+l.ID, key, nil)
+	expectStatusCode(t, res, http.StatusOK)
+}
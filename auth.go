@@ -1,39 +1,118 @@
 package main
 
 import (
+	"archiiv/fs"
+	"archiiv/session"
 	"archiiv/user"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
+const (
+	// access tokens are sent with every request so they are short-lived
+	accessTokenTTL = 15 * time.Minute
+	// refresh tokens are only exchanged for new tokens
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
 func getSessionToken(r *http.Request) string {
 	return r.Header.Get("Authorization")
 }
 
-func getUsername(r *http.Request, secret string) string {
+// verifyAccessToken returns the payload of a valid access token
+func verifyAccessToken(token string, secret []signingKey) (tokenPayload, error) {
+	p, err := verifyToken(token, secret, accessTokenTTL)
+	if err != nil {
+		return p, err
+	}
+	if p.Refresh {
+		return tokenPayload{}, errors.New("refresh tokens can't be used for requests")
+	}
+	return p, nil
+}
+
+type contextKey int
+
+const (
+	usernameKey contextKey = iota
+	keyAuthKey
+)
+
+// withUsername makes getUsername return the name for a request that was
+// authorized by something other than the Authorization header
+func withUsername(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), usernameKey, name))
+}
+
+func getUsername(r *http.Request, secret []signingKey) string {
+	if name, ok := r.Context().Value(usernameKey).(string); ok {
+		return name
+	}
+
 	// This function is only called in endpoints wrapped around
-	// `requireLogin` middleware so this function can assume that some user
-	// is logged in
+	// `requireLogin` or `allowPub` middleware so this function can assume
+	// that the token is either valid or missing
 	token := getSessionToken(r)
-	username, err := verifySignature(token, secret, 7*24*time.Hour)
+	if token == "" {
+		return fs.UserPub
+	}
+
+	p, err := verifyAccessToken(token, secret)
 	if err != nil {
 		panic(err)
 	}
-	return username
+	return p.Username
 }
 
-func validateToken(secret, token string) bool {
-	_, err := verifySignature(token, secret, 7*24*time.Hour)
+func validateToken(secret []signingKey, token string) bool {
+	_, err := verifyAccessToken(token, secret)
 	return err == nil
 }
 
-func login(name string, pwd [64]byte, secret string, userStore user.UserStore) (ok bool, token string) {
+// rejectRevokedTokens answers 401 to requests made with a token revoked by
+// logging out, before they get to requireLogin
+func rejectRevokedTokens(secret []signingKey, log *slog.Logger, sessions *session.Store, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := verifyAccessToken(getSessionToken(r), secret)
+		if err == nil && sessions.IsRevoked(p.Username, p.Nonce, p.Timestamp) {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tokenPair is what the client gets after logging in
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func issueTokens(name string, secret []signingKey) (tokenPair, error) {
+	access, err := sign(name, secret)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refresh, _, err := signToken(name, secret, true)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{Token: access, RefreshToken: refresh}, nil
+}
+
+func login(name, pwd string, secret []signingKey, userStore *user.UserStore) (ok bool, tokens tokenPair) {
 	if !userStore.CheckPassword(name, pwd) {
 		ok = false
 		return
 	}
 
-	token, err := sign(name, secret)
+	tokens, err := issueTokens(name, secret)
 	if err != nil {
 		ok = false
 		return
@@ -42,3 +121,114 @@ func login(name string, pwd [64]byte, secret string, userStore user.UserStore) (
 	ok = true
 	return
 }
+
+// verifyRefreshToken returns the payload of a valid refresh token of a user
+// that still exists
+func verifyRefreshToken(token string, secret []signingKey, userStore *user.UserStore, sessions *session.Store) (tokenPayload, error) {
+	p, err := verifyToken(token, secret, refreshTokenTTL)
+	if err != nil {
+		return p, err
+	}
+
+	if !p.Refresh {
+		return tokenPayload{}, errors.New("not a refresh token")
+	}
+
+	if sessions.IsRevoked(p.Username, p.Nonce, p.Timestamp) {
+		return tokenPayload{}, errors.New("the token was revoked")
+	}
+
+	if p.Username != fs.UserRoot && !userStore.Active(p.Username) {
+		return tokenPayload{}, errors.New("the user doesn't exist or is disabled")
+	}
+
+	return p, nil
+}
+
+func handleSessionTokenRefresh(secret []signingKey, log *slog.Logger, userStore *user.UserStore, sessions *session.Store) http.Handler {
+	type Request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		p, e := verifyRefreshToken(req.RefreshToken, secret, userStore, sessions)
+		if e != nil {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		// every refresh token can be used once, a stolen one stops working
+		// as soon as either the thief or the owner uses it
+		if e = sessions.Revoke(p.Nonce, p.Timestamp.Add(refreshTokenTTL)); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke token: %v", e))
+			return
+		}
+
+		tokens, e := issueTokens(p.Username, secret)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sign tokens: %v", e))
+			return
+		}
+
+		sendOK(log, w, tokens)
+	})
+}
+
+// handleLogout revokes the access token of the request and the refresh token
+// in the body if there is one
+func handleLogout(secret []signingKey, log *slog.Logger, userStore *user.UserStore, sessions *session.Store) http.Handler {
+	type Request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, e := verifyAccessToken(getSessionToken(r), secret)
+		if e != nil {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		var req Request
+		if r.ContentLength != 0 {
+			if req, e = decode[Request](r); e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+				return
+			}
+		}
+
+		if e = sessions.Revoke(p.Nonce, p.Timestamp.Add(accessTokenTTL)); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke token: %v", e))
+			return
+		}
+
+		if req.RefreshToken != "" {
+			rp, e := verifyRefreshToken(req.RefreshToken, secret, userStore, sessions)
+			if e == nil && rp.Username == p.Username {
+				e = sessions.Revoke(rp.Nonce, rp.Timestamp.Add(refreshTokenTTL))
+				if e != nil {
+					sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke token: %v", e))
+					return
+				}
+			}
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+func handleLogoutAll(secret []signingKey, log *slog.Logger, sessions *session.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := sessions.RevokeAll(getUsername(r, secret)); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke tokens: %v", e))
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
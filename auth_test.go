@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tokensResponse struct {
+	Ok   bool      `json:"ok"`
+	Data tokenPair `json:"data"`
+}
+
+func loginTokensHelper(t *testing.T, srv http.Handler, username, pwd string) tokenPair {
+	res := hitPost(t, srv, "/api/v1/login", loginRequest{Username: username, Password: pwd})
+	expectStatusCode(t, res, http.StatusOK)
+	return decodeResponse[tokensResponse](t, res).Data
+}
+
+func refreshHelper(srv http.Handler, refresh string) *http.Response {
+	body := strings.NewReader(`{"refresh_token":"` + refresh + `"}`)
+	return hitAuth(srv, http.MethodPost, "/api/v1/refresh-token", "", body)
+}
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	tokens := loginTokensHelper(t, srv, "marek", "heslo")
+
+	// a refresh token is not an access token
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), tokens.RefreshToken, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	// and the other way around
+	res = refreshHelper(srv, tokens.Token)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	res = refreshHelper(srv, tokens.RefreshToken)
+	expectStatusCode(t, res, http.StatusOK)
+	fresh := decodeResponse[tokensResponse](t, res).Data
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), fresh.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// refresh tokens can be used only once
+	res = refreshHelper(srv, tokens.RefreshToken)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	res = refreshHelper(srv, fresh.RefreshToken)
+	expectStatusCode(t, res, http.StatusOK)
+}
+
+func TestLogout(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	tokens := loginTokensHelper(t, srv, "marek", "heslo")
+	other := loginTokensHelper(t, srv, "marek", "heslo")
+
+	body := strings.NewReader(`{"refresh_token":"` + tokens.RefreshToken + `"}`)
+	res := hitAuth(srv, http.MethodPost, "/api/v1/logout", tokens.Token, body)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), tokens.Token, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+	res = refreshHelper(srv, tokens.RefreshToken)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	// the other session is untouched
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), other.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// logging out without a body only revokes the access token
+	res = hitAuth(srv, http.MethodPost, "/api/v1/logout", other.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), other.Token, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+	res = refreshHelper(srv, other.RefreshToken)
+	expectStatusCode(t, res, http.StatusOK)
+}
+
+func TestLogoutAll(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"matěj": hashPassword("heslo2"),
+	})
+	first := loginTokensHelper(t, srv, "marek", "heslo")
+	second := loginTokensHelper(t, srv, "marek", "heslo")
+	matej := loginTokensHelper(t, srv, "matěj", "heslo2")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/logout-all", first.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	for _, tokens := range []tokenPair{first, second} {
+		res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), tokens.Token, nil)
+		expectStatusCode(t, res, http.StatusUnauthorized)
+		res = refreshHelper(srv, tokens.RefreshToken)
+		expectStatusCode(t, res, http.StatusUnauthorized)
+	}
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), matej.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// logging in again works
+	tokens := loginTokensHelper(t, srv, "marek", "heslo")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String(), tokens.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+}
+
+func TestLegacyPasswordUpgrade(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+
+	// the hash of marek in the users file, empty if it is the legacy array
+	storedHash := func() string {
+		b, err := os.ReadFile(filepath.Join(env.dir, "users.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f struct {
+			Users map[string]struct {
+				Password string `json:"password"`
+			} `json:"users"`
+		}
+		_ = json.Unmarshal(b, &f)
+		return f.Users["marek"].Password
+	}
+
+	// the initial users file holds the bare SHA-512
+	expectEqual(t, storedHash(), "", "hash before the first login")
+
+	res := hitPost(t, env.srv, "/api/v1/login", loginRequest{Username: "marek", Password: "hesl"})
+	expectFail(t, res, http.StatusForbidden, "wrong name or password")
+	expectEqual(t, storedHash(), "", "hash after a failed login")
+
+	loginHelper(t, env.srv, "marek", "heslo")
+	upgraded := storedHash()
+	if !strings.HasPrefix(upgraded, "$argon2id$v=19$m=64,t=1,p=4$") {
+		t.Errorf("hash after login is %#v", upgraded)
+	}
+
+	loginHelper(t, env.srv, "marek", "heslo")
+	expectEqual(t, storedHash(), upgraded, "hash after the second login")
+
+	res = hitPost(t, env.srv, "/api/v1/login", loginRequest{Username: "marek", Password: "hesl"})
+	expectFail(t, res, http.StatusForbidden, "wrong name or password")
+}
@@ -0,0 +1,351 @@
+package main
+
+// POST /api/v1/fs/batch runs a list of operations in order:
+//
+// {"op": "mkdir", "parent": P, "name": N}
+// {"op": "touch", "parent": P, "name": N}
+// {"op": "mount", "parent": P, "child": C}
+// {"op": "unmount", "parent": P, "child": C}
+// {"op": "set_perms", "uuid": U, "user": N, "perms": 3}  (null perms removes the entry)
+// {"op": "delete_section", "uuid": U, "section": S}
+//
+// Instead of a uuid an operation can refer to the record created by an earlier
+// mkdir or touch as "$index". With "atomic": true the batch stops at the first
+// failure and the operations done so far are undone. If some of them can't be
+// undone, rolled_back is false and rollback_error says why. The batch is not
+// isolated from other requests running at the same time though.
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const batchMaxOps = 1000
+
+var errBatchSkipped = errors.New("skipped after an earlier failure")
+
+type batchOp struct {
+	Op      string `json:"op"`
+	Parent  string `json:"parent"`
+	Child   string `json:"child"`
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	Section string `json:"section"`
+	User    string `json:"user"`
+	Perms   *uint8 `json:"perms"`
+}
+
+type batchResult struct {
+	Ok    bool       `json:"ok"`
+	UUID  *uuid.UUID `json:"uuid,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+type batch struct {
+	files    *fs.Fs
+	locks    *lease.Store
+	username string
+	atomic   bool
+	// uuids created by the operations, uuid.Nil for the others
+	created []uuid.UUID
+	// undo is run backwards on rollback, commit in order when all succeed
+	undo   []func() error
+	commit []batchCommit
+}
+
+// batchCommit finishes the operation with the index op
+type batchCommit struct {
+	op int
+	do func() error
+}
+
+// has to be called from run, while len(b.created) is the index of the
+// operation
+func (b *batch) onCommit(do func() error) {
+	b.commit = append(b.commit, batchCommit{op: len(b.created), do: do})
+}
+
+// ref parses a uuid or a "$index" reference to a created record
+func (b *batch) ref(s string) (uuid.UUID, error) {
+	n, ok := strings.CutPrefix(s, "$")
+	if !ok {
+		return uuid.Parse(s)
+	}
+
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 0 || i >= len(b.created) || b.created[i] == uuid.Nil {
+		return uuid.Nil, fmt.Errorf("invalid reference %#v", s)
+	}
+
+	return b.created[i], nil
+}
+
+func (b *batch) refs(a, c string) (uuid.UUID, uuid.UUID, error) {
+	x, err := b.ref(a)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	y, err := b.ref(c)
+	return x, y, err
+}
+
+// need checks that the user has the permission and that the file is not
+// locked by someone else
+func (b *batch) need(id uuid.UUID, perm uint8) error {
+	if err := checkPerm(b.files, id, b.username, perm); err != nil {
+		return err
+	}
+	if perm&(fs.PermWrite|fs.PermOwner) != 0 {
+		return b.locks.CheckWrite(id, b.username)
+	}
+	return nil
+}
+
+func (b *batch) run(op batchOp) (uuid.UUID, error) {
+	switch op.Op {
+	case "mkdir", "touch":
+		parent, err := b.ref(op.Parent)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.need(parent, fs.PermWrite); err != nil {
+			return uuid.Nil, err
+		}
+
+		create := b.files.Touch
+		if op.Op == "mkdir" {
+			create = b.files.Mkdir
+		}
+		id, err := create(parent, op.Name)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		// without its meta the record is removed right away, even when
+		// the batch isn't rolled back
+		if err := fs.WriteFileMeta(b.files, id, fs.NewFileMeta(id, b.username)); err != nil {
+			_ = b.files.Unmount(parent, id)
+			return uuid.Nil, fmt.Errorf("write meta: %w", err)
+		}
+		b.undo = append(b.undo, func() error { return b.files.Unmount(parent, id) })
+
+		return id, nil
+
+	case "mount":
+		parent, child, err := b.refs(op.Parent, op.Child)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.need(parent, fs.PermWrite); err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.need(child, fs.PermRead); err != nil {
+			return uuid.Nil, err
+		}
+
+		if err := b.files.Mount(parent, child); err != nil {
+			return uuid.Nil, err
+		}
+		b.undo = append(b.undo, func() error { return b.files.Unmount(parent, child) })
+
+		return uuid.Nil, nil
+
+	case "unmount":
+		parent, child, err := b.refs(op.Parent, op.Child)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.need(parent, fs.PermWrite); err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.locks.CheckWrite(child, b.username); err != nil {
+			return uuid.Nil, err
+		}
+
+		if !b.atomic {
+			return uuid.Nil, b.files.Unmount(parent, child)
+		}
+
+		// keep the child alive until the batch is done so that it can be
+		// mounted back
+		if err := b.files.Pin(child); err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.files.Unmount(parent, child); err != nil {
+			_ = b.files.Unpin(child)
+			return uuid.Nil, err
+		}
+		b.undo = append(b.undo, func() error {
+			// the child stays pinned if it can't be mounted back, so
+			// it isn't deleted
+			if err := b.files.Mount(parent, child); err != nil {
+				return err
+			}
+			return b.files.Unpin(child)
+		})
+		b.onCommit(func() error { return b.files.Unpin(child) })
+
+		return uuid.Nil, nil
+
+	case "set_perms":
+		id, err := b.ref(op.UUID)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.need(id, fs.PermOwner); err != nil {
+			return uuid.Nil, err
+		}
+		if op.User == "" {
+			return uuid.Nil, errors.New("missing user")
+		}
+
+		old, err := fs.ReadFileMeta(b.files, id)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("read meta: %w", err)
+		}
+
+		fm := old
+		fm.Perms = make(map[string]uint8, len(old.Perms)+1)
+		for name, bits := range old.Perms {
+			fm.Perms[name] = bits
+		}
+		if op.Perms == nil {
+			delete(fm.Perms, op.User)
+		} else {
+			fm.Perms[op.User] = *op.Perms & fs.PermAll
+		}
+
+		if err := fs.WriteFileMeta(b.files, id, fm); err != nil {
+			return uuid.Nil, fmt.Errorf("write meta: %w", err)
+		}
+		b.undo = append(b.undo, func() error { return fs.WriteFileMeta(b.files, id, old) })
+
+		return uuid.Nil, nil
+
+	case "delete_section":
+		id, err := b.ref(op.UUID)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if err := b.need(id, fs.PermWrite); err != nil {
+			return uuid.Nil, err
+		}
+		if op.Section == "meta" {
+			return uuid.Nil, errors.New("the meta section can't be deleted")
+		}
+
+		if !b.atomic {
+			return uuid.Nil, b.files.DeleteSection(id, op.Section)
+		}
+
+		// nothing in a batch reads sections so the deletion can wait until
+		// it can't be undone anymore
+		f, err := b.files.OpenSection(id, op.Section)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		f.Close()
+		b.onCommit(func() error { return b.files.DeleteSection(id, op.Section) })
+
+		return uuid.Nil, nil
+
+	default:
+		return uuid.Nil, fmt.Errorf("unknown operation %#v", op.Op)
+	}
+}
+
+// rollback undoes as much as it can and returns what couldn't be undone
+func (b *batch) rollback() error {
+	var errs []error
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		if err := b.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func handleBatch(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
+	type Request struct {
+		Atomic bool      `json:"atomic"`
+		Ops    []batchOp `json:"ops"`
+	}
+
+	type OkResponse struct {
+		Results       []batchResult `json:"results"`
+		RolledBack    bool          `json:"rolled_back"`
+		RollbackError string        `json:"rollback_error,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if e := dec.Decode(&req); e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		if len(req.Ops) > batchMaxOps {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("at most %d operations are allowed", batchMaxOps))
+			return
+		}
+
+		b := &batch{files: files, locks: locks, username: getUsername(r, secret), atomic: req.Atomic}
+		res := OkResponse{Results: make([]batchResult, len(req.Ops))}
+
+		failed := false
+		for i, op := range req.Ops {
+			if failed {
+				res.Results[i].Error = errBatchSkipped.Error()
+				b.created = append(b.created, uuid.Nil)
+				continue
+			}
+
+			id, e := b.run(op)
+			b.created = append(b.created, id)
+			if e != nil {
+				res.Results[i].Error = e.Error()
+				failed = req.Atomic
+				continue
+			}
+
+			res.Results[i].Ok = true
+			if id != uuid.Nil {
+				res.Results[i].UUID = &id
+			}
+		}
+
+		if failed {
+			for i := range res.Results {
+				res.Results[i].Ok = false
+				res.Results[i].UUID = nil
+			}
+
+			if e := b.rollback(); e != nil {
+				log.Error("batch rollback failed", "user", b.username, "error", e)
+				res.RollbackError = e.Error()
+			} else {
+				res.RolledBack = true
+			}
+		} else {
+			for _, c := range b.commit {
+				if e := c.do(); e != nil {
+					log.Error("batch commit failed", "user", b.username, "error", e)
+					res.Results[c.op].Ok = false
+					res.Results[c.op].Error = fmt.Sprintf("commit: %v", e)
+				}
+			}
+		}
+
+		sendOK(log, w, res)
+	})
+}
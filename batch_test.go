@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archiiv/fs"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type batchResponse struct {
+	Ok   bool `json:"ok"`
+	Data struct {
+		Results       []batchResult `json:"results"`
+		RolledBack    bool          `json:"rolled_back"`
+		RollbackError string        `json:"rollback_error"`
+	} `json:"data"`
+}
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	photo := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/thumbnail", token, strings.NewReader("small"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	body := `{"ops": [
+		{"op": "mkdir", "parent": "` + root.String() + `", "name": "album"},
+		{"op": "touch", "parent": "$0", "name": "cover.jpg"},
+		{"op": "mount", "parent": "$0", "child": "` + photo.String() + `"},
+		{"op": "set_perms", "uuid": "$1", "user": "pub", "perms": 2},
+		{"op": "delete_section", "uuid": "` + photo.String() + `", "section": "thumbnail"},
+		{"op": "touch", "parent": "$4", "name": "bad"}
+	]}`
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(body))
+	expectStatusCode(t, res, http.StatusOK)
+	data := decodeResponse[batchResponse](t, res).Data
+	expectEqual(t, data.RolledBack, false, "rolled back")
+	for i, r := range data.Results[:5] {
+		if !r.Ok {
+			t.Errorf("op %d failed: %s", i, r.Error)
+		}
+	}
+	expectEqual(t, data.Results[5].Ok, false, "reference to an op without uuid")
+
+	album := *data.Results[0].UUID
+	children := lsHelper(t, srv, token, album)
+	expectEqual(t, len(children), 2, "children of the album")
+	expectEqual(t, children[1], photo, "mounted photo")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+data.Results[1].UUID.String(), token, nil)
+	expectEqual(t, decodeResponse[statResponse](t, res).Data.Meta.Perms[fs.UserPub], fs.PermRead, "perms of pub")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/thumbnail", token, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+}
+
+func TestBatchAtomic(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	photo := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("pixels"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	body := `{"atomic": true, "ops": [
+		{"op": "mkdir", "parent": "` + root.String() + `", "name": "album"},
+		{"op": "unmount", "parent": "` + root.String() + `", "child": "` + photo.String() + `"},
+		{"op": "mount", "parent": "$0", "child": "` + photo.String() + `"},
+		{"op": "delete_section", "uuid": "` + photo.String() + `", "section": "data"},
+		{"op": "set_perms", "uuid": "` + photo.String() + `", "user": "pub", "perms": 7},
+		{"op": "frobnicate"},
+		{"op": "touch", "parent": "$0", "name": "never"}
+	]}`
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(body))
+	expectStatusCode(t, res, http.StatusOK)
+	data := decodeResponse[batchResponse](t, res).Data
+	expectEqual(t, data.RolledBack, true, "rolled back")
+	expectEqual(t, data.RollbackError, "", "rollback error")
+	expectEqual(t, data.Results[5].Error != "", true, "error of the unknown op")
+	expectEqual(t, data.Results[6].Error, errBatchSkipped.Error(), "op after the failure")
+
+	children := lsHelper(t, srv, token, root)
+	expectEqual(t, len(children), 1, "children of the root after rollback")
+	expectEqual(t, children[0], photo, "photo is mounted back")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", token, nil)
+	expectBody(t, res, "pixels")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+photo.String(), token, nil)
+	_, hasPub := decodeResponse[statResponse](t, res).Data.Meta.Perms[fs.UserPub]
+	expectEqual(t, hasPub, false, "perms after rollback")
+}
@@ -0,0 +1,244 @@
+package main
+
+// The subcommands of the archiiv binary (e.g. `archiiv snapshot list`) are
+// thin clients of a running server. They sign a root token with
+// ARCHIIV_SECRET, so they work only where the server secret is available.
+
+import (
+	"archiiv/fs"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+)
+
+type command func(args []string, env func(string) string, out io.Writer) error
+
+var commands = map[string]command{
+	"snapshot": runSnapshotCommand,
+	"user":     runUserCommand,
+}
+
+type cliClient struct {
+	base  string
+	token string
+}
+
+// newCLIClient parses the flags common to all subcommands and returns the
+// remaining arguments
+func newCLIClient(name string, args []string, env func(string) string) (c cliClient, rest []string, err error) {
+	flags := flag.NewFlagSet("archiiv "+name, flag.ContinueOnError)
+
+	var host, port string
+	flags.StringVar(&host, "host", "localhost", "")
+	flags.StringVar(&port, "port", "8275", "")
+
+	if err = flags.Parse(args); err != nil {
+		err = fmt.Errorf("flags parse: %w", err)
+		return
+	}
+
+	c.base = "http://" + net.JoinHostPort(host, port)
+	secret, err := secretToKeys(env("ARCHIIV_SECRET"))
+	if err != nil {
+		err = fmt.Errorf("ARCHIIV_SECRET: %w", err)
+		return
+	}
+	c.token, err = sign(fs.UserRoot, secret)
+	if err != nil {
+		err = fmt.Errorf("sign root token: %w", err)
+		return
+	}
+
+	return c, flags.Args(), nil
+}
+
+// call makes the request and decodes the data of the response into v
+func (c cliClient) call(method, path string, query url.Values, body io.Reader, v any) error {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.token)
+
+	client := http.Client{Timeout: 10 * time.Minute}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var r struct {
+		Ok    bool            `json:"ok"`
+		Error string          `json:"error"`
+		Data  json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+
+	if !r.Ok {
+		return fmt.Errorf("server: %s", r.Error)
+	}
+
+	if v == nil || len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+func runSnapshotCommand(args []string, env func(string) string, out io.Writer) error {
+	c, args, err := newCLIClient("snapshot", args, env)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New("usage: archiiv snapshot create [name] | list | delete <name>")
+	}
+
+	switch args[0] {
+	case "create":
+		q := url.Values{}
+		if len(args) > 1 {
+			q.Set("name", args[1])
+		}
+
+		var info struct {
+			Name string `json:"name"`
+		}
+		if err := c.call(http.MethodPost, "/api/v1/snapshots/create", q, nil, &info); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, info.Name)
+
+	case "list":
+		var infos []struct {
+			Name    string    `json:"name"`
+			Created time.Time `json:"created"`
+		}
+		if err := c.call(http.MethodGet, "/api/v1/snapshots", nil, nil, &infos); err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, i := range infos {
+			fmt.Fprintf(tw, "%s\t%s\n", i.Name, i.Created.Format(time.RFC3339))
+		}
+		return tw.Flush()
+
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("usage: archiiv snapshot delete <name>")
+		}
+		return c.call(http.MethodPost, "/api/v1/snapshots/delete/"+url.PathEscape(args[1]), nil, nil, nil)
+
+	default:
+		return fmt.Errorf("unknown snapshot command %#v", args[0])
+	}
+
+	return nil
+}
+
+// cliPassword returns ARCHIIV_PASSWORD or, when it isn't set, a random
+// password which is printed so it can be handed to the user
+func cliPassword(env func(string) string, out io.Writer) string {
+	if pwd := env("ARCHIIV_PASSWORD"); pwd != "" {
+		return pwd
+	}
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	pwd := base64.RawURLEncoding.EncodeToString(b)
+	fmt.Fprintln(out, pwd)
+	return pwd
+}
+
+func jsonBody(v any) io.Reader {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return bytes.NewReader(b)
+}
+
+func runUserCommand(args []string, env func(string) string, out io.Writer) error {
+	c, args, err := newCLIClient("user", args, env)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New("usage: archiiv user add [-display_name name] [-email email] <name> | del <name> | passwd <name> | list")
+	}
+
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("archiiv user add", flag.ContinueOnError)
+		var displayName, email string
+		flags.StringVar(&displayName, "display_name", "", "")
+		flags.StringVar(&email, "email", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return fmt.Errorf("flags parse: %w", err)
+		}
+		if flags.NArg() != 1 {
+			return errors.New("usage: archiiv user add [-display_name name] [-email email] <name>")
+		}
+
+		body := jsonBody(map[string]string{
+			"name":         flags.Arg(0),
+			"password":     cliPassword(env, out),
+			"display_name": displayName,
+			"email":        email,
+		})
+		return c.call(http.MethodPost, "/api/v1/users/create", nil, body, nil)
+
+	case "del":
+		if len(args) != 2 {
+			return errors.New("usage: archiiv user del <name>")
+		}
+		return c.call(http.MethodPost, "/api/v1/users/delete/"+url.PathEscape(args[1]), nil, nil, nil)
+
+	case "passwd":
+		if len(args) != 2 {
+			return errors.New("usage: archiiv user passwd <name>")
+		}
+		body := jsonBody(map[string]string{"password": cliPassword(env, out)})
+		return c.call(http.MethodPost, "/api/v1/users/passwd/"+url.PathEscape(args[1]), nil, body, nil)
+
+	case "list":
+		var infos []userInfo
+		if err := c.call(http.MethodGet, "/api/v1/users", nil, nil, &infos); err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, i := range infos {
+			state := ""
+			if i.Disabled {
+				state = "disabled"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", i.Name, i.DisplayName, i.Email, i.Created.Format(time.RFC3339), state)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unknown user command %#v", args[0])
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+// Records and sections are versioned (see fs/version.go) and the versions are
+// sent as ETags. Mutating endpoints accept If-Match and fail with 412 when the
+// record or section changed since the client has seen it.
+
+import (
+	"archiiv/fs"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+func recordETag(version uint64) string {
+	return fmt.Sprintf(`"r%d"`, version)
+}
+
+func sectionVersionETag(version uint64) string {
+	return fmt.Sprintf(`"s%d"`, version)
+}
+
+// ifMatch returns the version the change has to be conditional on, 0 if the
+// request has no If-Match header. Returns fs.ErrVersionMismatch if none of the
+// ETags in the header is the current one
+func ifMatch(r *http.Request, current func() (uint64, error), etag func(uint64) string) (uint64, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+
+	version, err := current()
+	if err != nil {
+		// If-Match never matches a resource that doesn't exist
+		return 0, fs.ErrVersionMismatch
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		// weak tags never match, If-Match uses the strong comparison
+		if tag == "*" || tag == etag(version) {
+			return version, nil
+		}
+	}
+
+	return 0, fs.ErrVersionMismatch
+}
+
+func recordIfMatch(r *http.Request, files *fs.Fs, id uuid.UUID) (uint64, error) {
+	return ifMatch(r, func() (uint64, error) { return files.RecordVersion(id) }, recordETag)
+}
+
+func sectionIfMatch(r *http.Request, files *fs.Fs, id uuid.UUID, section string) (uint64, error) {
+	return ifMatch(r, func() (uint64, error) { return files.SectionVersion(id, section) }, sectionVersionETag)
+}
+
+func isVersionMismatch(e error) bool {
+	return errors.Is(e, fs.ErrVersionMismatch)
+}
+
+func sendPreconditionFailed(log *slog.Logger, w http.ResponseWriter) {
+	sendError(log, w, http.StatusPreconditionFailed, "412 precondition failed")
+}
+
+// setRecordETag sends the current version of the record
+func setRecordETag(w http.ResponseWriter, files *fs.Fs, id uuid.UUID) {
+	if version, err := files.RecordVersion(id); err == nil {
+		w.Header().Set("ETag", recordETag(version))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func hitIfMatch(srv http.Handler, method, target, token, etag string, body io.Reader) *http.Response {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Add("Authorization", token)
+	req.Header.Set("If-Match", etag)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestIfMatchRecord(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+album.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	etag := res.Header.Get("ETag")
+	st := decodeResponse[statResponse](t, res).Data
+	expectEqual(t, etag, recordETag(st.Version), "etag of the stat")
+
+	res = hitIfMatch(srv, http.MethodPost, "/api/v1/fs/touch/"+album.String()+"/a.jpg", token, etag, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// the touch changed the children
+	res = hitIfMatch(srv, http.MethodPost, "/api/v1/fs/mkdir/"+album.String()+"/sub", token, etag, nil)
+	expectStatusCode(t, res, http.StatusPreconditionFailed)
+	expectEqual(t, len(lsHelper(t, srv, token, album)), 1, "children after the failed mkdir")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+album.String(), token, nil)
+	etag = res.Header.Get("ETag")
+	res = hitIfMatch(srv, http.MethodPost, "/api/v1/fs/rename/"+album.String()+"/photos", token, `"r0", `+etag, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// renaming changes the version too
+	res = hitIfMatch(srv, http.MethodPost, "/api/v1/fs/mkdir/"+album.String()+"/sub", token, etag, nil)
+	expectStatusCode(t, res, http.StatusPreconditionFailed)
+	res = hitIfMatch(srv, http.MethodPost, "/api/v1/fs/mkdir/"+album.String()+"/sub", token, "*", nil)
+	expectStatusCode(t, res, http.StatusOK)
+}
+
+func TestIfMatchSection(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	file := touchHelper(t, srv, token, root, "notes.txt")
+	target := "/api/v1/fs/upload/" + file.String() + "/data"
+
+	// the section doesn't exist yet
+	res := hitIfMatch(srv, http.MethodPost, target, token, "*", strings.NewReader("v1"))
+	expectStatusCode(t, res, http.StatusPreconditionFailed)
+	res = hitAuth(srv, http.MethodPost, target, token, strings.NewReader("v1"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+file.String()+"/data", token, nil)
+	etag := res.Header.Get("ETag")
+
+	// two clients edit the same version, only the first one wins even when
+	// both writes happen within the clock resolution
+	res = hitIfMatch(srv, http.MethodPost, target, token, etag, strings.NewReader("v2"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitIfMatch(srv, http.MethodPost, target, token, etag, strings.NewReader("conflict"))
+	expectStatusCode(t, res, http.StatusPreconditionFailed)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+file.String()+"/data", token, nil)
+	if res.Header.Get("ETag") == etag {
+		t.Error("the etag did not change")
+	}
+	expectBody(t, res, "v2")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"archiiv/fs"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// sectionContentType returns the MIME type stored in the file metadata. If
+// there is none, http.ServeContent sniffs the type from the content
+func sectionContentType(files *fs.Fs, id uuid.UUID, section string) string {
+	if section != "data" {
+		return ""
+	}
+
+	fm, err := fs.ReadFileMeta(files, id)
+	if err != nil || !strings.Contains(fm.Type, "/") {
+		return ""
+	}
+
+	return fm.Type
+}
+
+// sectionETag identifies one version of a section, see fs.FileVersion
+func sectionETag(fi os.FileInfo) string {
+	return sectionVersionETag(fs.FileVersion(fi))
+}
+
+// serveSection sends the section as a plain file download with support for
+// range and conditional requests
+func serveSection(log *slog.Logger, w http.ResponseWriter, r *http.Request, files *fs.Fs, id uuid.UUID, section string, f *os.File) {
+	fi, err := f.Stat()
+	if err != nil {
+		sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("stat section: %v", err))
+		return
+	}
+
+	if ct := sectionContentType(files, id, section); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", sectionETag(fi))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
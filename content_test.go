@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCatServesPlainFile(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	file := touchHelper(t, srv, token, root, "page.html")
+	target := "/api/v1/fs/cat/" + file.String() + "/data"
+
+	content := "<html><body>ahoj</body></html>"
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", token, strings.NewReader(content))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, target, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, res.Header.Get("Content-Type"), "text/html; charset=utf-8", "sniffed content type")
+	expectEqual(t, res.Header.Get("Accept-Ranges"), "bytes", "accept ranges")
+	expectEqual(t, res.ContentLength, int64(len(content)), "content length")
+	etag := res.Header.Get("ETag")
+	expectBody(t, res, content)
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Add("Authorization", token)
+	req.Header.Add("Range", "bytes=7-10")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	res = w.Result()
+	expectStatusCode(t, res, http.StatusPartialContent)
+	expectEqual(t, res.Header.Get("Content-Range"), "bytes 7-10/30", "content range")
+	expectBody(t, res, "body")
+
+	req = httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Add("Authorization", token)
+	req.Header.Add("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	expectStatusCode(t, w.Result(), http.StatusNotModified)
+}
+
+func TestCatMissingSection(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	file := touchHelper(t, srv, token, root, "empty")
+
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+file.String()+"/data", token, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+}
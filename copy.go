@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// copyMeta returns the metadata of the copy. With keep the original metadata
+// is carried over, otherwise the user copying the file becomes its creator and
+// owner and only the type is kept
+func copyMeta(from *fs.Fs, username string, keep bool) func(old, new uuid.UUID) (fs.FileMeta, error) {
+	return func(old, new uuid.UUID) (fs.FileMeta, error) {
+		fm, err := fs.ReadFileMeta(from, old)
+		if err != nil {
+			fm = fs.FileMeta{}
+		}
+
+		if !keep {
+			typ := fm.Type
+			fm = fs.NewFileMeta(new, username)
+			fm.Type = typ
+		}
+		fm.UUID = new
+
+		return fm, nil
+	}
+}
+
+func handleCopy(secret []signingKey, files *fs.Fs, log *slog.Logger, jobs *jobStore, locks *lease.Store) http.Handler {
+	type OkResponse struct {
+		JobID uuid.UUID `json:"job_id"`
+	}
+
+	type Result struct {
+		NewUUID uuid.UUID `json:"new_uuid"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		parentID, e := uuid.Parse(r.PathValue("parentUUID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		var keepMeta bool
+		switch r.URL.Query().Get("meta") {
+		case "", "reset":
+		case "keep":
+			keepMeta = true
+		default:
+			sendError(log, w, http.StatusBadRequest, "meta must be keep or reset")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if checkPerm(files, id, username, fs.PermRead) != nil || checkPerm(files, parentID, username, fs.PermWrite) != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentID) {
+			return
+		}
+
+		total, e := files.CountTree(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		jobID := jobs.start(log, username, apiKeyID(r), "copy", total, func(progress func(int)) (any, error) {
+			mapping, err := files.Copy(id, parentID, fs.CopyOptions{
+				// files the user can't read are left out of the copy
+				Include: func(u uuid.UUID) bool {
+					return checkPerm(files, u, username, fs.PermRead) == nil
+				},
+				Progress: progress,
+				Meta:     copyMeta(files, username, keepMeta),
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{NewUUID: mapping[id]}, nil
+		})
+
+		w.Header().Set("Location", "/api/v1/jobs/"+jobID.String())
+		sendAccepted(log, w, OkResponse{JobID: jobID})
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func waitForJob(t *testing.T, srv http.Handler, token string, location string) job {
+	for range 100 {
+		res := hitAuth(srv, http.MethodGet, location, token, nil)
+		expectStatusCode(t, res, http.StatusOK)
+		j := decodeResponse[struct {
+			Ok   bool `json:"ok"`
+			Data job  `json:"data"`
+		}](t, res).Data
+
+		if j.State != jobRunning {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job did not finish")
+	return job{}
+}
+
+func TestCopySubtree(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	photo := touchHelper(t, srv, token, album, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("original"))
+	expectStatusCode(t, res, http.StatusOK)
+	// mounted twice in the subtree, copied once
+	sub := mkdirHelper(t, srv, token, album, "sub")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/mount/"+sub.String()+"/"+photo.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// the name is taken next to the original
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/copy/"+album.String()+"/"+root.String(), token, nil)
+	expectStatusCode(t, res, http.StatusAccepted)
+	j := waitForJob(t, srv, token, res.Header.Get("Location"))
+	expectEqual(t, j.State, jobFailed, "job state")
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 1, "children of the root")
+
+	copies := mkdirHelper(t, srv, token, root, "copies")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/copy/"+album.String()+"/"+copies.String()+"?meta=keep", token, nil)
+	expectStatusCode(t, res, http.StatusAccepted)
+
+	j = waitForJob(t, srv, token, res.Header.Get("Location"))
+	expectEqual(t, j.State, jobDone, "job state")
+	expectEqual(t, j.Done, 3, "copied records")
+
+	copied := uuid.MustParse(j.Result.(map[string]any)["new_uuid"].(string))
+	if copied == album {
+		t.Fatal("copy has the same uuid")
+	}
+
+	children := lsHelper(t, srv, token, copied)
+	expectEqual(t, len(children), 2, "children of the copy")
+	newPhoto := children[0]
+	expectEqual(t, lsHelper(t, srv, token, children[1])[0], newPhoto, "shared child of the copy")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+newPhoto.String(), token, nil)
+	st := decodeResponse[statResponse](t, res).Data
+	expectEqual(t, st.Refs, 2, "refs of the shared copy")
+	expectEqual(t, st.Meta.UUID, newPhoto, "uuid in the copied meta")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+newPhoto.String()+"/data", token, strings.NewReader("changed"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", token, nil)
+	expectBody(t, res, "original")
+}
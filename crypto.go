@@ -1,28 +1,63 @@
 package main
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
-	"encoding/gob"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+// Tokens look like `v1.<base64url without padding>`. The base64 part of
+// version 1 is this binary layout, integers are big-endian:
+//
+//	1 byte   length of the key id
+//	n bytes  key id
+//	1 byte   flags, bit 0 marks a refresh token
+//	8 bytes  issue time in unix nanoseconds
+//	8 bytes  nonce
+//	n bytes  username
+//	64 bytes ed25519 signature of "archiiv.v1." followed by everything above
+//
+// A new layout gets a new version prefix so old servers reject it instead of
+// misreading it
+const (
+	tokenVersion       = "v1"
+	tokenSignedPrefix  = "archiiv." + tokenVersion + "."
+	tokenFlagRefresh   = 1 << 0
+	tokenFixedFieldLen = 1 + 8 + 8
+)
+
+var (
+	errTokenVersion = errors.New("unsupported token version")
+	errTokenFormat  = errors.New("malformed token")
+	errTokenKey     = errors.New("token signed with an unknown key")
+	errNoKey        = errors.New("no key in the secret")
 )
 
 type tokenPayload struct {
 	Username  string
 	Timestamp time.Time
 	Nonce     int64
+	// refresh tokens can only be exchanged for new tokens
+	Refresh bool
+	// id of the key that signed the token
+	KeyID string
 }
 
-type fullToken struct {
-	Data tokenPayload
-	Sign []byte
+// signingKey is one key from ARCHIIV_SECRET
+type signingKey struct {
+	id   string
+	priv ed25519.PrivateKey
 }
 
 func generateSecret() string {
@@ -38,46 +73,123 @@ func hashPassword(pwd string) [64]byte {
 	return sha512.Sum512([]byte(pwd))
 }
 
-func secretToKeys(secretStr string) (priv ed25519.PrivateKey, err error) {
-	secret, err := base64.URLEncoding.DecodeString(secretStr)
-	if err != nil {
-		return nil, err
+// secretToKeys parses ARCHIIV_SECRET. It is a comma separated list of keys
+// in the form `[id:]seed` where seed is a base64 encoded ed25519 seed. New
+// tokens are signed with the first key, tokens signed with any of the keys
+// are accepted. A key without an id gets one derived from its public key.
+//
+// To rotate the secret put a new key first and drop the old one once the
+// tokens it signed expired. The server parses the secret once when it starts
+// and passes the keys around
+func secretToKeys(secretStr string) ([]signingKey, error) {
+	var keys []signingKey
+
+	for _, part := range strings.Split(secretStr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		id, seedStr, hasID := strings.Cut(part, ":")
+		if !hasID {
+			seedStr = part
+		}
+
+		seed, err := base64.URLEncoding.DecodeString(seedStr)
+		if err != nil {
+			return nil, fmt.Errorf("decode key: %w", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("key seed must be %d bytes long (is %d)", ed25519.SeedSize, len(seed))
+		}
+
+		priv := ed25519.NewKeyFromSeed(seed)
+		if !hasID {
+			sum := sha256.Sum256(priv.Public().(ed25519.PublicKey))
+			id = base64.RawURLEncoding.EncodeToString(sum[:6])
+		}
+		if id == "" || len(id) > math.MaxUint8 {
+			return nil, fmt.Errorf("key id must be 1 to %d bytes long", math.MaxUint8)
+		}
+
+		for _, k := range keys {
+			if k.id == id {
+				return nil, fmt.Errorf("duplicate key id %#v", id)
+			}
+		}
+
+		keys = append(keys, signingKey{id: id, priv: priv})
 	}
-	priv = ed25519.NewKeyFromSeed(secret)
-	return
+
+	if len(keys) == 0 {
+		return nil, errNoKey
+	}
+
+	return keys, nil
 }
 
-func payloadToBytes(p tokenPayload) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(p); err != nil {
-		return nil, err
+// publicKey returns the public part of the key with the id
+func publicKey(secret []signingKey, id string) (ed25519.PublicKey, error) {
+	for _, k := range secret {
+		if k.id == id {
+			return k.priv.Public().(ed25519.PublicKey), nil
+		}
 	}
-	return buf.Bytes(), nil
+	return nil, errTokenKey
 }
 
-func gobEncode(v any) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(v); err != nil {
-		return nil, fmt.Errorf("gob decode: %w", err)
+func encodePayload(p tokenPayload) []byte {
+	b := make([]byte, 0, 1+len(p.KeyID)+tokenFixedFieldLen+len(p.Username))
+	b = append(b, byte(len(p.KeyID)))
+	b = append(b, p.KeyID...)
+
+	var flags byte
+	if p.Refresh {
+		flags |= tokenFlagRefresh
 	}
-	return buf.Bytes(), nil
+	b = append(b, flags)
+
+	b = binary.BigEndian.AppendUint64(b, uint64(p.Timestamp.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(p.Nonce))
+	return append(b, p.Username...)
 }
 
-func gobDecode[T any](d []byte) (T, error) {
-	dec := gob.NewDecoder(bytes.NewReader(d))
-	var v T
-	if err := dec.Decode(&v); err != nil {
-		return v, fmt.Errorf("gob decode: %w", err)
+func decodePayload(b []byte) (p tokenPayload, err error) {
+	if len(b) < 1 {
+		return p, errTokenFormat
+	}
+	idLen := int(b[0])
+	b = b[1:]
+
+	if len(b) < idLen+tokenFixedFieldLen {
+		return p, errTokenFormat
+	}
+	p.KeyID = string(b[:idLen])
+	b = b[idLen:]
+
+	if b[0]&^tokenFlagRefresh != 0 {
+		return p, errTokenFormat
 	}
-	return v, nil
+	p.Refresh = b[0]&tokenFlagRefresh != 0
+	b = b[1:]
+
+	p.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	p.Nonce = int64(binary.BigEndian.Uint64(b[8:]))
+	p.Username = string(b[16:])
+
+	return p, nil
+}
+
+func sign(username string, secret []signingKey) (string, error) {
+	token, _, err := signToken(username, secret, false)
+	return token, err
 }
 
-func sign(username, secret string) (string, error) {
-	// we construct the payload, serialize the payload into []byte, sign
-	// the []byte, construct (payload, signature), serialize (payload,
-	// signature) into string and return it
+func signToken(username string, secret []signingKey, refresh bool) (string, tokenPayload, error) {
+	if len(secret) == 0 {
+		return "", tokenPayload{}, errNoKey
+	}
+
 	nonce, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
 		// error here is sus. better take the thing down
@@ -88,59 +200,180 @@ func sign(username, secret string) (string, error) {
 		Username:  username,
 		Timestamp: time.Now(),
 		Nonce:     nonce.Int64(),
+		Refresh:   refresh,
+		KeyID:     secret[0].id,
 	}
 
-	payloadBytes, err := payloadToBytes(payload)
-	if err != nil {
-		return "", fmt.Errorf("payload to bytes: %w", err)
+	body := encodePayload(payload)
+	signature := ed25519.Sign(secret[0].priv, append([]byte(tokenSignedPrefix), body...))
+
+	return tokenVersion + "." + base64.RawURLEncoding.EncodeToString(append(body, signature...)), payload, nil
+}
+
+// verifyToken checks the signature and age of the token and returns its
+// payload
+func verifyToken(dataStr string, secret []signingKey, maxAge time.Duration) (tokenPayload, error) {
+	version, rest, ok := strings.Cut(dataStr, ".")
+	if !ok || version != tokenVersion {
+		return tokenPayload{}, errTokenVersion
 	}
 
-	priv, err := secretToKeys(secret)
+	data, err := base64.RawURLEncoding.DecodeString(rest)
 	if err != nil {
-		return "", fmt.Errorf("derive key from secret: %w", err)
+		return tokenPayload{}, fmt.Errorf("base64 decode token: %w", err)
+	}
+
+	if len(data) < ed25519.SignatureSize {
+		return tokenPayload{}, errTokenFormat
 	}
+	body, signature := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
 
-	signature, err := priv.Sign(nil, payloadBytes, &ed25519.Options{})
+	p, err := decodePayload(body)
 	if err != nil {
-		return "", err
+		return tokenPayload{}, err
 	}
 
-	fullTokenBytes, err := gobEncode(fullToken{Data: payload, Sign: signature})
+	pub, err := publicKey(secret, p.KeyID)
 	if err != nil {
-		return "", err
+		return tokenPayload{}, err
+	}
+
+	if !ed25519.Verify(pub, append([]byte(tokenSignedPrefix), body...), signature) {
+		return tokenPayload{}, errors.New("signature is invalid")
+	}
+
+	if time.Since(p.Timestamp).Microseconds() > maxAge.Microseconds() {
+		return tokenPayload{}, errors.New("signature is too old")
+	}
+
+	return p, nil
+}
+
+// Pre-signed URLs carry a signature in the `sig` query parameter. It looks
+// like a token, `v1.<base64url without padding>`, with this layout:
+//
+//	1 byte   length of the key id
+//	n bytes  key id
+//	8 bytes  issue time in unix nanoseconds
+//	8 bytes  expiry time in unix nanoseconds
+//	8 bytes  nonce
+//	n bytes  username
+//	64 bytes ed25519 signature of "archiiv.url.v1.", the scope and everything
+//	         above
+//
+// The scope is the method, file and section the URL is for. It isn't in the
+// signature, the server takes it from the request it verifies
+const (
+	urlSignedPrefix  = "archiiv.url." + tokenVersion + "."
+	urlFixedFieldLen = 8 + 8 + 8
+)
+
+type urlPayload struct {
+	Username string
+	Issued   time.Time
+	Expires  time.Time
+	Nonce    int64
+	KeyID    string
+}
+
+// urlScope is what a pre-signed URL allows
+func urlScope(method string, id uuid.UUID, section string) []byte {
+	return []byte(method + " " + id.String() + "/" + section + "\n")
+}
+
+func encodeURLPayload(p urlPayload) []byte {
+	b := make([]byte, 0, 1+len(p.KeyID)+urlFixedFieldLen+len(p.Username))
+	b = append(b, byte(len(p.KeyID)))
+	b = append(b, p.KeyID...)
+	b = binary.BigEndian.AppendUint64(b, uint64(p.Issued.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(p.Expires.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(p.Nonce))
+	return append(b, p.Username...)
+}
+
+func decodeURLPayload(b []byte) (p urlPayload, err error) {
+	if len(b) < 1 {
+		return p, errTokenFormat
+	}
+	idLen := int(b[0])
+	b = b[1:]
+
+	if len(b) < idLen+urlFixedFieldLen {
+		return p, errTokenFormat
 	}
+	p.KeyID = string(b[:idLen])
+	b = b[idLen:]
+
+	p.Issued = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	p.Expires = time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	p.Nonce = int64(binary.BigEndian.Uint64(b[16:]))
+	p.Username = string(b[24:])
 
-	return base64.URLEncoding.EncodeToString(fullTokenBytes), nil
+	return p, nil
 }
 
-func verifySignature(dataStr, secret string, maxAge time.Duration) (string, error) {
-	data, err := base64.URLEncoding.DecodeString(dataStr)
+// signURL returns the signature that lets anyone use the method on the
+// section of the file as the user until expires
+func signURL(username string, secret []signingKey, method string, id uuid.UUID, section string, expires time.Time) (string, error) {
+	if len(secret) == 0 {
+		return "", errNoKey
+	}
+
+	nonce, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
-		return "", fmt.Errorf("base64 decode token: %w", err)
+		panic(err)
 	}
 
-	ft, err := gobDecode[fullToken](data)
+	body := encodeURLPayload(urlPayload{
+		Username: username,
+		Issued:   time.Now(),
+		Expires:  expires,
+		Nonce:    nonce.Int64(),
+		KeyID:    secret[0].id,
+	})
+
+	msg := append([]byte(urlSignedPrefix), urlScope(method, id, section)...)
+	signature := ed25519.Sign(secret[0].priv, append(msg, body...))
+
+	return tokenVersion + "." + base64.RawURLEncoding.EncodeToString(append(body, signature...)), nil
+}
+
+// verifyURL checks that the signature is valid for the method on the section
+// of the file and hasn't expired
+func verifyURL(sig string, secret []signingKey, method string, id uuid.UUID, section string) (urlPayload, error) {
+	version, rest, ok := strings.Cut(sig, ".")
+	if !ok || version != tokenVersion {
+		return urlPayload{}, errTokenVersion
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(rest)
 	if err != nil {
-		return "", fmt.Errorf("decode FullToken: %w", err)
+		return urlPayload{}, fmt.Errorf("base64 decode signature: %w", err)
+	}
+
+	if len(data) < ed25519.SignatureSize {
+		return urlPayload{}, errTokenFormat
 	}
+	body, signature := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
 
-	priv, err := secretToKeys(secret)
+	p, err := decodeURLPayload(body)
 	if err != nil {
-		return "", fmt.Errorf("derive key from secret: %w", err)
+		return urlPayload{}, err
 	}
 
-	payloadBytes, err := payloadToBytes(ft.Data)
+	pub, err := publicKey(secret, p.KeyID)
 	if err != nil {
-		return "", fmt.Errorf("payload to bytes: %w", err)
+		return urlPayload{}, err
 	}
 
-	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), payloadBytes, ft.Sign) {
-		return "", errors.New("signature is invalid")
+	msg := append([]byte(urlSignedPrefix), urlScope(method, id, section)...)
+	if !ed25519.Verify(pub, append(msg, body...), signature) {
+		return urlPayload{}, errors.New("signature is invalid")
 	}
 
-	if time.Since(ft.Data.Timestamp).Microseconds() > maxAge.Microseconds() {
-		return "", errors.New("signature is too old")
+	if time.Now().After(p.Expires) {
+		return urlPayload{}, errors.New("the URL expired")
 	}
 
-	return ft.Data.Username, nil
+	return p, nil
 }
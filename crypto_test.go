@@ -1,12 +1,26 @@
 package main
 
 import (
+	"errors"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+// mustKeys parses the secret as the server does when it starts
+func mustKeys(t *testing.T, secret string) []signingKey {
+	keys, err := secretToKeys(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
 func TestSignVerify(t *testing.T) {
-	secret := generateSecret()
+	secret := mustKeys(t, generateSecret())
 
 	msg := "hello world"
 
@@ -15,12 +29,123 @@ func TestSignVerify(t *testing.T) {
 		t.Error(err)
 	}
 
-	msg2, err := verifySignature(sign, secret, 10*time.Second)
+	p, err := verifyToken(sign, secret, 10*time.Second)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if msg != msg2 {
+	if msg != p.Username {
 		t.Error("decoded string is not equal")
 	}
 }
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := "old:" + generateSecret()
+	newKey := "new:" + generateSecret()
+
+	oldToken, err := sign("marek", mustKeys(t, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old key still verifies after a new one is put first
+	rotated := mustKeys(t, newKey+","+oldKey)
+	if _, err := verifyToken(oldToken, rotated, time.Minute); err != nil {
+		t.Errorf("old token after rotation: %v", err)
+	}
+
+	newToken, _, err := signToken("marek", rotated, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := verifyToken(newToken, rotated, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, p.KeyID, "new", "key id of a new token")
+
+	// and stops once it is dropped
+	if _, err := verifyToken(oldToken, mustKeys(t, newKey), time.Minute); !errors.Is(err, errTokenKey) {
+		t.Errorf("old token after dropping the key: %v", err)
+	}
+}
+
+func TestRejectUnknownTokenVersion(t *testing.T) {
+	secret := mustKeys(t, generateSecret())
+
+	token, err := sign("marek", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rest, _ := strings.Cut(token, ".")
+	for _, bad := range []string{"v2." + rest, rest, ""} {
+		if _, err := verifyToken(bad, secret, time.Minute); !errors.Is(err, errTokenVersion) {
+			t.Errorf("token %#v: expected %v, got %v", bad, errTokenVersion, err)
+		}
+	}
+
+	if _, err := verifyToken("v1.AAAA", secret, time.Minute); !errors.Is(err, errTokenFormat) {
+		t.Errorf("short token: expected %v, got %v", errTokenFormat, err)
+	}
+}
+
+func TestSecretToKeys(t *testing.T) {
+	seed := generateSecret()
+
+	for _, bad := range []string{"", "nonsense", seed + "," + seed, "a:" + seed + ",a:" + generateSecret()} {
+		if _, err := secretToKeys(bad); err == nil {
+			t.Errorf("secret %#v should be rejected", bad)
+		}
+	}
+
+	keys, err := secretToKeys(seed + ", k2:" + generateSecret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, len(keys), 2, "number of keys")
+	expectEqual(t, keys[1].id, "k2", "explicit key id")
+}
+
+func TestSignedURLScope(t *testing.T) {
+	secret := mustKeys(t, generateSecret())
+	id := uuid.New()
+
+	sig, err := signURL("marek", secret, http.MethodGet, id, "data", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := verifyURL(sig, secret, http.MethodGet, id, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, p.Username, "marek", "username")
+
+	if _, err := verifyURL(sig, secret, http.MethodPost, id, "data"); err == nil {
+		t.Error("signature accepted for another method")
+	}
+	if _, err := verifyURL(sig, secret, http.MethodGet, uuid.New(), "data"); err == nil {
+		t.Error("signature accepted for another file")
+	}
+	if _, err := verifyURL(sig, secret, http.MethodGet, id, "meta"); err == nil {
+		t.Error("signature accepted for another section")
+	}
+
+	// a session token is not a URL signature
+	token, err := sign("marek", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyURL(token, secret, http.MethodGet, id, "data"); err == nil {
+		t.Error("session token accepted as a URL signature")
+	}
+
+	sig, err = signURL("marek", secret, http.MethodGet, id, "data", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyURL(sig, secret, http.MethodGet, id, "data"); err == nil {
+		t.Error("expired signature accepted")
+	}
+}
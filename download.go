@@ -0,0 +1,231 @@
+package main
+
+// GET /api/v1/fs/download/{uuid}?format=zip|tar.gz&section=data streams the
+// subtree as an archive built on the fly. Record names are used as paths,
+// directories the user can't read are skipped along with their content and so
+// are files that don't have the section.
+
+import (
+	"archiiv/fs"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// archiveWriter is the common part of zip and tar
+type archiveWriter interface {
+	addDir(name string, modified time.Time) error
+	addFile(name string, size int64, modified time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ w *zip.Writer }
+
+func (a zipArchive) addDir(name string, modified time.Time) error {
+	_, err := a.w.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modified})
+	return err
+}
+
+func (a zipArchive) addFile(name string, size int64, modified time.Time, r io.Reader) error {
+	w, err := a.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a zipArchive) Close() error {
+	return a.w.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (a tarGzArchive) addDir(name string, modified time.Time) error {
+	return a.w.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modified})
+}
+
+func (a tarGzArchive) addFile(name string, size int64, modified time.Time, r io.Reader) error {
+	err := a.w.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.w, r)
+	return err
+}
+
+func (a tarGzArchive) Close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// archiveName turns a record name into a single path element
+func archiveName(name string) string {
+	name = strings.ReplaceAll(name, "/", "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// uniqueName appends a counter before the extension until the name is not
+// taken yet: photo.jpg, photo (2).jpg, photo (3).jpg...
+func uniqueName(taken map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	taken[unique] = true
+	return unique
+}
+
+type archiveBuilder struct {
+	files    *fs.Fs
+	username string
+	section  string
+	w        archiveWriter
+	// directories already in the archive. A directory mounted several
+	// times in the tree is written out once, its other places are empty
+	// directories. Otherwise the archive could grow exponentially
+	seen map[uuid.UUID]bool
+}
+
+func (b archiveBuilder) addDir(dir uuid.UUID, prefix string) error {
+	if b.seen[dir] {
+		return nil
+	}
+	b.seen[dir] = true
+
+	entries, err := b.files.GetEntries(dir)
+	if err != nil {
+		return err
+	}
+
+	taken := map[string]bool{}
+	for _, e := range entries {
+		if checkPerm(b.files, e.UUID, b.username, fs.PermRead) != nil {
+			continue
+		}
+
+		name := prefix + uniqueName(taken, archiveName(e.Name))
+
+		if e.IsDir {
+			if err := b.w.addDir(name, time.Now()); err != nil {
+				return err
+			}
+			if err := b.addDir(e.UUID, name+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := b.addFile(e.UUID, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b archiveBuilder) addFile(id uuid.UUID, name string) error {
+	f, err := b.files.OpenSection(id, b.section)
+	if err != nil {
+		// files without the section are left out
+		return nil
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return b.w.addFile(name, fi.Size(), fi.ModTime(), f)
+}
+
+func handleDownload(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		section := r.URL.Query().Get("section")
+		if section == "" {
+			section = "data"
+		}
+		if section == "meta" {
+			sendError(log, w, http.StatusBadRequest, "the meta section can't be downloaded")
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "zip"
+		}
+		if format != "zip" && format != "tar.gz" {
+			sendError(log, w, http.StatusBadRequest, "format must be zip or tar.gz")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		dir, e := files.GetEntry(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+		if !dir.IsDir {
+			sendError(log, w, http.StatusBadRequest, "not a directory")
+			return
+		}
+
+		name := archiveName(dir.Name)
+		var aw archiveWriter
+		if format == "zip" {
+			w.Header().Set("Content-Type", "application/zip")
+			aw = zipArchive{zip.NewWriter(w)}
+		} else {
+			w.Header().Set("Content-Type", "application/gzip")
+			gz := gzip.NewWriter(w)
+			aw = tarGzArchive{gz, tar.NewWriter(gz)}
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, strings.ReplaceAll(name, `"`, "_"), format))
+
+		// the archive has a single top level directory like most archives
+		// people download
+		e = aw.addDir(name, time.Now())
+		if e == nil {
+			e = archiveBuilder{files: files, username: username, section: section, w: aw, seen: map[uuid.UUID]bool{}}.addDir(id, name+"/")
+		}
+		if e == nil {
+			e = aw.Close()
+		}
+		// once the archive is streaming there is no way to report an error
+		// other than cutting the response short
+		if e != nil {
+			log.Error("download failed", "uuid", id, "error", e)
+		}
+	})
+}
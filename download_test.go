@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDownloadDirectory(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	srv, root := env.srv, env.root
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	upload := func(id uuid.UUID, section, content string) {
+		res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+id.String()+"/"+section, token, strings.NewReader(content))
+		expectStatusCode(t, res, http.StatusOK)
+	}
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	upload(touchHelper(t, srv, token, album, "photo.jpg"), "data", "first")
+	second := touchHelper(t, srv, token, album, "second.jpg")
+	upload(second, "data", "second")
+	upload(second, "thumbnail", "small")
+	// directories written by older versions can hold duplicate names
+	renameOnDisk(t, env, second, "photo.jpg")
+	// no data section so it is left out
+	touchHelper(t, srv, token, album, "empty.jpg")
+	sub := mkdirHelper(t, srv, token, album, "sub")
+	upload(touchHelper(t, srv, token, sub, "nested.txt"), "data", "nested")
+
+	// readable only by ema
+	secret := touchHelper(t, srv, emaToken, root, "secret.txt")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+secret.String()+"/data", emaToken, strings.NewReader("secret"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [{"op": "set_perms", "uuid": "`+album.String()+`", "user": "ema", "perms": 4}]}`))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/mount/"+album.String()+"/"+secret.String(), emaToken, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	srv = startTestServer(t, env.dir, env.root, env.secret)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/download/"+album.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, res.Header.Get("Content-Type"), "application/zip", "content type")
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(content)
+	}
+
+	expectEqual(t, len(got), 5, "entries in the zip")
+	expectEqual(t, got["album/photo.jpg"], "first", "first photo")
+	expectEqual(t, got["album/photo (2).jpg"], "second", "second photo")
+	expectEqual(t, got["album/sub/nested.txt"], "nested", "nested file")
+	for _, name := range []string{"album/", "album/sub/"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/download/"+album.String()+"?format=tar.gz&section=thumbnail", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "album/photo (2).jpg" {
+			content, _ := io.ReadAll(tr)
+			expectEqual(t, string(content), "small", "thumbnail")
+		}
+	}
+	expectEqual(t, slices.Equal(names, []string{"album/", "album/photo (2).jpg", "album/sub/"}), true, "entries in the tar")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/download/"+album.String()+"?format=rar", token, nil)
+	expectStatusCode(t, res, http.StatusBadRequest)
+}
+
+func TestDownloadSharedDirectoryOnce(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	a := mkdirHelper(t, srv, token, album, "a")
+	b := mkdirHelper(t, srv, token, album, "b")
+	shared := mkdirHelper(t, srv, token, a, "shared")
+	photo := touchHelper(t, srv, token, shared, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("babička"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/mount/"+b.String()+"/"+shared.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/download/"+album.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+
+	expectEqual(t, strings.Join(names, " "), "album/ album/a/ album/a/shared/ album/a/shared/photo.jpg album/b/ album/b/shared/", "entries in the zip")
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"archiiv/fs"
+	"archiiv/lease"
 	"archiiv/user"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -26,6 +28,20 @@ func sendOK(log *slog.Logger, w http.ResponseWriter, v any) {
 	}
 }
 
+// sendAccepted tells the client that a background job was started
+func sendAccepted(log *slog.Logger, w http.ResponseWriter, v any) {
+	err := encode(w, http.StatusAccepted, struct {
+		Ok   bool `json:"ok"`
+		Data any  `json:"data"`
+	}{
+		Ok:   true,
+		Data: v,
+	})
+	if err != nil {
+		log.Error("failed to send accepted reponse", "error", err)
+	}
+}
+
 func logAccesses(log *slog.Logger, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Info("request", "url", r.URL.Path)
@@ -33,8 +49,17 @@ func logAccesses(log *slog.Logger, h http.Handler) http.Handler {
 	})
 }
 
-func requireLogin(secret string, log *slog.Logger, h http.Handler) http.Handler {
+func requireLogin(secret []signingKey, log *slog.Logger, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a, ok := r.Context().Value(keyAuthKey).(keyAuth); ok {
+			if !a.allows(r) {
+				sendError(log, w, http.StatusForbidden, "the API key doesn't allow this")
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
 		token := getSessionToken(r)
 		if validateToken(secret, token) {
 			h.ServeHTTP(w, r)
@@ -44,10 +69,24 @@ func requireLogin(secret string, log *slog.Logger, h http.Handler) http.Handler
 	})
 }
 
-func handleLogin(secret string, log *slog.Logger, userStore user.UserStore) http.Handler {
+// allowPub serves requests without a token as the pub user, so files whose
+// perms let pub in can be used without an account. A token that is sent has
+// to be valid though
+func allowPub(secret []signingKey, log *slog.Logger, h http.Handler) http.Handler {
+	login := requireLogin(secret, log, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getSessionToken(r) == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		login.ServeHTTP(w, r)
+	})
+}
+
+func handleLogin(secret []signingKey, log *slog.Logger, userStore *user.UserStore) http.Handler {
 	type LoginRequest struct {
-		Username string   `json:"username"`
-		Password [64]byte `json:"password"`
+		Username string `json:"username"`
+		Password string `json:"password"`
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lr, err := decode[LoginRequest](r)
@@ -56,13 +95,11 @@ func handleLogin(secret string, log *slog.Logger, userStore user.UserStore) http
 			return
 		}
 
-		ok, token := login(lr.Username, lr.Password, secret, userStore)
+		ok, tokens := login(lr.Username, lr.Password, secret, userStore)
 
 		if ok {
 			log.Info("New login", "user", lr.Username)
-			sendOK(log, w, struct {
-				Token string `json:"token"`
-			}{Token: token})
+			sendOK(log, w, tokens)
 			return
 		} else {
 			log.Info("Failed login", "user", lr.Username)
@@ -72,7 +109,7 @@ func handleLogin(secret string, log *slog.Logger, userStore user.UserStore) http
 	})
 }
 
-func handleWhoami(secret string, log *slog.Logger) http.Handler {
+func handleWhoami(secret []signingKey, log *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		name := getUsername(r, secret)
 		sendOK(log, w, struct {
@@ -81,7 +118,40 @@ func handleWhoami(secret string, log *slog.Logger) http.Handler {
 	})
 }
 
-func handleLs(fs *fs.Fs, log *slog.Logger) http.Handler {
+// fileStat is the full information about a file as seen by the user
+type fileStat struct {
+	fs.Stat
+	Meta  *fs.FileMeta  `json:"meta"`
+	Perms uint8         `json:"perms"`
+	Locks []lease.Lease `json:"locks"`
+}
+
+func statFile(files *fs.Fs, id uuid.UUID, username string) (fileStat, error) {
+	st, err := files.Stat(id)
+	if err != nil {
+		return fileStat{}, err
+	}
+
+	fst := fileStat{Stat: st}
+
+	// files without metadata are accessible only to root
+	fm, err := fs.ReadFileMeta(files, id)
+	if err == nil {
+		fst.Meta = &fm
+		fst.Perms = fm.EffectivePerms(username)
+	} else {
+		fst.Perms = fs.FileMeta{}.EffectivePerms(username)
+	}
+
+	// users who can't read the file learn only what they may do with it
+	if fst.Perms&fs.PermRead == 0 {
+		return fileStat{Stat: fs.Stat{UUID: id}, Perms: fst.Perms}, nil
+	}
+
+	return fst, nil
+}
+
+func handleLs(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uuidArg := r.PathValue("uuid")
 
@@ -91,22 +161,42 @@ func handleLs(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		ch, e := fs.GetChildren(id)
+		ch, e := files.GetChildren(id)
 		if e != nil {
 			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
 			return
 		}
 
-		// TODO(matěj) check permission
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		setRecordETag(w, files, id)
+
+		if r.URL.Query().Get("stat") != "true" {
+			sendOK(log, w, ch)
+			return
+		}
+
+		stats := make([]fileStat, 0, len(ch))
+		for _, c := range ch {
+			st, e := statFile(files, c, username)
+			if e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("stat: %v", e))
+				return
+			}
+			stats = append(stats, st)
+		}
 
-		sendOK(log, w, ch)
+		sendOK(log, w, stats)
 	})
 }
 
-func handleCat(fs *fs.Fs, log *slog.Logger) http.Handler {
+func handleStat(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uuidArg := r.PathValue("uuid")
-		sectionArg := r.PathValue("section")
 
 		id, e := uuid.Parse(uuidArg)
 		if e != nil {
@@ -114,24 +204,53 @@ func handleCat(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		// anyone may stat a file, the response tells them what they
+		// are allowed to do with it. The rest is only for readers
+		st, e := statFile(files, id, getUsername(r, secret))
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		if st.Perms&fs.PermRead == 0 {
+			sendOK(log, w, st)
+			return
+		}
+
+		st.Locks = locks.List(id)
+		w.Header().Set("ETag", recordETag(st.Version))
+		sendOK(log, w, st)
+	})
+}
+
+func handleCat(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuidArg := r.PathValue("uuid")
+		sectionArg := r.PathValue("section")
 
-		sectionReader, e := fs.OpenSection(id, sectionArg)
+		id, e := uuid.Parse(uuidArg)
 		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("open section: %v", e))
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
 			return
 		}
 
-		if _, e = io.Copy(w, sectionReader); e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("io copy: %v", e))
+		if e = checkPerm(files, id, getUsername(r, secret), fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
 			return
 		}
 
-		sendOK(log, w, nil)
+		sectionFile, e := files.OpenSection(id, sectionArg)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("open section: %v", e))
+			return
+		}
+		defer sectionFile.Close()
+
+		serveSection(log, w, r, files, id, sectionArg, sectionFile)
 	})
 }
 
-func handleUpload(log *slog.Logger, fs *fs.Fs) http.Handler {
+func handleUpload(secret []signingKey, log *slog.Logger, files *fs.Fs, locks *lease.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uuidArg := r.PathValue("uuid")
 		sectionArg := r.PathValue("section")
@@ -143,24 +262,49 @@ func handleUpload(log *slog.Logger, fs *fs.Fs) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		username := getUsername(r, secret)
+		if e = checkPerm(files, uuid, username, sectionWritePerm(sectionArg)); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, uuid) {
+			return
+		}
+
+		version, e := sectionIfMatch(r, files, uuid, sectionArg)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
 
-		sectionWriter, e := fs.CreateSection(uuid, sectionArg)
+		sectionWriter, e := files.CreateSectionIf(uuid, sectionArg, version)
 		if e != nil {
 			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("create section: %v", e))
 			return
 		}
+		defer sectionWriter.Abort()
 
 		if _, e = io.Copy(sectionWriter, r.Body); e != nil {
 			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("io copy: %v", e))
 			return
 		}
 
+		e = sectionWriter.Close()
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("close section: %v", e))
+			return
+		}
+
 		sendOK(log, w, nil)
 	})
 }
 
-func handleTouch(fs *fs.Fs, log *slog.Logger) http.Handler {
+func handleTouch(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
 	type OkResponse struct {
 		NewFileUUID uuid.UUID `json:"new_file_uuid"`
 	}
@@ -175,19 +319,52 @@ func handleTouch(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		username := getUsername(r, secret)
+		if e = checkPerm(files, parentID, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentID) {
+			return
+		}
+
+		version, e := recordIfMatch(r, files, parentID)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
 
-		fileID, e := fs.Touch(parentID, name)
+		fileID, e := files.TouchIf(parentID, name, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		}
+		if errors.Is(e, fs.ErrBadName) {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		}
 		if e != nil {
 			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("touch: %v", e))
 			return
 		}
 
+		e = fs.WriteFileMeta(files, fileID, fs.NewFileMeta(fileID, username))
+		if e != nil {
+			_ = files.Unmount(parentID, fileID)
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("write meta: %v", e))
+			return
+		}
+
 		sendOK(log, w, OkResponse{NewFileUUID: fileID})
 	})
 }
 
-func handleMkdir(fs *fs.Fs, log *slog.Logger) http.Handler {
+func handleMkdir(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
 	type OkResponse struct {
 		NewDirUUID uuid.UUID `json:"new_dir_uuid"`
 	}
@@ -202,19 +379,52 @@ func handleMkdir(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, id) {
+			return
+		}
+
+		version, e := recordIfMatch(r, files, id)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
 
-		fileID, e := fs.Mkdir(id, name)
+		fileID, e := files.MkdirIf(id, name, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		}
+		if errors.Is(e, fs.ErrBadName) {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		}
 		if e != nil {
 			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("mkdir: %v", e))
 			return
 		}
 
+		e = fs.WriteFileMeta(files, fileID, fs.NewFileMeta(fileID, username))
+		if e != nil {
+			_ = files.Unmount(id, fileID)
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("write meta: %v", e))
+			return
+		}
+
 		sendOK(log, w, OkResponse{NewDirUUID: fileID})
 	})
 }
 
-func handleMount(fs *fs.Fs, log *slog.Logger) http.Handler {
+func handleMount(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		parentArg := r.PathValue("parentUUID")
 		childArg := r.PathValue("childUUID")
@@ -231,9 +441,35 @@ func handleMount(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		username := getUsername(r, secret)
+		if e = checkPerm(files, parentUUID, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+		if e = checkPerm(files, childUUID, username, fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentUUID) {
+			return
+		}
+
+		version, e := recordIfMatch(r, files, parentUUID)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
 
-		e = fs.Mount(parentUUID, childUUID)
+		e = files.MountIf(parentUUID, childUUID, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		}
+		if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		}
 		if e != nil {
 			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("parse uuid: %v", e))
 			return
@@ -243,7 +479,7 @@ func handleMount(fs *fs.Fs, log *slog.Logger) http.Handler {
 	})
 }
 
-func handleUnmount(fs *fs.Fs, log *slog.Logger) http.Handler {
+func handleUnmount(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		parentArg := r.PathValue("parentUUID")
 		childArg := r.PathValue("childUUID")
@@ -260,9 +496,27 @@ func handleUnmount(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		username := getUsername(r, secret)
+		if e = checkPerm(files, parentUUID, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentUUID, childUUID) {
+			return
+		}
+
+		version, e := recordIfMatch(r, files, parentUUID)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
 
-		e = fs.Unmount(parentUUID, childUUID)
+		e = files.UnmountIf(parentUUID, childUUID, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		}
 		if e != nil {
 			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("parse uuid: %v", e))
 			return
@@ -271,3 +525,99 @@ func handleUnmount(fs *fs.Fs, log *slog.Logger) http.Handler {
 		sendOK(log, w, nil)
 	})
 }
+
+func handleRename(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuidArg := r.PathValue("uuid")
+		name := r.PathValue("name")
+
+		id, e := uuid.Parse(uuidArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, id) {
+			return
+		}
+
+		version, e := recordIfMatch(r, files, id)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
+
+		e = files.RenameIf(id, name, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		} else if errors.Is(e, fs.ErrBadName) {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		} else if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		} else if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("rename: %v", e))
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+func handleMove(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ids [3]uuid.UUID
+		for i, arg := range []string{"fromUUID", "uuid", "toUUID"} {
+			id, e := uuid.Parse(r.PathValue(arg))
+			if e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+				return
+			}
+			ids[i] = id
+		}
+		from, id, to := ids[0], ids[1], ids[2]
+
+		username := getUsername(r, secret)
+		if checkPerm(files, from, username, fs.PermWrite) != nil || checkPerm(files, to, username, fs.PermWrite) != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+		if checkPerm(files, id, username, fs.PermRead) != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, from, id, to) {
+			return
+		}
+
+		// the client has seen the record in the source directory
+		version, e := recordIfMatch(r, files, from)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
+
+		e = files.MoveIf(from, id, to, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		} else if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		} else if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("move: %v", e))
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
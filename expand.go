@@ -0,0 +1,378 @@
+package main
+
+// POST /api/v1/fs/expand/{uuid}?format=zip|tar|tar.gz unpacks the archive in
+// the request body into the directory. Directories of the archive that exist
+// already are merged into, files are never overwritten. Every entry is
+// reported separately so a few bad entries don't fail a huge upload.
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var errExpandLimit = errors.New("the expand size limit is exceeded")
+
+type expandResult struct {
+	Path  string    `json:"path"`
+	UUID  uuid.UUID `json:"uuid"`
+	IsDir bool      `json:"is_dir"`
+	Size  int64     `json:"size"`
+	Error string    `json:"error,omitempty"`
+}
+
+type expander struct {
+	files    *fs.Fs
+	locks    *lease.Store
+	username string
+	root     uuid.UUID
+	// remaining bytes of the limit, negative if there is no limit
+	remaining int64
+	dirs      map[string]uuid.UUID
+	results   []expandResult
+}
+
+// splitArchivePath turns the path of an archive entry into names of records
+func splitArchivePath(p string) ([]string, error) {
+	var names []string
+	for _, n := range strings.Split(strings.ReplaceAll(p, `\`, "/"), "/") {
+		switch n {
+		case "", ".":
+			continue
+		case "..":
+			return nil, errors.New("the path leads outside of the archive")
+		}
+		names = append(names, n)
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("empty path")
+	}
+
+	return names, nil
+}
+
+func (x *expander) fail(p string, isDir bool, err error) {
+	x.results = append(x.results, expandResult{Path: p, IsDir: isDir, Error: err.Error()})
+}
+
+// dir returns the directory at the path, creating the missing ones
+func (x *expander) dir(names []string) (uuid.UUID, error) {
+	id := x.root
+	for i, name := range names {
+		p := strings.Join(names[:i+1], "/")
+		if known, ok := x.dirs[p]; ok {
+			id = known
+			continue
+		}
+
+		existing, err := x.files.Resolve(id, name)
+		if err == nil {
+			e, err := x.files.GetEntry(existing)
+			if err != nil {
+				return uuid.Nil, err
+			}
+			if !e.IsDir {
+				return uuid.Nil, fmt.Errorf("%s is not a directory", p)
+			}
+			if checkPerm(x.files, existing, x.username, fs.PermWrite) != nil {
+				return uuid.Nil, fmt.Errorf("%s: %w", p, errPermissionDenied)
+			}
+			if err := x.locks.CheckWrite(existing, x.username); err != nil {
+				return uuid.Nil, fmt.Errorf("%s: %w", p, err)
+			}
+			x.dirs[p] = existing
+			id = existing
+			continue
+		}
+
+		created, err := x.files.Mkdir(id, name)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("mkdir %s: %w", p, err)
+		}
+		if err := fs.WriteFileMeta(x.files, created, fs.NewFileMeta(created, x.username)); err != nil {
+			return uuid.Nil, fmt.Errorf("write meta: %w", err)
+		}
+
+		x.results = append(x.results, expandResult{Path: p, UUID: created, IsDir: true})
+		x.dirs[p] = created
+		id = created
+	}
+
+	return id, nil
+}
+
+func (x *expander) addDir(p string) {
+	names, err := splitArchivePath(p)
+	if err != nil {
+		x.fail(p, true, err)
+		return
+	}
+
+	if _, err := x.dir(names); err != nil {
+		x.fail(p, true, err)
+	}
+}
+
+func (x *expander) addFile(p string, size int64, r io.Reader) {
+	names, err := splitArchivePath(p)
+	if err != nil {
+		x.fail(p, false, err)
+		return
+	}
+
+	if x.remaining >= 0 && size > x.remaining {
+		x.fail(p, false, errExpandLimit)
+		return
+	}
+
+	parent, err := x.dir(names[:len(names)-1])
+	if err != nil {
+		x.fail(p, false, err)
+		return
+	}
+
+	name := names[len(names)-1]
+	if _, err := x.files.Resolve(parent, name); err == nil {
+		x.fail(p, false, fs.ErrNameExists)
+		return
+	}
+
+	id, n, err := x.createFile(parent, name, r)
+	if err != nil {
+		x.fail(p, false, err)
+		return
+	}
+
+	if x.remaining >= 0 {
+		x.remaining -= n
+	}
+	x.results = append(x.results, expandResult{Path: strings.Join(names, "/"), UUID: id, Size: n})
+}
+
+func (x *expander) createFile(parent uuid.UUID, name string, r io.Reader) (id uuid.UUID, n int64, err error) {
+	id, err = x.files.Touch(parent, name)
+	if err != nil {
+		return uuid.Nil, 0, fmt.Errorf("touch: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = x.files.Unmount(parent, id)
+		}
+	}()
+
+	if err = fs.WriteFileMeta(x.files, id, fs.NewFileMeta(id, x.username)); err != nil {
+		return uuid.Nil, 0, fmt.Errorf("write meta: %w", err)
+	}
+
+	sw, err := x.files.CreateSection(id, "data")
+	if err != nil {
+		return uuid.Nil, 0, fmt.Errorf("create section: %w", err)
+	}
+	defer sw.Abort()
+
+	// the sizes in the archive headers can't be trusted
+	if x.remaining >= 0 {
+		r = io.LimitReader(r, x.remaining+1)
+	}
+
+	n, err = io.Copy(sw, r)
+	if err != nil {
+		return uuid.Nil, 0, fmt.Errorf("io copy: %w", err)
+	}
+	if x.remaining >= 0 && n > x.remaining {
+		return uuid.Nil, 0, errExpandLimit
+	}
+
+	if err = sw.Close(); err != nil {
+		return uuid.Nil, 0, fmt.Errorf("close section: %w", err)
+	}
+
+	return id, n, nil
+}
+
+func (x *expander) expandTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			x.addDir(hdr.Name)
+		case tar.TypeReg:
+			x.addFile(hdr.Name, hdr.Size, tr)
+		case tar.TypeXGlobalHeader:
+		default:
+			x.fail(hdr.Name, false, fmt.Errorf("unsupported entry type %q", hdr.Typeflag))
+		}
+	}
+}
+
+func (x *expander) expandZip(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			x.addDir(zf.Name)
+			continue
+		}
+
+		if !zf.Mode().IsRegular() {
+			x.fail(zf.Name, false, errors.New("unsupported entry type"))
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			x.fail(zf.Name, false, err)
+			continue
+		}
+		x.addFile(zf.Name, int64(zf.UncompressedSize64), rc)
+		rc.Close()
+	}
+
+	return nil
+}
+
+// spoolBody saves the request body into a temporary file because zip files
+// can't be read as a stream
+func spoolBody(tmpDir string, r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp(tmpDir, "expand-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	// the file stays open until the caller closes it
+	_ = os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func archiveFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	switch r.Header.Get("Content-Type") {
+	case "application/zip":
+		return "zip"
+	case "application/gzip", "application/x-gzip":
+		return "tar.gz"
+	default:
+		return "tar"
+	}
+}
+
+func handleExpand(secret []signingKey, files *fs.Fs, log *slog.Logger, tmpDir string, limit int64, locks *lease.Store) http.Handler {
+	type OkResponse struct {
+		Created int            `json:"created"`
+		Failed  int            `json:"failed"`
+		Entries []expandResult `json:"entries"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		format := archiveFormat(r)
+		if format != "zip" && format != "tar" && format != "tar.gz" {
+			sendError(log, w, http.StatusBadRequest, "format must be zip, tar or tar.gz")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, id) {
+			return
+		}
+
+		if dir, e := files.GetEntry(id); e != nil || !dir.IsDir {
+			sendError(log, w, http.StatusBadRequest, "not a directory")
+			return
+		}
+
+		x := &expander{
+			files:     files,
+			locks:     locks,
+			username:  username,
+			root:      id,
+			remaining: -1,
+			dirs:      map[string]uuid.UUID{},
+			results:   []expandResult{},
+		}
+		if limit > 0 {
+			x.remaining = limit
+		}
+
+		switch format {
+		case "zip":
+			var f *os.File
+			f, e = spoolBody(tmpDir, r.Body)
+			if e == nil {
+				e = x.expandZip(f)
+				f.Close()
+			}
+		case "tar":
+			e = x.expandTar(r.Body)
+		case "tar.gz":
+			var gz *gzip.Reader
+			gz, e = gzip.NewReader(r.Body)
+			if e == nil {
+				e = x.expandTar(gz)
+			}
+		}
+
+		// the entries created before a broken part of the archive are kept
+		// and reported
+		if e != nil {
+			x.fail("", false, fmt.Errorf("read archive: %w", e))
+		}
+
+		res := OkResponse{Entries: x.results}
+		for _, er := range x.results {
+			if er.Error == "" {
+				res.Created++
+			} else {
+				res.Failed++
+			}
+		}
+
+		sendOK(log, w, res)
+	})
+}
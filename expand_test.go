@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type expandResponse struct {
+	Ok   bool `json:"ok"`
+	Data struct {
+		Created int            `json:"created"`
+		Failed  int            `json:"failed"`
+		Entries []expandResult `json:"entries"`
+	} `json:"data"`
+}
+
+func zipHelper(t *testing.T, files map[string]string, order []string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range order {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExpandZip(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	takeout := mkdirHelper(t, srv, token, root, "takeout")
+	existing := mkdirHelper(t, srv, token, takeout, "Photos")
+	touchHelper(t, srv, token, existing, "taken.jpg")
+
+	archive := zipHelper(t, map[string]string{
+		"Photos/a.jpg":     "aaa",
+		"Photos/taken.jpg": "bbb",
+		"Mail/2024/x.mbox": "mail",
+		"../escape.txt":    "nope",
+		"Mail/":            "",
+	}, []string{"Photos/a.jpg", "Photos/taken.jpg", "Mail/", "Mail/2024/x.mbox", "../escape.txt"})
+
+	raw := hitAuth(srv, http.MethodPost, "/api/v1/fs/expand/"+takeout.String()+"?format=zip", token, bytes.NewReader(archive))
+	expectStatusCode(t, raw, http.StatusOK)
+	res := decodeResponse[expandResponse](t, raw).Data
+
+	// Mail, Mail/2024, Mail/2024/x.mbox and Photos/a.jpg
+	expectEqual(t, res.Created, 4, "created entries")
+	expectEqual(t, res.Failed, 2, "failed entries")
+
+	byPath := map[string]expandResult{}
+	for _, e := range res.Entries {
+		byPath[e.Path] = e
+	}
+	expectEqual(t, byPath["Photos/taken.jpg"].Error != "", true, "existing file is not overwritten")
+	expectEqual(t, byPath["../escape.txt"].Error != "", true, "path outside the archive")
+
+	photos := lsHelper(t, srv, token, existing)
+	expectEqual(t, len(photos), 2, "merged directory")
+	raw = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+byPath["Mail/2024/x.mbox"].UUID.String()+"/data", token, nil)
+	expectBody(t, raw, "mail")
+}
+
+func TestExpandTarLimit(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")}, "--expand_limit", "5")
+	token := loginHelper(t, env.srv, "marek", "heslo")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{{"a.txt", "abc"}, {"b.txt", "defg"}, {"c.txt", "h"}} {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := hitAuth(env.srv, http.MethodPost, "/api/v1/fs/expand/"+env.root.String(), token, &buf)
+	expectStatusCode(t, raw, http.StatusOK)
+	res := decodeResponse[expandResponse](t, raw).Data
+	expectEqual(t, res.Created, 2, "created entries")
+	expectEqual(t, res.Entries[1].Path, "b.txt", "entry over the limit")
+	expectEqual(t, res.Entries[1].Error, errExpandLimit.Error(), "error of the entry over the limit")
+	expectEqual(t, res.Entries[1].UUID, uuid.Nil, "uuid of a failed entry")
+}
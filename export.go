@@ -0,0 +1,407 @@
+package main
+
+// Subtrees are exported as tar archives with this layout:
+//
+// manifest.json              the exportManifest, always the first entry
+// sections/$uuid.$section    the content of a section, except 'meta'
+//
+// The metadata of every record is stored in the manifest so that it can be
+// fixed up (new uuids, unknown users) before it is written on import.
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/user"
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	exportVersion      = 1
+	exportManifestName = "manifest.json"
+	exportSectionsDir  = "sections/"
+	// the manifest is decoded in memory
+	exportMaxManifestSize = 256 << 20
+)
+
+type exportRecord struct {
+	UUID     uuid.UUID    `json:"uuid"`
+	Name     string       `json:"name"`
+	IsDir    bool         `json:"is_dir"`
+	Children []uuid.UUID  `json:"children,omitempty"`
+	Sections []string     `json:"sections,omitempty"`
+	Meta     *fs.FileMeta `json:"meta,omitempty"`
+}
+
+type exportManifest struct {
+	Version  int            `json:"version"`
+	Root     uuid.UUID      `json:"root"`
+	Exported time.Time      `json:"exported"`
+	Records  []exportRecord `json:"records"`
+}
+
+// buildManifest walks the subtree and collects the records the user can read
+func buildManifest(files *fs.Fs, root uuid.UUID, username string) (exportManifest, error) {
+	m := exportManifest{Version: exportVersion, Root: root, Exported: time.Now().UTC()}
+
+	seen := map[uuid.UUID]bool{}
+	var walk func(id uuid.UUID) error
+	walk = func(id uuid.UUID) error {
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+
+		st, err := files.GetEntry(id)
+		if err != nil {
+			return err
+		}
+
+		rec := exportRecord{UUID: id, Name: st.Name, IsDir: st.IsDir}
+
+		sections, err := files.ListSections(id)
+		if err != nil {
+			return err
+		}
+		rec.Sections = slices.DeleteFunc(sections, func(s string) bool { return s == "meta" })
+
+		if fm, err := fs.ReadFileMeta(files, id); err == nil {
+			rec.Meta = &fm
+		}
+
+		children, err := files.GetChildren(id)
+		if err != nil {
+			return err
+		}
+
+		// reserve the slot so that parents come before children
+		i := len(m.Records)
+		m.Records = append(m.Records, rec)
+
+		for _, c := range children {
+			if checkPerm(files, c, username, fs.PermRead) != nil {
+				continue
+			}
+			if err := walk(c); err != nil {
+				return err
+			}
+			m.Records[i].Children = append(m.Records[i].Children, c)
+		}
+
+		return nil
+	}
+
+	return m, walk(root)
+}
+
+func writeExport(w io.Writer, files *fs.Fs, m exportManifest) error {
+	tw := tar.NewWriter(w)
+
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    exportManifestName,
+		Mode:    0600,
+		Size:    int64(len(mb)),
+		ModTime: m.Exported,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(mb); err != nil {
+		return err
+	}
+
+	for _, rec := range m.Records {
+		for _, s := range rec.Sections {
+			if err := writeExportSection(tw, files, rec.UUID, s); err != nil {
+				return fmt.Errorf("section %s.%s: %w", rec.UUID, s, err)
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeExportSection(tw *tar.Writer, files *fs.Fs, id uuid.UUID, section string) error {
+	f, err := files.OpenSection(id, section)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    exportSectionsDir + id.String() + "." + section,
+		Mode:    0600,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func handleExport(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		m, e := buildManifest(files, id, username)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar"`, id))
+
+		// once the tar is streaming there is no way to report an error
+		// other than cutting the response short
+		if e = writeExport(w, files, m); e != nil {
+			log.Error("export failed", "uuid", id, "error", e)
+		}
+	})
+}
+
+type importOptions struct {
+	preserveUUIDs bool
+	// give the bits of users unknown on this server to the importing user
+	// instead of dropping them
+	unknownToImporter bool
+}
+
+// fixImportedMeta points the metadata to the new uuid and resolves permission
+// entries of users that don't exist on this server
+func fixImportedMeta(meta *fs.FileMeta, id uuid.UUID, importer string, users *user.UserStore, o importOptions) fs.FileMeta {
+	if meta == nil {
+		return fs.NewFileMeta(id, importer)
+	}
+
+	fm := *meta
+	fm.UUID = id
+	fm.Perms = map[string]uint8{}
+	for name, bits := range meta.Perms {
+		if name == fs.UserPub || name == fs.UserRoot || users.Exists(name) {
+			fm.Perms[name] |= bits
+		} else if o.unknownToImporter {
+			fm.Perms[importer] |= bits
+		}
+	}
+	if fm.Hooks == nil {
+		fm.Hooks = []string{}
+	}
+
+	return fm
+}
+
+// readImport creates the subtree described by the archive. The root of the
+// subtree is left pinned and unmounted, see fs.CreateRecords
+func readImport(r io.Reader, files *fs.Fs, users *user.UserStore, importer string, o importOptions) (newRoot uuid.UUID, err error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if hdr.Name != exportManifestName {
+		return uuid.Nil, errors.New("the archive does not start with a manifest")
+	}
+
+	var m exportManifest
+	if err := json.NewDecoder(io.LimitReader(tr, exportMaxManifestSize)).Decode(&m); err != nil {
+		return uuid.Nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if m.Version != exportVersion {
+		return uuid.Nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	mapping := map[uuid.UUID]uuid.UUID{}
+	for _, rec := range m.Records {
+		if o.preserveUUIDs {
+			mapping[rec.UUID] = rec.UUID
+		} else {
+			mapping[rec.UUID] = uuid.New()
+		}
+	}
+
+	recs := make([]fs.TreeRecord, 0, len(m.Records))
+	expected := map[string]bool{}
+	for _, rec := range m.Records {
+		tr := fs.TreeRecord{UUID: mapping[rec.UUID], Name: rec.Name, IsDir: rec.IsDir}
+		for _, c := range rec.Children {
+			nc, ok := mapping[c]
+			if !ok {
+				return uuid.Nil, fmt.Errorf("child %s of %s is missing", c, rec.UUID)
+			}
+			tr.Children = append(tr.Children, nc)
+		}
+		recs = append(recs, tr)
+
+		for _, s := range rec.Sections {
+			// the meta section comes from the manifest, where it is fixed
+			// up for this server
+			if s == "meta" {
+				return uuid.Nil, fmt.Errorf("record %s lists the meta section", rec.UUID)
+			}
+			if err := fs.CheckSectionName(s); err != nil {
+				return uuid.Nil, fmt.Errorf("record %s: %w", rec.UUID, err)
+			}
+			expected[rec.UUID.String()+"."+s] = true
+		}
+	}
+
+	newRoot = mapping[m.Root]
+	if err := files.CreateRecords(newRoot, recs); err != nil {
+		return uuid.Nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = files.Unpin(newRoot)
+		}
+	}()
+
+	for _, rec := range m.Records {
+		fm := fixImportedMeta(rec.Meta, mapping[rec.UUID], importer, users, o)
+		if err = fs.WriteFileMeta(files, mapping[rec.UUID], fm); err != nil {
+			return uuid.Nil, fmt.Errorf("write meta: %w", err)
+		}
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uuid.Nil, err
+		}
+
+		name, ok := strings.CutPrefix(hdr.Name, exportSectionsDir)
+		if !ok || !expected[name] {
+			return uuid.Nil, fmt.Errorf("unexpected entry %#v", hdr.Name)
+		}
+		delete(expected, name)
+
+		idStr, section, _ := strings.Cut(name, ".")
+		if err = importSection(tr, files, mapping[uuid.MustParse(idStr)], section); err != nil {
+			return uuid.Nil, fmt.Errorf("section %s: %w", name, err)
+		}
+	}
+
+	if len(expected) > 0 {
+		return uuid.Nil, errors.New("the archive is missing some sections")
+	}
+
+	return newRoot, nil
+}
+
+func importSection(r io.Reader, files *fs.Fs, id uuid.UUID, section string) error {
+	sw, err := files.CreateSection(id, section)
+	if err != nil {
+		return err
+	}
+	defer sw.Abort()
+
+	if _, err := io.Copy(sw, r); err != nil {
+		return err
+	}
+
+	return sw.Close()
+}
+
+func handleImport(secret []signingKey, files *fs.Fs, log *slog.Logger, users *user.UserStore, locks *lease.Store) http.Handler {
+	type OkResponse struct {
+		NewUUID uuid.UUID `json:"new_uuid"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentID, e := uuid.Parse(r.PathValue("parentUUID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		var o importOptions
+		switch r.URL.Query().Get("uuids") {
+		case "", "remap":
+		case "preserve":
+			o.preserveUUIDs = true
+		default:
+			sendError(log, w, http.StatusBadRequest, "uuids must be remap or preserve")
+			return
+		}
+
+		switch r.URL.Query().Get("unknown_users") {
+		case "", "drop":
+		case "importer":
+			o.unknownToImporter = true
+		default:
+			sendError(log, w, http.StatusBadRequest, "unknown_users must be drop or importer")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, parentID, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentID) {
+			return
+		}
+
+		root, e := readImport(r.Body, files, users, username, o)
+		if errors.Is(e, fs.ErrRecordExists) {
+			sendError(log, w, http.StatusConflict, fmt.Sprintf("import: %v", e))
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("import: %v", e))
+			return
+		}
+
+		e = files.Mount(parentID, root)
+		// the root is mounted now or it should be deleted anyway
+		_ = files.Unpin(root)
+		if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, fmt.Sprintf("mount: %v", e))
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("mount: %v", e))
+			return
+		}
+
+		sendOK(log, w, OkResponse{NewUUID: root})
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func exportHelper(t *testing.T, srv http.Handler, token string, id uuid.UUID) []byte {
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/export/"+id.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, res.Header.Get("Content-Type"), "application/x-tar", "content type")
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestExportImport(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	photo := touchHelper(t, srv, token, album, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("pixels"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	archive := exportHelper(t, srv, token, album)
+	imports := mkdirHelper(t, srv, token, root, "imports")
+
+	// the uuids exist already
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+imports.String()+"?uuids=preserve", token, bytes.NewReader(archive))
+	expectStatusCode(t, res, http.StatusConflict)
+
+	// so does the name
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, bytes.NewReader(archive))
+	expectStatusCode(t, res, http.StatusConflict)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+imports.String(), token, bytes.NewReader(archive))
+	expectStatusCode(t, res, http.StatusOK)
+	imported := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			NewUUID uuid.UUID `json:"new_uuid"`
+		} `json:"data"`
+	}](t, res).Data.NewUUID
+	if imported == album {
+		t.Fatal("import has the same uuid")
+	}
+
+	children := lsHelper(t, srv, token, imported)
+	expectEqual(t, len(children), 1, "children of the import")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+children[0].String()+"/data", token, nil)
+	expectBody(t, res, "pixels")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+children[0].String(), token, nil)
+	st := decodeResponse[statResponse](t, res).Data
+	expectEqual(t, st.Meta.UUID, children[0], "uuid in the imported meta")
+	expectEqual(t, st.Meta.Perms["marek"], fs.PermAll, "perms of marek")
+
+	// another server where marek does not exist
+	other, otherRoot := newTestServerWithRoot(t, map[string][64]byte{"ema": hashPassword("heslo")})
+	emaToken := loginHelper(t, other, "ema", "heslo")
+
+	res = hitAuth(other, http.MethodPost, "/api/v1/fs/import/"+otherRoot.String()+"?uuids=preserve&unknown_users=importer", emaToken, bytes.NewReader(archive))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(other, http.MethodGet, "/api/v1/fs/stat/"+photo.String(), emaToken, nil)
+	st = decodeResponse[statResponse](t, res).Data
+	expectEqual(t, st.Meta.Perms["ema"], fs.PermAll, "perms of the importer")
+	_, hasMarek := st.Meta.Perms["marek"]
+	expectEqual(t, hasMarek, false, "unknown user dropped")
+	res = hitAuth(other, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", emaToken, nil)
+	expectBody(t, res, "pixels")
+}
+
+func TestImportRejectsBrokenArchive(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, strings.NewReader("not a tar"))
+	expectStatusCode(t, res, http.StatusBadRequest)
+
+	// a truncated archive leaves nothing behind
+	album := mkdirHelper(t, srv, token, root, "album")
+	photo := touchHelper(t, srv, token, album, "photo.jpg")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader(strings.Repeat("pixels", 10000)))
+	expectStatusCode(t, res, http.StatusOK)
+	archive := exportHelper(t, srv, token, album)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+album.String(), token, bytes.NewReader(archive[:len(archive)/2]))
+	expectStatusCode(t, res, http.StatusBadRequest)
+	expectEqual(t, len(lsHelper(t, srv, token, album)), 1, "children after a failed import")
+}
+
+func TestImportRejectsMetaSection(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	archive := func(section, content string) []byte {
+		id := uuid.New()
+		manifest, err := json.Marshal(exportManifest{Version: exportVersion, Root: id, Records: []exportRecord{
+			{UUID: id, Name: "photo.jpg", Sections: []string{section}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, f := range []struct{ name, content string }{
+			{exportManifestName, string(manifest)},
+			{exportSectionsDir + id.String() + "." + section, content},
+		} {
+			if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.content))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(f.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	// the meta section would skip fixing the permissions up
+	b := archive("meta", `{"perms":{"pub":7}}`)
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, bytes.NewReader(b))
+	expectStatusCode(t, res, http.StatusBadRequest)
+	b = archive("../x", "x")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, bytes.NewReader(b))
+	expectStatusCode(t, res, http.StatusBadRequest)
+
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 0, "children after the failed imports")
+	b = archive("data", "pixels")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, bytes.NewReader(b))
+	expectStatusCode(t, res, http.StatusOK)
+}
+
+func TestImportRejectsBadNames(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	archive := func(names ...string) []byte {
+		dir := exportRecord{UUID: uuid.New(), Name: "album", IsDir: true}
+		records := []exportRecord{dir}
+		for _, name := range names {
+			rec := exportRecord{UUID: uuid.New(), Name: name}
+			records[0].Children = append(records[0].Children, rec.UUID)
+			records = append(records, rec)
+		}
+		manifest, err := json.Marshal(exportManifest{Version: exportVersion, Root: dir.UUID, Records: records})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		if err := tw.WriteHeader(&tar.Header{Name: exportManifestName, Mode: 0600, Size: int64(len(manifest))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(manifest); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	for _, names := range [][]string{{"a/b"}, {".."}, {""}, {"photo.jpg", "photo.jpg"}} {
+		res := hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, bytes.NewReader(archive(names...)))
+		expectStatusCode(t, res, http.StatusBadRequest)
+	}
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 0, "children after the failed imports")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/import/"+root.String(), token, bytes.NewReader(archive("a.jpg", "b.jpg")))
+	expectStatusCode(t, res, http.StatusOK)
+}
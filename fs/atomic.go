@@ -0,0 +1,315 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// half written files live in $fs_root/.tmp and are renamed to their final
+// place once complete. The directory is wiped on every start
+const tmpDirName = ".tmp"
+
+func (fs *Fs) initTmpDir() error {
+	if err := fs.finishJournals(); err != nil {
+		return fmt.Errorf("finish journals: %w", err)
+	}
+
+	tmp := fs.path(tmpDirName)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	return os.Mkdir(tmp, 0750)
+}
+
+// writeRecords replaces several records at once. The new records are written
+// to $fs_root/.tmp first, then a journal listing them is renamed into place,
+// which is the commit point, and only then the records are renamed over the
+// old ones. A crash before the commit keeps all the old records, after it
+// NewFs finishes the renames, so either all or none of the new records
+// survive. Has to be called with fs.snapLock read locked and the records
+// locked
+func (fs *Fs) writeRecords(recs ...*record) (err error) {
+	if err = fs.checkWritable(); err != nil {
+		return err
+	}
+
+	for _, r := range recs {
+		r.Version++
+	}
+
+	var journal []journalEntry
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, r := range recs {
+			r.Version--
+		}
+		for _, e := range journal {
+			_ = os.Remove(fs.path(filepath.Join(tmpDirName, e.Tmp)))
+		}
+	}()
+
+	for _, r := range recs {
+		var name string
+		name, err = fs.writeTmp(r.id.String(), r)
+		if err != nil {
+			return err
+		}
+		journal = append(journal, journalEntry{Tmp: name, Record: r.id})
+	}
+
+	name, err := fs.writeTmp("journal", journal)
+	if err != nil {
+		return err
+	}
+	committed := fs.path(filepath.Join(tmpDirName, name+journalSuffix))
+	if err = os.Rename(fs.path(filepath.Join(tmpDirName, name)), committed); err != nil {
+		_ = os.Remove(fs.path(filepath.Join(tmpDirName, name)))
+		return err
+	}
+
+	// the write is committed, a rename that fails here is retried by the
+	// next start, which is why the journal then stays
+	done := true
+	for _, e := range journal {
+		if os.Rename(fs.path(filepath.Join(tmpDirName, e.Tmp)), fs.path(e.Record.String())) != nil {
+			done = false
+		}
+	}
+	if done {
+		_ = os.Remove(committed)
+	}
+
+	return nil
+}
+
+// journals of committed writes end with journalSuffix
+const journalSuffix = ".journal"
+
+type journalEntry struct {
+	// name of the new record in $fs_root/.tmp
+	Tmp    string    `json:"tmp"`
+	Record uuid.UUID `json:"record"`
+}
+
+// writeTmp encodes v into a new file in $fs_root/.tmp and syncs it. Returns
+// the name of the file
+func (fs *Fs) writeTmp(prefix string, v any) (string, error) {
+	f, err := os.CreateTemp(fs.path(tmpDirName), prefix+".*")
+	if err != nil {
+		return "", err
+	}
+
+	err = json.NewEncoder(f).Encode(v)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return filepath.Base(f.Name()), nil
+}
+
+// finishJournals completes the writes that were committed but not finished
+// before the last stop. A record is only replaced by a newer version, so a
+// journal that was left behind never undoes a later write
+func (fs *Fs) finishJournals() error {
+	tmp := fs.path(tmpDirName)
+	journals, err := filepath.Glob(filepath.Join(tmp, "*"+journalSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, j := range journals {
+		b, err := os.ReadFile(j)
+		if err != nil {
+			return err
+		}
+
+		var entries []journalEntry
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return fmt.Errorf("decode %s: %w", filepath.Base(j), err)
+		}
+
+		for _, e := range entries {
+			src := filepath.Join(tmp, filepath.Base(e.Tmp))
+			dst := fs.path(e.Record.String())
+
+			newer, err := recordVersionOf(src)
+			if errors.Is(err, os.ErrNotExist) {
+				// renamed already
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			old, err := recordVersionOf(dst)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+
+			if newer > old {
+				if err := os.Rename(src, dst); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func recordVersionOf(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var r struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return 0, fmt.Errorf("decode %s: %w", filepath.Base(path), err)
+	}
+	return r.Version, nil
+}
+
+// SectionWriter writes into a temporary file which replaces the destination
+// file on Close
+type SectionWriter struct {
+	f    *os.File
+	dest string
+	done bool
+	hash hash.Hash
+	fs   *Fs
+	// set for sections, whose commits are serialised by the record lock
+	rec      *record
+	version  uint64
+	onCommit func()
+	// set when the caller holds fs.snapLock for its whole operation
+	snapLocked bool
+}
+
+func (fs *Fs) createAtomic(dest string) (*SectionWriter, error) {
+	if err := fs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(fs.path(tmpDirName), filepath.Base(dest)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &SectionWriter{f: f, dest: dest, hash: sha256.New(), fs: fs}, nil
+}
+
+func (w *SectionWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// Close commits the written content
+func (w *SectionWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if err := w.f.Close(); err != nil {
+		_ = os.Remove(w.f.Name())
+		return err
+	}
+
+	// snapLock comes before the record lock
+	if !w.snapLocked {
+		w.fs.snapLock.RLock()
+		defer w.fs.snapLock.RUnlock()
+	}
+
+	if w.rec != nil {
+		w.rec.lock()
+		defer w.rec.unlock()
+
+		if err := w.checkSectionVersion(); err != nil {
+			_ = os.Remove(w.f.Name())
+			return err
+		}
+	}
+
+	err := os.Rename(w.f.Name(), w.dest)
+	if err != nil {
+		_ = os.Remove(w.f.Name())
+		return err
+	}
+
+	// the hash was computed while writing so there is no need to read the
+	// file again when someone asks for it
+	if fi, err := os.Stat(w.dest); err == nil {
+		w.fs.hashes.put(w.dest, fi, w.hash.Sum(nil))
+	}
+
+	if w.onCommit != nil {
+		w.onCommit()
+	}
+
+	return nil
+}
+
+// checkSectionVersion compares the version of the section being replaced and
+// makes sure that the new content gets a higher one
+func (w *SectionWriter) checkSectionVersion() error {
+	old, err := os.Stat(w.dest)
+	if errors.Is(err, os.ErrNotExist) {
+		if w.version != 0 {
+			return ErrVersionMismatch
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if w.version != 0 && FileVersion(old) != w.version {
+		return ErrVersionMismatch
+	}
+
+	fi, err := os.Stat(w.f.Name())
+	if err != nil {
+		return err
+	}
+
+	// the modification time is the version so it must not stay the same
+	// when two writes happen within the clock resolution
+	if !fi.ModTime().After(old.ModTime()) {
+		mod := old.ModTime().Add(time.Microsecond)
+		return os.Chtimes(w.f.Name(), mod, mod)
+	}
+
+	return nil
+}
+
+// Abort discards the written content. Calling Abort after Close is a no-op so
+// it can be deferred
+func (w *SectionWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	_ = w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+type CopyOptions struct {
+	// Include decides which records of the subtree are copied. Records
+	// that are not included are skipped together with their children. nil
+	// includes everything
+	Include func(uuid.UUID) bool
+	// Progress is called after every copied record with the number of
+	// records copied so far
+	Progress func(copied int)
+	// Meta returns the 'meta' section of the copy new of the record old. It
+	// is written before the copy is mounted, so the copy never shows up
+	// without it. nil leaves the copies without metadata
+	Meta func(old, new uuid.UUID) (FileMeta, error)
+}
+
+// CountTree returns the number of distinct records in the subtree
+func (fs *Fs) CountTree(id uuid.UUID) (int, error) {
+	if _, err := fs.getRecord(id); err != nil {
+		return 0, err
+	}
+
+	seen := map[uuid.UUID]bool{}
+	stack := []uuid.UUID{id}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+
+		r, err := fs.getRecord(u)
+		if err != nil {
+			continue
+		}
+		r.lock()
+		stack = append(stack, r.Children...)
+		r.unlock()
+	}
+
+	return len(seen), nil
+}
+
+// linkOrCopy hard links the file if possible. Sections are replaced by
+// renaming so a hard link behaves like an independent copy
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+type copier struct {
+	from    *Fs
+	fs      *Fs
+	opts    CopyOptions
+	mapping map[uuid.UUID]uuid.UUID
+	created []*record
+}
+
+// has to be called with c.fs.snapLock read locked
+func (c *copier) copyRecord(old uuid.UUID) (*record, error) {
+	if n, ok := c.mapping[old]; ok {
+		return c.fs.getRecord(n)
+	}
+
+	r, err := c.from.getRecord(old)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock()
+	nr := &record{
+		Children: []uuid.UUID{},
+		IsDir:    r.IsDir,
+		Name:     r.Name,
+		id:       uuid.New(),
+		sections: map[string]struct{}{},
+	}
+	children := slices.Clone(r.Children)
+	sections := make([]string, 0, len(r.sections))
+	for s := range r.sections {
+		sections = append(sections, s)
+	}
+	r.unlock()
+
+	c.mapping[old] = nr.id
+	c.created = append(c.created, nr)
+	c.fs.setRecord(nr)
+
+	for _, s := range sections {
+		// the caller decides what metadata the copy gets
+		if s == "meta" {
+			continue
+		}
+
+		err := linkOrCopy(c.from.getSectionFileName(old, s), c.fs.getSectionFileName(nr.id, s))
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted while copying
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		nr.sections[s] = struct{}{}
+	}
+
+	if c.opts.Meta != nil {
+		fm, err := c.opts.Meta(old, nr.id)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.writeMeta(nr, fm); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.opts.Progress != nil {
+		c.opts.Progress(len(c.created))
+	}
+
+	for _, ch := range children {
+		if c.opts.Include != nil && !c.opts.Include(ch) {
+			continue
+		}
+
+		nc, err := c.copyRecord(ch)
+		if err != nil {
+			return nil, err
+		}
+		nr.Children = append(nr.Children, nc.id)
+		nc.refs++
+	}
+
+	return nr, c.fs.writeRecord(nr)
+}
+
+// has to be called with c.fs.snapLock read locked
+func (c *copier) writeMeta(nr *record, fm FileMeta) error {
+	w, err := c.fs.createAtomic(c.fs.getSectionFileName(nr.id, "meta"))
+	if err != nil {
+		return err
+	}
+	w.snapLocked = true
+
+	if err = json.NewEncoder(w).Encode(fm); err != nil {
+		w.Abort()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	nr.sections["meta"] = struct{}{}
+	return nil
+}
+
+// has to be called with no lock held on the created records
+func (c *copier) cleanup() {
+	for _, r := range c.created {
+		for s := range r.sections {
+			_ = os.Remove(c.fs.getSectionFileName(r.id, s))
+		}
+		_ = os.Remove(c.fs.path(r.id.String()))
+
+		c.fs.lock.Lock()
+		delete(c.fs.records, r.id)
+		c.fs.lock.Unlock()
+	}
+}
+
+// Copy creates an independent copy of the subtree with new uuids and mounts
+// it into dstParent. Records mounted several times within the subtree are
+// copied once and mounted the same way in the copy. The 'meta' section is not
+// copied, opts.Meta makes a new one. Returns the mapping from the original
+// uuids to the new ones
+func (fs *Fs) Copy(src, dstParent uuid.UUID, opts CopyOptions) (map[uuid.UUID]uuid.UUID, error) {
+	return fs.CopyFrom(fs, src, dstParent, opts)
+}
+
+// CopyFrom is like Copy but the subtree is taken from another fs, e.g. a
+// snapshot
+func (fs *Fs) CopyFrom(from *Fs, src, dstParent uuid.UUID, opts CopyOptions) (map[uuid.UUID]uuid.UUID, error) {
+	if err := fs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	// a snapshot taken meanwhile must not see a partial copy
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	c := copier{from: from, fs: fs, opts: opts, mapping: map[uuid.UUID]uuid.UUID{}}
+
+	nr, err := c.copyRecord(src)
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+
+	fs.treeLock.Lock()
+	err = fs.mount(dstParent, nr.id, 0)
+	fs.treeLock.Unlock()
+
+	if err != nil {
+		c.cleanup()
+		return nil, err
+	}
+
+	return c.mapping, nil
+}
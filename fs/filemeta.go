@@ -2,6 +2,9 @@ package fs
 
 import (
 	"encoding/json"
+	"maps"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -10,6 +13,15 @@ const (
 	PermOwner = uint8(1 << iota)
 	PermRead
 	PermWrite
+
+	PermAll = PermOwner | PermRead | PermWrite
+)
+
+const (
+	// UserPub is the user everyone is logged in as
+	UserPub = "pub"
+	// UserRoot has access to anything
+	UserRoot = "root"
 )
 
 // FileMeta contains the metadata asociated with each file. It is saved in the
@@ -23,7 +35,51 @@ type FileMeta struct {
 	CreatedAt uint64           `json:"createdAt"`
 }
 
+// NewFileMeta returns metadata of a file just created by the user, who becomes
+// its owner
+func NewFileMeta(file uuid.UUID, creator string) FileMeta {
+	return FileMeta{
+		UUID:      file,
+		Perms:     map[string]uint8{creator: PermAll},
+		Hooks:     []string{},
+		CreatedBy: creator,
+		CreatedAt: uint64(time.Now().Unix()),
+	}
+}
+
+// EffectivePerms returns the permission bits the user has for the file. Users
+// without their own entry get the bits of the pub user
+func (fm FileMeta) EffectivePerms(username string) uint8 {
+	if username == UserRoot {
+		return PermAll
+	}
+	if p, ok := fm.Perms[username]; ok {
+		return p
+	}
+	return fm.Perms[UserPub]
+}
+
+func (fm FileMeta) clone() FileMeta {
+	fm.Perms = maps.Clone(fm.Perms)
+	fm.Hooks = slices.Clone(fm.Hooks)
+	return fm
+}
+
+// ReadFileMeta returns the decoded 'meta' section. The decoded metadata is
+// cached in memory until the section is written again
 func ReadFileMeta(fs *Fs, file uuid.UUID) (fm FileMeta, err error) {
+	rec, err := fs.getRecord(file)
+	if err != nil {
+		return
+	}
+
+	rec.lock()
+	defer rec.unlock()
+
+	if rec.meta != nil {
+		return rec.meta.clone(), nil
+	}
+
 	r, err := fs.OpenSection(file, "meta")
 	if err != nil {
 		return
@@ -31,6 +87,12 @@ func ReadFileMeta(fs *Fs, file uuid.UUID) (fm FileMeta, err error) {
 	defer r.Close()
 
 	err = json.NewDecoder(r).Decode(&fm)
+	if err != nil {
+		return
+	}
+
+	cached := fm.clone()
+	rec.meta = &cached
 	return
 }
 
@@ -39,8 +101,12 @@ func WriteFileMeta(fs *Fs, file uuid.UUID, fm FileMeta) error {
 	if err != nil {
 		return err
 	}
-	defer w.Close()
 
-	enc := json.NewEncoder(w)
-	return enc.Encode(fm)
+	err = json.NewEncoder(w).Encode(fm)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close()
 }
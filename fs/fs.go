@@ -18,10 +18,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 
@@ -47,9 +47,17 @@ type record struct {
 	Children []uuid.UUID `json:"children,omitempty"`
 	IsDir    bool        `json:"is_dir"`
 	Name     string      `json:"name"`
-	id       uuid.UUID   `json:"-"`
-	refs     uint        `json:"-"`
-	mutex    sync.Mutex  `json:"-"`
+	// incremented on every write of the record
+	Version uint64     `json:"version"`
+	id      uuid.UUID  `json:"-"`
+	refs    uint       `json:"-"`
+	mutex   sync.Mutex `json:"-"`
+	// names of the sections that exist on disk
+	sections map[string]struct{} `json:"-"`
+	// decoded 'meta' section, nil if not loaded yet
+	meta *FileMeta `json:"-"`
+	// size of the 'data' section, nil if not known yet
+	dataSize *int64 `json:"-"`
 }
 
 func (r *record) lock() {
@@ -60,18 +68,48 @@ func (r *record) unlock() {
 	r.mutex.Unlock()
 }
 
+// forgetSection drops what is cached about the section after it changed. Has
+// to be called with the record locked
+func (r *record) forgetSection(section string) {
+	switch section {
+	case "meta":
+		r.meta = nil
+	case "data":
+		r.dataSize = nil
+	}
+}
+
 type Fs struct {
-	lock     sync.RWMutex
+	lock sync.RWMutex
+	// serialises the operations that could create cycles or name
+	// collisions if they ran concurrently
+	treeLock sync.Mutex
 	records  map[uuid.UUID]*record
 	root     uuid.UUID
 	basePath string
+	hashes   hashCache
+	readOnly bool
+	// operations that change the files in basePath hold snapLock read
+	// locked from start to end so that a snapshot sees the fs at a single
+	// instant and never half of an operation. It is taken before treeLock
+	// and the record locks
+	snapLock sync.RWMutex
+}
+
+var ErrReadOnly = errors.New("the fs is read-only")
+
+func (fs *Fs) checkWritable() error {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+	return nil
 }
 
 func (fs *Fs) getRecord(u uuid.UUID) (*record, error) {
 	fs.lock.RLock()
-	defer fs.lock.Unlock()
-	r, e := fs.records[u]
-	if e {
+	defer fs.lock.RUnlock()
+	r, ok := fs.records[u]
+	if !ok {
 		return nil, errors.New("uuid doesn't exist")
 	}
 	return r, nil
@@ -88,36 +126,61 @@ func (fs *Fs) path(p string) string {
 	return filepath.Join(fs.basePath, p)
 }
 
+// has to be called with fs.snapLock read locked
 func (fs *Fs) writeRecord(r *record) error {
-	f, err := os.Create(fs.path(r.id.String()))
+	f, err := fs.createAtomic(fs.path(r.id.String()))
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	f.snapLocked = true
+
+	r.Version++
+	err = json.NewEncoder(f).Encode(r)
+	if err != nil {
+		r.Version--
+		f.Abort()
+		return err
+	}
 
-	enc := json.NewEncoder(f)
-	return enc.Encode(r)
+	if err = f.Close(); err != nil {
+		r.Version--
+		return err
+	}
+
+	return nil
 }
 
+// has to be called with fs.snapLock read locked and the parent locked
 func (fs *Fs) newRecord(parent *record, name string, dir bool) (*record, error) {
+	if !parent.IsDir {
+		return nil, errors.New("parent is not a directory")
+	}
+
 	child := new(record)
 	child.Children = []uuid.UUID{}
 	child.id = uuid.New()
 	child.Name = name
 	child.refs = 1
 	child.IsDir = dir
+	child.sections = map[string]struct{}{}
 
-	fs.setRecord(child)
-
-	for _, e := range parent.Children {
-		if e == child.id {
-			return nil, errors.New("child already there")
-		}
+	err := fs.writeRecord(child)
+	if err != nil {
+		return nil, err
 	}
 
 	parent.Children = append(parent.Children, child.id)
 
-	return child, fs.writeRecord(child)
+	err = fs.writeRecord(parent)
+	if err != nil {
+		parent.Children = parent.Children[:len(parent.Children)-1]
+		_ = os.Remove(fs.path(child.id.String()))
+		return nil, err
+	}
+
+	fs.setRecord(child)
+
+	return child, nil
 }
 
 // return new slice that does not contain v
@@ -131,7 +194,7 @@ func removeUUID(s []uuid.UUID, v uuid.UUID) ([]uuid.UUID, error) {
 		}
 	}
 
-	for ; i < len(s); i++ {
+	for i++; i < len(s); i++ {
 		if s[i] == v {
 			return s, errors.New("duplicite uuid")
 		}
@@ -141,9 +204,13 @@ func removeUUID(s []uuid.UUID, v uuid.UUID) ([]uuid.UUID, error) {
 		return s, errors.New("uuid not found")
 	}
 
-	// swap remove
-	s[pos] = s[len(s)-1]
-	return s[:len(s)-1], nil
+	// keep the order so that listings stay stable
+	return slices.Concat(s[:pos], s[pos+1:]), nil
+}
+
+// CheckSectionName fails unless the section name can be used
+func CheckSectionName(section string) error {
+	return checkSectionNameSanity(section)
 }
 
 func checkSectionNameSanity(section string) error {
@@ -157,9 +224,22 @@ func (fs *Fs) getSectionFileName(file uuid.UUID, section string) string {
 	return fs.path(file.String() + "." + section)
 }
 
+// the record has to be locked by the caller, who also holds fs.snapLock read
+// locked
 func (fs *Fs) deleteRecord(r *record) error {
 	for _, u := range r.Children {
-		err := fs.Unmount(r.id, u)
+		child, err := fs.getRecord(u)
+		if err != nil {
+			return err
+		}
+
+		child.lock()
+		child.refs--
+		if child.refs == 0 {
+			err = fs.deleteRecord(child)
+		}
+		child.unlock()
+
 		if err != nil {
 			return err
 		}
@@ -173,13 +253,17 @@ func (fs *Fs) deleteRecord(r *record) error {
 	idStr := r.id.String()
 	for _, e := range entries {
 		if strings.HasPrefix(e.Name(), idStr) {
-			err = os.Remove(e.Name())
+			err = os.Remove(fs.path(e.Name()))
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	fs.lock.Lock()
+	delete(fs.records, r.id)
+	fs.lock.Unlock()
+
 	return nil
 }
 
@@ -188,30 +272,124 @@ func (fs *Fs) GetRoot() uuid.UUID {
 }
 
 func (fs *Fs) GetChildren(u uuid.UUID) ([]uuid.UUID, error) {
-	return fs.records[u].Children, nil
+	r, err := fs.getRecord(u)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock()
+	defer r.unlock()
+
+	return append([]uuid.UUID{}, r.Children...), nil
 }
 
 func (fs *Fs) Mkdir(parentUUID uuid.UUID, name string) (uuid.UUID, error) {
+	return fs.MkdirIf(parentUUID, name, 0)
+}
+
+// MkdirIf is Mkdir that fails with ErrVersionMismatch unless the parent is at
+// the version. Version 0 matches any version
+func (fs *Fs) MkdirIf(parentUUID uuid.UUID, name string, version uint64) (uuid.UUID, error) {
+	if err := checkName(name); err != nil {
+		return uuid.UUID{}, err
+	}
+
+	if err := fs.checkWritable(); err != nil {
+		return uuid.UUID{}, err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	fs.treeLock.Lock()
+	defer fs.treeLock.Unlock()
+
 	parent, err := fs.getRecord(parentUUID)
 	if err != nil {
-		return uuid.UUID{}, nil
+		return uuid.UUID{}, err
+	}
+
+	if _, err := fs.childByName(parentUUID, name); err == nil {
+		return uuid.UUID{}, ErrNameExists
+	}
+
+	parent.lock()
+	defer parent.unlock()
+
+	if err := parent.checkVersion(version); err != nil {
+		return uuid.UUID{}, err
 	}
 
 	r, err := fs.newRecord(parent, name, true)
-	return r.id, err
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return r.id, nil
 }
 
 func (fs *Fs) Touch(parentUUID uuid.UUID, name string) (uuid.UUID, error) {
+	return fs.TouchIf(parentUUID, name, 0)
+}
+
+// TouchIf is Touch that fails with ErrVersionMismatch unless the parent is at
+// the version. Version 0 matches any version
+func (fs *Fs) TouchIf(parentUUID uuid.UUID, name string, version uint64) (uuid.UUID, error) {
+	if err := checkName(name); err != nil {
+		return uuid.UUID{}, err
+	}
+
+	if err := fs.checkWritable(); err != nil {
+		return uuid.UUID{}, err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	fs.treeLock.Lock()
+	defer fs.treeLock.Unlock()
+
 	parent, err := fs.getRecord(parentUUID)
 	if err != nil {
 		return uuid.UUID{}, err
 	}
 
+	if _, err := fs.childByName(parentUUID, name); err == nil {
+		return uuid.UUID{}, ErrNameExists
+	}
+
+	parent.lock()
+	defer parent.unlock()
+
+	if err := parent.checkVersion(version); err != nil {
+		return uuid.UUID{}, err
+	}
+
 	r, err := fs.newRecord(parent, name, false)
-	return r.id, err
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return r.id, nil
 }
 
 func (fs *Fs) Unmount(parentUUID uuid.UUID, childUUID uuid.UUID) error {
+	return fs.UnmountIf(parentUUID, childUUID, 0)
+}
+
+// UnmountIf is Unmount that fails with ErrVersionMismatch unless the parent is
+// at the version. Version 0 matches any version
+func (fs *Fs) UnmountIf(parentUUID uuid.UUID, childUUID uuid.UUID, version uint64) error {
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	return fs.unmount(parentUUID, childUUID, version)
+}
+
+// has to be called with fs.snapLock read locked
+func (fs *Fs) unmount(parentUUID uuid.UUID, childUUID uuid.UUID, version uint64) error {
 	parent, err := fs.getRecord(parentUUID)
 	if err != nil {
 		return err
@@ -220,6 +398,10 @@ func (fs *Fs) Unmount(parentUUID uuid.UUID, childUUID uuid.UUID) error {
 	parent.lock()
 	defer parent.unlock()
 
+	if err := parent.checkVersion(version); err != nil {
+		return err
+	}
+
 	parent.Children, err = removeUUID(parent.Children, childUUID)
 	if err != nil {
 		return err
@@ -246,12 +428,83 @@ func (fs *Fs) Unmount(parentUUID uuid.UUID, childUUID uuid.UUID) error {
 	return nil
 }
 
+// Pin keeps the record alive even if it is unmounted from all its parents.
+// Pins are not persisted, they have to be restored after every start
+func (fs *Fs) Pin(id uuid.UUID) error {
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return err
+	}
+
+	r.lock()
+	r.refs++
+	r.unlock()
+
+	return nil
+}
+
+// Unpin releases a pin. The record is deleted if it isn't mounted anywhere
+func (fs *Fs) Unpin(id uuid.UUID) error {
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	r.lock()
+	defer r.unlock()
+
+	r.refs--
+	if r.refs == 0 {
+		return fs.deleteRecord(r)
+	}
+
+	return nil
+}
+
 func (fs *Fs) Mount(parent uuid.UUID, newChild uuid.UUID) error {
+	return fs.MountIf(parent, newChild, 0)
+}
+
+// MountIf is Mount that fails with ErrVersionMismatch unless the parent is at
+// the version. Version 0 matches any version
+func (fs *Fs) MountIf(parent uuid.UUID, newChild uuid.UUID, version uint64) error {
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	fs.treeLock.Lock()
+	defer fs.treeLock.Unlock()
+
+	return fs.mount(parent, newChild, version)
+}
+
+// has to be called with fs.snapLock read locked and fs.treeLock held. The
+// mount fails with ErrNameExists when the parent already has another child
+// with the same name
+func (fs *Fs) mount(parent uuid.UUID, newChild uuid.UUID, version uint64) error {
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+
 	child, err := fs.getRecord(newChild)
 	if err != nil {
 		return err
 	}
 
+	if fs.isReachable(newChild, parent) {
+		return errors.New("mount would create a cycle")
+	}
+
+	child.lock()
+	name := child.Name
+	child.unlock()
+
+	if other, err := fs.childByName(parent, name); err == nil && other != newChild {
+		return ErrNameExists
+	}
+
 	rec, err := fs.getRecord(parent)
 	if err != nil {
 		return err
@@ -259,6 +512,14 @@ func (fs *Fs) Mount(parent uuid.UUID, newChild uuid.UUID) error {
 	rec.lock()
 	defer rec.unlock()
 
+	if !rec.IsDir {
+		return errors.New("parent is not a directory")
+	}
+
+	if err := rec.checkVersion(version); err != nil {
+		return err
+	}
+
 	for _, child := range rec.Children {
 		if child == newChild {
 			return errors.New("child with this uuid already exists")
@@ -274,21 +535,60 @@ func (fs *Fs) Mount(parent uuid.UUID, newChild uuid.UUID) error {
 	return fs.writeRecord(rec)
 }
 
-func (fs *Fs) OpenSection(uuid uuid.UUID, section string) (io.ReadCloser, error) {
+// OpenSection opens the section for reading. Sections are never modified in
+// place so the returned file keeps its content even if the section gets
+// replaced while it is being read
+func (fs *Fs) OpenSection(uuid uuid.UUID, section string) (*os.File, error) {
 	err := checkSectionNameSanity(section)
 	if err != nil {
 		return nil, err
 	}
+
+	if _, err = fs.getRecord(uuid); err != nil {
+		return nil, err
+	}
+
 	return os.Open(fs.getSectionFileName(uuid, section))
 }
 
-func (fs *Fs) CreateSection(uuid uuid.UUID, section string) (io.WriteCloser, error) {
+// CreateSection returns a writer for the section. The new content replaces
+// the old one only after the writer is successfully closed, so readers never
+// see a partially written section. Call Abort to throw the new content away.
+func (fs *Fs) CreateSection(uuid uuid.UUID, section string) (*SectionWriter, error) {
+	return fs.CreateSectionIf(uuid, section, 0)
+}
+
+// CreateSectionIf is CreateSection whose Close fails with ErrVersionMismatch
+// unless the section is still at the version. Version 0 matches any version
+func (fs *Fs) CreateSectionIf(uuid uuid.UUID, section string, version uint64) (*SectionWriter, error) {
 	err := checkSectionNameSanity(section)
 	if err != nil {
 		return nil, err
 	}
 
-	return os.Create(fs.getSectionFileName(uuid, section))
+	if err = fs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	r, err := fs.getRecord(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := fs.createAtomic(fs.getSectionFileName(uuid, section))
+	if err != nil {
+		return nil, err
+	}
+
+	w.rec = r
+	w.version = version
+	// called with the record locked
+	w.onCommit = func() {
+		r.sections[section] = struct{}{}
+		r.forgetSection(section)
+	}
+
+	return w, nil
 }
 
 func (fs *Fs) DeleteSection(uuid uuid.UUID, section string) error {
@@ -297,7 +597,29 @@ func (fs *Fs) DeleteSection(uuid uuid.UUID, section string) error {
 		return err
 	}
 
-	return os.Remove(fs.getSectionFileName(uuid, section))
+	if err = fs.checkWritable(); err != nil {
+		return err
+	}
+
+	r, err := fs.getRecord(uuid)
+	if err != nil {
+		return err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	r.lock()
+	defer r.unlock()
+
+	err = os.Remove(fs.getSectionFileName(uuid, section))
+	if err != nil {
+		return err
+	}
+
+	delete(r.sections, section)
+	r.forgetSection(section)
+	return nil
 }
 
 func (fs *Fs) loadRecords() error {
@@ -306,9 +628,13 @@ func (fs *Fs) loadRecords() error {
 		return err
 	}
 
-	var recordFiles []string
+	var recordFiles, sectionFiles []string
 
 	for _, e := range entries {
+		if e.Name() == tmpDirName {
+			continue
+		}
+
 		if e.Type().IsDir() {
 			return errors.New("garbage directory in fs root")
 		}
@@ -321,6 +647,8 @@ func (fs *Fs) loadRecords() error {
 
 		if len(name) == 36 {
 			recordFiles = append(recordFiles, name)
+		} else {
+			sectionFiles = append(sectionFiles, name)
 		}
 	}
 
@@ -343,10 +671,34 @@ func (fs *Fs) loadRecords() error {
 			return fmt.Errorf("json decore err: %w", err)
 		}
 
+		// written before records had versions
+		if rec.Version == 0 {
+			rec.Version = 1
+		}
+		rec.id = u
+		rec.sections = map[string]struct{}{}
 		fs.records[u] = rec
 	}
 
-	// TODO(prokop) load section file names
+	for _, sectionName := range sectionFiles {
+		u, section, _ := strings.Cut(sectionName, ".")
+		rec, ok := fs.records[uuid.MustParse(u)]
+		if !ok {
+			// left behind by an operation that was interrupted
+			// before it wrote the record
+			continue
+		}
+		rec.sections[section] = struct{}{}
+	}
+
+	for _, rec := range fs.records {
+		for _, c := range rec.Children {
+			if child, ok := fs.records[c]; ok {
+				child.refs++
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -355,11 +707,14 @@ func checkLoadedRecordsAreSane(map[uuid.UUID]*record) error {
 	return nil
 }
 
-func NewFs(root uuid.UUID, basePath string) (fs *Fs, err error) {
+// OpenReadOnly loads the fs without ever writing to basePath. All operations
+// that would modify the fs fail with ErrReadOnly
+func OpenReadOnly(root uuid.UUID, basePath string) (fs *Fs, err error) {
 	fs = new(Fs)
 	fs.basePath = basePath
 	fs.root = root
 	fs.records = make(map[uuid.UUID]*record)
+	fs.readOnly = true
 
 	err = fs.loadRecords()
 	if err != nil {
@@ -371,6 +726,33 @@ func NewFs(root uuid.UUID, basePath string) (fs *Fs, err error) {
 		return
 	}
 
+	return fs, nil
+}
+
+func NewFs(root uuid.UUID, basePath string) (fs *Fs, err error) {
+	fs = new(Fs)
+	fs.basePath = basePath
+	fs.root = root
+	fs.records = make(map[uuid.UUID]*record)
+
+	err = fs.initTmpDir()
+	if err != nil {
+		return
+	}
+
+	err = fs.loadRecords()
+	if err != nil {
+		return
+	}
+
+	if r, c := fs.records[root]; !c {
+		err = errors.New("the root UUID not found in fs")
+		return
+	} else {
+		// the root is never unmounted from anywhere
+		r.refs++
+	}
+
 	return fs, checkLoadedRecordsAreSane(fs.records)
 }
 
@@ -411,6 +793,24 @@ func InitFsDir(dir string, users map[string][64]byte) (rootUUID uuid.UUID, err e
 		return
 	}
 
+	// the root is owned by all initial users
+	rootMeta := NewFileMeta(rootUUID, UserRoot)
+	for name := range users {
+		rootMeta.Perms[name] = PermAll
+	}
+	f3, err := os.Create(rootUUIDPath + ".meta") // #nosec G304: the dir argument is trusted
+	if err != nil {
+		err = fmt.Errorf("InitFsDir: %w", err)
+		return
+	}
+	defer f3.Close()
+
+	err = json.NewEncoder(f3).Encode(rootMeta)
+	if err != nil {
+		err = fmt.Errorf("InitFsDir: %w", err)
+		return
+	}
+
 	// create users.json
 	usersPath := filepath.Join(dir, "users.json")
 	f2, err := os.Create(usersPath) // #nosec G304: the dir argument is trusted
@@ -0,0 +1,212 @@
+package fs
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// ErrNameExists is returned when a record would enter a directory (by Touch,
+// Mkdir, Mount, Copy, Rename or Move) that already has a child with the same
+// name, see the comment in path.go
+var ErrNameExists = errors.New("name already exists in the directory")
+
+// isReachable reports whether to can be reached from from by following
+// children, including from == to
+func (fs *Fs) isReachable(from, to uuid.UUID) bool {
+	seen := map[uuid.UUID]bool{}
+	stack := []uuid.UUID{from}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if u == to {
+			return true
+		}
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+
+		r, err := fs.getRecord(u)
+		if err != nil {
+			continue
+		}
+		r.lock()
+		stack = append(stack, r.Children...)
+		r.unlock()
+	}
+	return false
+}
+
+// parentsOf returns all directories the record is mounted in
+func (fs *Fs) parentsOf(id uuid.UUID) []uuid.UUID {
+	fs.lock.RLock()
+	recs := make([]*record, 0, len(fs.records))
+	for _, r := range fs.records {
+		recs = append(recs, r)
+	}
+	fs.lock.RUnlock()
+
+	var parents []uuid.UUID
+	for _, r := range recs {
+		r.lock()
+		if slices.Contains(r.Children, id) {
+			parents = append(parents, r.id)
+		}
+		r.unlock()
+	}
+	return parents
+}
+
+// Parents returns all directories the record is mounted in
+func (fs *Fs) Parents(id uuid.UUID) ([]uuid.UUID, error) {
+	if _, err := fs.getRecord(id); err != nil {
+		return nil, err
+	}
+	return fs.parentsOf(id), nil
+}
+
+// Rename changes the name of the record. The new name must not be used by
+// another child of any directory the record is mounted in
+func (fs *Fs) Rename(id uuid.UUID, name string) error {
+	return fs.RenameIf(id, name, 0)
+}
+
+// RenameIf is Rename that fails with ErrVersionMismatch unless the record is
+// at the version. Version 0 matches any version
+func (fs *Fs) RenameIf(id uuid.UUID, name string, version uint64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	fs.treeLock.Lock()
+	defer fs.treeLock.Unlock()
+
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range fs.parentsOf(id) {
+		if other, err := fs.childByName(p, name); err == nil && other != id {
+			return ErrNameExists
+		}
+	}
+
+	r.lock()
+	defer r.unlock()
+
+	if err := r.checkVersion(version); err != nil {
+		return err
+	}
+
+	old := r.Name
+	r.Name = name
+	if err := fs.writeRecord(r); err != nil {
+		r.Name = old
+		return err
+	}
+
+	return nil
+}
+
+// Move moves the record from one directory to another. Both directories are
+// written at once (see writeRecords), so the record is never lost or left in
+// both of them, not even by a crash
+func (fs *Fs) Move(from uuid.UUID, id uuid.UUID, to uuid.UUID) error {
+	return fs.MoveIf(from, id, to, 0)
+}
+
+// MoveIf is Move that fails with ErrVersionMismatch unless the source
+// directory is at the version. Version 0 matches any version
+func (fs *Fs) MoveIf(from uuid.UUID, id uuid.UUID, to uuid.UUID, version uint64) error {
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	fs.treeLock.Lock()
+	defer fs.treeLock.Unlock()
+
+	if from == to {
+		return nil
+	}
+
+	child, err := fs.getRecord(id)
+	if err != nil {
+		return err
+	}
+	src, err := fs.getRecord(from)
+	if err != nil {
+		return err
+	}
+	dst, err := fs.getRecord(to)
+	if err != nil {
+		return err
+	}
+
+	if fs.isReachable(id, to) {
+		return errors.New("move would create a cycle")
+	}
+
+	child.lock()
+	name := child.Name
+	child.unlock()
+
+	if other, err := fs.childByName(to, name); err == nil && other != id {
+		return ErrNameExists
+	}
+
+	// records are locked from parents to children, like deleteRecord does,
+	// and the tree lock keeps the directories from changing places
+	first, second := src, dst
+	if fs.isReachable(to, from) {
+		first, second = dst, src
+	}
+	first.lock()
+	defer first.unlock()
+	second.lock()
+	defer second.unlock()
+
+	if err := src.checkVersion(version); err != nil {
+		return err
+	}
+
+	if !dst.IsDir {
+		return errors.New("parent is not a directory")
+	}
+
+	if slices.Contains(dst.Children, id) {
+		return errors.New("the record is already in the target directory")
+	}
+
+	if !slices.Contains(src.Children, id) {
+		return errors.New("the record is not in the source directory")
+	}
+
+	srcChildren, dstChildren := src.Children, dst.Children
+
+	src.Children, err = removeUUID(src.Children, id)
+	if err != nil {
+		return err
+	}
+	dst.Children = append(slices.Clone(dst.Children), id)
+
+	if err := fs.writeRecords(src, dst); err != nil {
+		src.Children, dst.Children = srcChildren, dstChildren
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package fs
+
+// Paths are slash separated record names walked from a start directory
+// (usually the root). Record names are unique within a directory. Directories
+// written before that was enforced can still hold several children with the
+// same name; the one mounted first wins, i.e. the first one in the stored
+// order of the directory. Empty path segments are ignored, `.` stays in the
+// current directory and `..` is rejected because a record can have many
+// parents.
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxPaths limits the number of paths returned by Paths. The number of paths
+// can grow exponentially with the number of multiply mounted directories
+const maxPaths = 1000
+
+var ErrPathNotFound = errors.New("path not found")
+
+// ErrBadName is returned when a record would get a name that can't be a
+// segment of a path
+var ErrBadName = errors.New("a name can't be empty, '.' or '..' and can't contain '/'")
+
+// checkName fails with ErrBadName unless the name can be a segment of a path
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return ErrBadName
+	}
+	return nil
+}
+
+func splitPath(p string) ([]string, error) {
+	var names []string
+	for _, n := range strings.Split(p, "/") {
+		switch n {
+		case "", ".":
+			continue
+		case "..":
+			return nil, errors.New("'..' is not supported in paths")
+		}
+		names = append(names, n)
+	}
+	return names, nil
+}
+
+func (fs *Fs) childByName(dir uuid.UUID, name string) (uuid.UUID, error) {
+	r, err := fs.getRecord(dir)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	r.lock()
+	children := slices.Clone(r.Children)
+	isDir := r.IsDir
+	r.unlock()
+
+	if !isDir {
+		return uuid.UUID{}, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	for _, c := range children {
+		child, err := fs.getRecord(c)
+		if err != nil {
+			continue
+		}
+
+		child.lock()
+		match := child.Name == name
+		child.unlock()
+
+		if match {
+			return c, nil
+		}
+	}
+
+	return uuid.UUID{}, fmt.Errorf("%w: no %#v in %s", ErrPathNotFound, name, dir)
+}
+
+// Resolve walks the path from start. The nil uuid starts at the root
+func (fs *Fs) Resolve(start uuid.UUID, p string) (uuid.UUID, error) {
+	names, err := splitPath(p)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	cur := start
+	if cur == uuid.Nil {
+		cur = fs.root
+	}
+
+	if _, err = fs.getRecord(cur); err != nil {
+		return uuid.UUID{}, err
+	}
+
+	for _, n := range names {
+		cur, err = fs.childByName(cur, n)
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+	}
+
+	return cur, nil
+}
+
+// ResolveParent resolves everything but the last name of the path and returns
+// the directory and the last name
+func (fs *Fs) ResolveParent(start uuid.UUID, p string) (uuid.UUID, string, error) {
+	names, err := splitPath(p)
+	if err != nil {
+		return uuid.UUID{}, "", err
+	}
+
+	if len(names) == 0 {
+		return uuid.UUID{}, "", errors.New("empty path")
+	}
+
+	dir, err := fs.Resolve(start, strings.Join(names[:len(names)-1], "/"))
+	if err != nil {
+		return uuid.UUID{}, "", err
+	}
+
+	return dir, names[len(names)-1], nil
+}
+
+// Paths returns the paths from the root by which the record is reachable. A
+// record mounted in several directories has several paths. Paths are returned
+// sorted and there are at most maxPaths of them
+func (fs *Fs) Paths(target uuid.UUID) ([]string, error) {
+	if _, err := fs.getRecord(target); err != nil {
+		return nil, err
+	}
+
+	// build the reverse edges once, walking up from the target is then
+	// cheaper than searching the whole tree
+	parents := map[uuid.UUID][]uuid.UUID{}
+	names := map[uuid.UUID]string{}
+
+	fs.lock.RLock()
+	recs := make([]*record, 0, len(fs.records))
+	for _, r := range fs.records {
+		recs = append(recs, r)
+	}
+	fs.lock.RUnlock()
+
+	for _, r := range recs {
+		r.lock()
+		names[r.id] = r.Name
+		for _, c := range r.Children {
+			parents[c] = append(parents[c], r.id)
+		}
+		r.unlock()
+	}
+
+	var paths []string
+	var walk func(u uuid.UUID, suffix string)
+	walk = func(u uuid.UUID, suffix string) {
+		if len(paths) >= maxPaths {
+			return
+		}
+		if u == fs.root {
+			paths = append(paths, "/"+suffix)
+			return
+		}
+		for _, p := range parents[u] {
+			s := names[u]
+			if suffix != "" {
+				s += "/" + suffix
+			}
+			walk(p, s)
+		}
+	}
+	walk(target, "")
+
+	slices.Sort(paths)
+	return paths, nil
+}
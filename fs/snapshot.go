@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot hard links every record and section into the directory dst, which
+// must not exist yet. Files in the fs are never modified in place, so the
+// links keep the content they had at the time of the snapshot. dst is a valid
+// fs root that can be opened with OpenReadOnly
+func (fs *Fs) Snapshot(dst string) (err error) {
+	if err = fs.checkWritable(); err != nil {
+		return err
+	}
+
+	fs.snapLock.Lock()
+	defer fs.snapLock.Unlock()
+
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Mkdir(dst, 0750); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dst)
+		}
+	}()
+
+	for _, e := range entries {
+		if e.Name() == tmpDirName {
+			continue
+		}
+
+		if !onlyFileInFsRootPatternRegex.MatchString(e.Name()) {
+			return errors.New("garbage file in fs root")
+		}
+
+		if err = os.Link(fs.path(e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
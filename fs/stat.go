@@ -0,0 +1,197 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type SectionInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified"`
+	Version  uint64    `json:"version"`
+}
+
+// Stat describes a record without its metadata section
+type Stat struct {
+	UUID     uuid.UUID     `json:"uuid"`
+	Name     string        `json:"name"`
+	IsDir    bool          `json:"is_dir"`
+	Version  uint64        `json:"version"`
+	Refs     uint          `json:"refs"`
+	Children int           `json:"children"`
+	Sections []SectionInfo `json:"sections"`
+}
+
+type hashCacheEntry struct {
+	modTime time.Time
+	size    int64
+	sum     []byte
+}
+
+// hashCache remembers section hashes so that they are computed at most once
+// for every version of a section
+type hashCache struct {
+	lock    sync.Mutex
+	entries map[string]hashCacheEntry
+}
+
+func (c *hashCache) put(path string, fi os.FileInfo, sum []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]hashCacheEntry)
+	}
+	c.entries[path] = hashCacheEntry{modTime: fi.ModTime(), size: fi.Size(), sum: sum}
+}
+
+func (c *hashCache) get(path string, fi os.FileInfo) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[path]
+	if !ok || !e.modTime.Equal(fi.ModTime()) || e.size != fi.Size() {
+		return nil, false
+	}
+	return e.sum, true
+}
+
+func (fs *Fs) sectionInfo(id uuid.UUID, section string) (SectionInfo, error) {
+	path := fs.getSectionFileName(id, section)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return SectionInfo{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return SectionInfo{}, err
+	}
+
+	sum, ok := fs.hashes.get(path, fi)
+	if !ok {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return SectionInfo{}, err
+		}
+		sum = h.Sum(nil)
+		fs.hashes.put(path, fi, sum)
+	}
+
+	return SectionInfo{
+		Name:     section,
+		Size:     fi.Size(),
+		SHA256:   hex.EncodeToString(sum),
+		Modified: fi.ModTime().UTC(),
+		Version:  FileVersion(fi),
+	}, nil
+}
+
+func (fs *Fs) Stat(id uuid.UUID) (Stat, error) {
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return Stat{}, err
+	}
+
+	r.lock()
+	st := Stat{
+		UUID:     id,
+		Name:     r.Name,
+		IsDir:    r.IsDir,
+		Version:  r.Version,
+		Refs:     r.refs,
+		Children: len(r.Children),
+	}
+	sections := make([]string, 0, len(r.sections))
+	for s := range r.sections {
+		sections = append(sections, s)
+	}
+	r.unlock()
+
+	sort.Strings(sections)
+
+	st.Sections = make([]SectionInfo, 0, len(sections))
+	for _, s := range sections {
+		si, err := fs.sectionInfo(id, s)
+		if os.IsNotExist(err) {
+			// deleted since we released the lock
+			continue
+		}
+		if err != nil {
+			return Stat{}, err
+		}
+		st.Sections = append(st.Sections, si)
+	}
+
+	return st, nil
+}
+
+// Entry is the part of Stat that is cheap to get for every child of a large
+// directory
+type Entry struct {
+	UUID  uuid.UUID
+	Name  string
+	IsDir bool
+	// size of the 'data' section
+	Size int64
+}
+
+// GetEntries returns the children of the directory in their stored order
+func (fs *Fs) GetEntries(dir uuid.UUID) ([]Entry, error) {
+	children, err := fs.GetChildren(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(children))
+	for _, c := range children {
+		e, err := fs.GetEntry(c)
+		if err != nil {
+			// unmounted since we got the children
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// GetEntry returns the Entry of a single record
+func (fs *Fs) GetEntry(id uuid.UUID) (Entry, error) {
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	r.lock()
+	defer r.unlock()
+
+	e := Entry{UUID: id, Name: r.Name, IsDir: r.IsDir}
+	if _, ok := r.sections["data"]; !ok {
+		return e, nil
+	}
+
+	// directory listings ask for the size of every child, so it is kept
+	// until the section changes
+	if r.dataSize == nil {
+		fi, err := os.Stat(fs.getSectionFileName(id, "data"))
+		if err != nil {
+			return e, nil
+		}
+		size := fi.Size()
+		r.dataSize = &size
+	}
+	e.Size = *r.dataSize
+
+	return e, nil
+}
@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+var ErrRecordExists = errors.New("record already exists")
+
+// TreeRecord describes one record of a subtree created by CreateRecords
+type TreeRecord struct {
+	UUID     uuid.UUID
+	Name     string
+	IsDir    bool
+	Children []uuid.UUID
+}
+
+// ListSections returns the names of the sections of the record
+func (fs *Fs) ListSections(id uuid.UUID) ([]string, error) {
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock()
+	sections := make([]string, 0, len(r.sections))
+	for s := range r.sections {
+		sections = append(sections, s)
+	}
+	r.unlock()
+
+	slices.Sort(sections)
+	return sections, nil
+}
+
+// CreateRecords creates a whole subtree at once. None of the uuids may exist
+// yet, the children of every record must be part of recs and the names must
+// be valid and unique among the children of each directory. The subtree is
+// not mounted anywhere, instead its root is pinned; the caller fills in the
+// sections, mounts the root and unpins it. Unpinning the root without
+// mounting it deletes the whole subtree again
+func (fs *Fs) CreateRecords(root uuid.UUID, recs []TreeRecord) error {
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+
+	fs.snapLock.RLock()
+	defer fs.snapLock.RUnlock()
+
+	byID := make(map[uuid.UUID]*TreeRecord, len(recs))
+	for i := range recs {
+		r := &recs[i]
+		if _, dup := byID[r.UUID]; dup {
+			return fmt.Errorf("duplicate record %s", r.UUID)
+		}
+		if _, err := fs.getRecord(r.UUID); err == nil {
+			return fmt.Errorf("%w: %s", ErrRecordExists, r.UUID)
+		}
+		if err := checkName(r.Name); err != nil {
+			return fmt.Errorf("record %s: %w", r.UUID, err)
+		}
+		byID[r.UUID] = r
+	}
+
+	if _, ok := byID[root]; !ok {
+		return errors.New("the root is not among the records")
+	}
+
+	refs := map[uuid.UUID]uint{root: 1}
+	for _, r := range recs {
+		if !r.IsDir && len(r.Children) > 0 {
+			return fmt.Errorf("file %s has children", r.UUID)
+		}
+		names := make(map[string]bool, len(r.Children))
+		for _, c := range r.Children {
+			child, ok := byID[c]
+			if !ok {
+				return fmt.Errorf("child %s of %s is missing", c, r.UUID)
+			}
+			if names[child.Name] {
+				return fmt.Errorf("%w: %s in %s", ErrNameExists, child.Name, r.UUID)
+			}
+			names[child.Name] = true
+			refs[c]++
+		}
+	}
+
+	// every record has to be reachable from the root exactly through its
+	// references and there may be no cycle
+	state := map[uuid.UUID]int{}
+	var visit func(u uuid.UUID) error
+	visit = func(u uuid.UUID) error {
+		switch state[u] {
+		case 1:
+			return errors.New("the records form a cycle")
+		case 2:
+			return nil
+		}
+		state[u] = 1
+		for _, c := range byID[u].Children {
+			if err := visit(c); err != nil {
+				return err
+			}
+		}
+		state[u] = 2
+		return nil
+	}
+	if err := visit(root); err != nil {
+		return err
+	}
+	if len(state) != len(recs) {
+		return errors.New("some records are not reachable from the root")
+	}
+
+	created := make([]*record, 0, len(recs))
+	for _, r := range recs {
+		rec := &record{
+			Children: slices.Clone(r.Children),
+			IsDir:    r.IsDir,
+			Name:     r.Name,
+			id:       r.UUID,
+			refs:     refs[r.UUID],
+			sections: map[string]struct{}{},
+		}
+		if rec.Children == nil {
+			rec.Children = []uuid.UUID{}
+		}
+
+		if err := fs.writeRecord(rec); err != nil {
+			c := copier{fs: fs, created: created}
+			c.cleanup()
+			return err
+		}
+
+		created = append(created, rec)
+		fs.setRecord(rec)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package fs
+
+// Records and sections have versions that grow with every change so that
+// clients can make their changes conditional on the state they have seen.
+//
+// The version of a record is stored in the record and incremented by every
+// write. The version of a section is the modification time of its file in
+// nanoseconds, sections are always replaced by a newer file.
+
+import (
+	"errors"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// has to be called with the record locked
+func (r *record) checkVersion(version uint64) error {
+	if version != 0 && r.Version != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// FileVersion returns the version of an opened section file
+func FileVersion(fi os.FileInfo) uint64 {
+	return uint64(fi.ModTime().UnixNano())
+}
+
+// RecordVersion returns the current version of the record
+func (fs *Fs) RecordVersion(id uuid.UUID) (uint64, error) {
+	r, err := fs.getRecord(id)
+	if err != nil {
+		return 0, err
+	}
+
+	r.lock()
+	defer r.unlock()
+
+	return r.Version, nil
+}
+
+// SectionVersion returns the current version of the section
+func (fs *Fs) SectionVersion(id uuid.UUID, section string) (uint64, error) {
+	if err := checkSectionNameSanity(section); err != nil {
+		return 0, err
+	}
+
+	if _, err := fs.getRecord(id); err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(fs.getSectionFileName(id, section))
+	if err != nil {
+		return 0, err
+	}
+
+	return FileVersion(fi), nil
+}
@@ -3,3 +3,8 @@ module archiiv
 go 1.22
 
 require github.com/google/uuid v1.6.0
+
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// finished jobs are forgotten after this long
+const jobRetention = time.Hour
+
+type jobState string
+
+const (
+	jobRunning jobState = "running"
+	jobDone    jobState = "done"
+	jobFailed  jobState = "failed"
+)
+
+// job is a long running operation started by an endpoint. The client polls
+// GET /api/v1/jobs/{id} for its progress
+type job struct {
+	ID       uuid.UUID `json:"id"`
+	Owner    string    `json:"owner"`
+	KeyID    string    `json:"-"`
+	Kind     string    `json:"kind"`
+	State    jobState  `json:"state"`
+	Total    int       `json:"total"`
+	Done     int       `json:"done"`
+	Error    string    `json:"error,omitempty"`
+	Result   any       `json:"result,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+type jobStore struct {
+	lock sync.Mutex
+	jobs map[uuid.UUID]*job
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: make(map[uuid.UUID]*job)}
+}
+
+// start runs f in the background. f reports its progress by calling progress
+// with the number of finished items out of total. keyID is the API key that
+// started the job, if any
+func (js *jobStore) start(log *slog.Logger, owner, keyID, kind string, total int, f func(progress func(done int)) (any, error)) uuid.UUID {
+	j := &job{
+		ID:    uuid.New(),
+		Owner: owner,
+		KeyID: keyID,
+		Kind:  kind,
+		State: jobRunning,
+		Total: total,
+	}
+
+	js.lock.Lock()
+	js.purge()
+	js.jobs[j.ID] = j
+	js.lock.Unlock()
+
+	go func() {
+		result, err := f(func(done int) {
+			js.lock.Lock()
+			j.Done = done
+			js.lock.Unlock()
+		})
+
+		js.lock.Lock()
+		defer js.lock.Unlock()
+
+		j.Finished = time.Now().UTC()
+		if err != nil {
+			log.Error("job failed", "job", j.ID, "kind", kind, "error", err)
+			j.State = jobFailed
+			j.Error = err.Error()
+			return
+		}
+
+		j.State = jobDone
+		j.Done = j.Total
+		j.Result = result
+	}()
+
+	return j.ID
+}
+
+// has to be called with js.lock held
+func (js *jobStore) purge() {
+	for id, j := range js.jobs {
+		if j.State != jobRunning && time.Since(j.Finished) > jobRetention {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+func (js *jobStore) get(id uuid.UUID, owner string) (job, bool) {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+
+	j, ok := js.jobs[id]
+	if !ok || j.Owner != owner {
+		return job{}, false
+	}
+
+	return *j, true
+}
+
+func handleJob(secret []signingKey, log *slog.Logger, jobs *jobStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		j, ok := jobs.get(id, getUsername(r, secret))
+		if !ok || !keyMayUse(r, j.KeyID) {
+			sendError(log, w, http.StatusNotFound, "job not found")
+			return
+		}
+
+		sendOK(log, w, j)
+	})
+}
@@ -0,0 +1,229 @@
+// Package lease keeps advisory locks on files. A lease is either exclusive or
+// shared; a file can have one exclusive lease or any number of shared ones,
+// but users may always add more leases to the ones they hold themselves.
+// While a file has a live lease, only the users holding one may change it.
+//
+// Leases live only in memory and expire unless they are renewed.
+package lease
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound = errors.New("lease not found")
+	ErrConflict = errors.New("the file is locked by another user")
+	ErrLocked   = errors.New("the file is locked")
+)
+
+type Mode string
+
+const (
+	Exclusive Mode = "exclusive"
+	Shared    Mode = "shared"
+)
+
+type Lease struct {
+	ID      string    `json:"id"`
+	File    uuid.UUID `json:"file"`
+	Owner   string    `json:"owner"`
+	Mode    Mode      `json:"mode"`
+	Expires time.Time `json:"expires"`
+	// the API key the lease was acquired with, if any
+	KeyID string `json:"-"`
+}
+
+type Store struct {
+	lock   sync.Mutex
+	leases map[string]*Lease
+	byFile map[uuid.UUID][]*Lease
+	maxTTL time.Duration
+}
+
+// NewStore returns an empty store. Longer TTLs than maxTTL are shortened
+func NewStore(maxTTL time.Duration) *Store {
+	return &Store{
+		leases: map[string]*Lease{},
+		byFile: map[uuid.UUID][]*Lease{},
+		maxTTL: maxTTL,
+	}
+}
+
+func (s *Store) expiry(ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		return time.Time{}, errors.New("ttl must be positive")
+	}
+	return time.Now().Add(min(ttl, s.maxTTL)).UTC(), nil
+}
+
+// has to be called with the store locked
+func (s *Store) remove(l *Lease) {
+	delete(s.leases, l.ID)
+	kept := slices.DeleteFunc(s.byFile[l.File], func(o *Lease) bool { return o == l })
+	if len(kept) == 0 {
+		delete(s.byFile, l.File)
+	} else {
+		s.byFile[l.File] = kept
+	}
+}
+
+// live returns the leases of the file that haven't expired and forgets the
+// expired ones. Has to be called with the store locked
+func (s *Store) live(file uuid.UUID) []*Lease {
+	now := time.Now()
+	for _, l := range slices.Clone(s.byFile[file]) {
+		if now.After(l.Expires) {
+			s.remove(l)
+		}
+	}
+	return s.byFile[file]
+}
+
+// Acquire creates a new lease on the file
+func (s *Store) Acquire(owner, keyID string, file uuid.UUID, mode Mode, ttl time.Duration) (Lease, error) {
+	if mode != Exclusive && mode != Shared {
+		return Lease{}, errors.New("unknown lease mode")
+	}
+
+	expires, err := s.expiry(ttl)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, l := range s.live(file) {
+		if l.Owner != owner && (mode == Exclusive || l.Mode == Exclusive) {
+			return Lease{}, ErrConflict
+		}
+	}
+
+	l := &Lease{
+		ID:      uuid.NewString(),
+		File:    file,
+		Owner:   owner,
+		Mode:    mode,
+		KeyID:   keyID,
+		Expires: expires,
+	}
+	s.leases[l.ID] = l
+	s.byFile[file] = append(s.byFile[file], l)
+
+	return *l, nil
+}
+
+// has to be called with the store locked
+func (s *Store) get(id string) (*Lease, error) {
+	l, ok := s.leases[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if time.Now().After(l.Expires) {
+		s.remove(l)
+		return nil, ErrNotFound
+	}
+
+	return l, nil
+}
+
+// Get returns the lease unless it has expired
+func (s *Store) Get(id string) (Lease, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l, err := s.get(id)
+	if err != nil {
+		return Lease{}, err
+	}
+	return *l, nil
+}
+
+// Renew extends the lease to ttl from now
+func (s *Store) Renew(id string, ttl time.Duration) (Lease, error) {
+	expires, err := s.expiry(ttl)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l, err := s.get(id)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	l.Expires = expires
+	return *l, nil
+}
+
+// Release removes the lease
+func (s *Store) Release(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	s.remove(l)
+	return nil
+}
+
+// List returns the live leases of the file. A nil store has no leases
+func (s *Store) List(file uuid.UUID) []Lease {
+	if s == nil {
+		return []Lease{}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	leases := []Lease{}
+	for _, l := range s.live(file) {
+		leases = append(leases, *l)
+	}
+	return leases
+}
+
+// CheckWrite fails with ErrLocked if the file has a live lease and the user
+// doesn't hold any of its leases. A nil store has no leases
+func (s *Store) CheckWrite(file uuid.UUID, user string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	leases := s.live(file)
+	if len(leases) == 0 {
+		return nil
+	}
+
+	for _, l := range leases {
+		if l.Owner == user {
+			return nil
+		}
+	}
+
+	return ErrLocked
+}
+
+// PurgeExpired forgets all expired leases
+func (s *Store) PurgeExpired() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for file := range s.byFile {
+		s.live(file)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+// GET /api/v1/fs/list/{uuid}?sort=none|name|created|size|type&order=asc|desc
+//                          &type=image/&name=*.jpg&limit=100&cursor=...
+//
+// lists a directory a page at a time, next_cursor fetches the next page.
+// sort=created orders by the time the file was added to the archive, not by
+// the time a photo was taken. Children the user can't read are listed without
+// the fields that come from their metadata, type and created_at.
+
+import (
+	"archiiv/fs"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+)
+
+type listEntry struct {
+	UUID      uuid.UUID `json:"uuid"`
+	Name      string    `json:"name"`
+	IsDir     bool      `json:"is_dir"`
+	Type      string    `json:"type"`
+	CreatedAt uint64    `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// listCursor points right after the last entry of a page. The entries are
+// totally ordered by (key, uuid) so the next page starts at the first entry
+// that sorts after the cursor, even if the directory changed in between
+type listCursor struct {
+	Sort  string    `json:"sort"`
+	Desc  bool      `json:"desc"`
+	Str   string    `json:"str,omitempty"`
+	Num   int64     `json:"num,omitempty"`
+	Index int       `json:"index,omitempty"`
+	UUID  uuid.UUID `json:"uuid"`
+}
+
+func (c listCursor) encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(s string) (c listCursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &c)
+	return
+}
+
+type listOptions struct {
+	sort   string
+	desc   bool
+	typ    string
+	glob   string
+	limit  int
+	cursor *listCursor
+}
+
+func parseListOptions(q url.Values) (o listOptions, err error) {
+	o.sort = q.Get("sort")
+	switch o.sort {
+	case "":
+		o.sort = "none"
+	case "none", "name", "created", "size", "type":
+	default:
+		return o, fmt.Errorf("unknown sort %#v", o.sort)
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		o.desc = true
+	default:
+		return o, fmt.Errorf("unknown order %#v", q.Get("order"))
+	}
+
+	o.typ = q.Get("type")
+
+	o.glob = q.Get("name")
+	if _, err = path.Match(o.glob, ""); err != nil {
+		return o, fmt.Errorf("name glob: %w", err)
+	}
+
+	o.limit = listDefaultLimit
+	if l := q.Get("limit"); l != "" {
+		o.limit, err = strconv.Atoi(l)
+		if err != nil || o.limit < 1 || o.limit > listMaxLimit {
+			return o, fmt.Errorf("limit must be between 1 and %d", listMaxLimit)
+		}
+	}
+
+	if c := q.Get("cursor"); c != "" {
+		cursor, err := decodeListCursor(c)
+		if err != nil {
+			return o, fmt.Errorf("decode cursor: %w", err)
+		}
+		if cursor.Sort != o.sort || cursor.Desc != o.desc {
+			return o, errors.New("cursor was created with a different ordering")
+		}
+		o.cursor = &cursor
+	}
+
+	return o, nil
+}
+
+// matchesType reports whether the file type matches the filter. A filter
+// ending with a slash matches the whole MIME category, e.g. `image/`
+func matchesType(filter, typ string) bool {
+	if filter == "" {
+		return true
+	}
+	if strings.HasSuffix(filter, "/") {
+		return strings.HasPrefix(typ, filter)
+	}
+	return typ == filter
+}
+
+// sortKey returns the key the entry is ordered by. Entries with equal keys are
+// ordered by their uuid
+func sortKey(sort string, index int, e listEntry) listCursor {
+	c := listCursor{Sort: sort, UUID: e.UUID}
+	switch sort {
+	case "none":
+		c.Index = index
+	case "name":
+		c.Str = e.Name
+	case "created":
+		c.Num = int64(e.CreatedAt)
+	case "size":
+		c.Num = e.Size
+	case "type":
+		c.Str = e.Type
+	}
+	return c
+}
+
+func compareKeys(a, b listCursor) int {
+	return cmp.Or(
+		cmp.Compare(a.Index, b.Index),
+		cmp.Compare(a.Num, b.Num),
+		strings.Compare(a.Str, b.Str),
+		strings.Compare(a.UUID.String(), b.UUID.String()),
+	)
+}
+
+// readListMeta fills in the fields of the entry that come from its metadata,
+// if the user may read it
+func readListMeta(files *fs.Fs, username string, le *listEntry) {
+	fm, err := fs.ReadFileMeta(files, le.UUID)
+	if err != nil || fm.EffectivePerms(username)&fs.PermRead == 0 {
+		return
+	}
+	le.Type = fm.Type
+	le.CreatedAt = fm.CreatedAt
+}
+
+func listDir(files *fs.Fs, dir uuid.UUID, username string, o listOptions) (page []listEntry, next string, err error) {
+	entries, err := files.GetEntries(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	type keyed struct {
+		key   listCursor
+		entry listEntry
+	}
+
+	// the metadata of every child is only needed to filter or sort by it,
+	// otherwise only the returned page reads it
+	allMeta := o.typ != "" || o.sort == "created" || o.sort == "type"
+
+	all := make([]keyed, 0, len(entries))
+	for i, e := range entries {
+		if o.glob != "" {
+			if ok, _ := path.Match(o.glob, e.Name); !ok {
+				continue
+			}
+		}
+
+		le := listEntry{UUID: e.UUID, Name: e.Name, IsDir: e.IsDir, Size: e.Size}
+		if allMeta {
+			readListMeta(files, username, &le)
+		}
+
+		if !matchesType(o.typ, le.Type) {
+			continue
+		}
+
+		key := sortKey(o.sort, i, le)
+		key.Desc = o.desc
+		all = append(all, keyed{key: key, entry: le})
+	}
+
+	order := func(a, b listCursor) int {
+		if o.desc {
+			return compareKeys(b, a)
+		}
+		return compareKeys(a, b)
+	}
+
+	slices.SortStableFunc(all, func(a, b keyed) int {
+		return order(a.key, b.key)
+	})
+
+	start := 0
+	if o.cursor != nil && o.sort == "none" {
+		// positions shift when earlier children are unmounted, so look
+		// for the last returned child first
+		if i := slices.IndexFunc(all, func(k keyed) bool { return k.key.UUID == o.cursor.UUID }); i != -1 {
+			start = i + 1
+		} else {
+			start, _ = slices.BinarySearchFunc(all, *o.cursor, func(k keyed, c listCursor) int {
+				return order(k.key, c)
+			})
+		}
+	} else if o.cursor != nil {
+		start, _ = slices.BinarySearchFunc(all, *o.cursor, func(k keyed, c listCursor) int {
+			return order(k.key, c)
+		})
+		// the cursor points at the last returned entry, skip it if it
+		// still exists
+		if start < len(all) && order(all[start].key, *o.cursor) == 0 {
+			start++
+		}
+	}
+
+	end := min(start+o.limit, len(all))
+
+	page = make([]listEntry, 0, end-start)
+	for _, k := range all[start:end] {
+		if !allMeta {
+			readListMeta(files, username, &k.entry)
+		}
+		page = append(page, k.entry)
+	}
+
+	if end < len(all) {
+		next = all[end-1].key.encode()
+	}
+
+	return page, next, nil
+}
+
+func handleList(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
+	type Page struct {
+		Entries    []listEntry `json:"entries"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuidArg := r.PathValue("uuid")
+
+		id, e := uuid.Parse(uuidArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		o, e := parseListOptions(r.URL.Query())
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		page, next, e := listDir(files, id, username, o)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		sendOK(log, w, Page{Entries: page, NextCursor: next})
+	})
+}
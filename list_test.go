@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type listResponse struct {
+	Ok   bool `json:"ok"`
+	Data struct {
+		Entries    []listEntry `json:"entries"`
+		NextCursor string      `json:"next_cursor"`
+	} `json:"data"`
+}
+
+func listNames(t *testing.T, srv http.Handler, token string, dir uuid.UUID, query string) (names []string, next string) {
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/list/"+dir.String()+"?"+query, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	lr := decodeResponse[listResponse](t, res)
+	for _, e := range lr.Data.Entries {
+		names = append(names, e.Name)
+	}
+	return names, lr.Data.NextCursor
+}
+
+func TestListPagination(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	ids := map[string]uuid.UUID{}
+	for _, n := range []string{"c.jpg", "a.jpg", "e.png", "b.jpg", "d.jpg"} {
+		ids[n] = touchHelper(t, srv, token, root, n)
+	}
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+ids["b.jpg"].String()+"/data", token, strings.NewReader("bigger"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	names, next := listNames(t, srv, token, root, "sort=name&limit=2")
+	expectEqual(t, strings.Join(names, ","), "a.jpg,b.jpg", "first page")
+
+	// unmounting an already listed entry must not shift the next page
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/unmount/"+root.String()+"/"+ids["a.jpg"].String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	names, next = listNames(t, srv, token, root, "sort=name&limit=2&cursor="+next)
+	expectEqual(t, strings.Join(names, ","), "c.jpg,d.jpg", "second page")
+	names, next = listNames(t, srv, token, root, "sort=name&limit=2&cursor="+next)
+	expectEqual(t, strings.Join(names, ","), "e.png", "last page")
+	expectEqual(t, next, "", "cursor after last page")
+
+	names, _ = listNames(t, srv, token, root, "")
+	expectEqual(t, strings.Join(names, ","), "c.jpg,e.png,b.jpg,d.jpg", "stored order")
+
+	names, _ = listNames(t, srv, token, root, "sort=size&order=desc&limit=1")
+	expectEqual(t, strings.Join(names, ","), "b.jpg", "largest file")
+
+	names, _ = listNames(t, srv, token, root, "sort=name&name=*.jpg&order=desc")
+	expectEqual(t, strings.Join(names, ","), "d.jpg,c.jpg,b.jpg", "glob filter")
+}
+
+func TestListRejectsForeignCursor(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	touchHelper(t, srv, token, root, "a")
+	touchHelper(t, srv, token, root, "b")
+
+	_, next := listNames(t, srv, token, root, "sort=name&limit=1")
+
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/list/"+root.String()+"?sort=size&limit=1&cursor="+next, token, nil)
+	expectFail(t, res, http.StatusBadRequest, "cursor was created with a different ordering")
+}
+
+func TestListFollowsSectionChanges(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	file := touchHelper(t, srv, token, root, "a")
+
+	entry := func() listEntry {
+		res := hitAuth(srv, http.MethodGet, "/api/v1/fs/list/"+root.String()+"?sort=name", token, nil)
+		expectStatusCode(t, res, http.StatusOK)
+		lr := decodeResponse[listResponse](t, res)
+		if len(lr.Data.Entries) != 1 {
+			t.Fatalf("expected one entry, got %v", lr.Data.Entries)
+		}
+		return lr.Data.Entries[0]
+	}
+
+	upload := func(content string) {
+		res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", token, strings.NewReader(content))
+		expectStatusCode(t, res, http.StatusOK)
+	}
+
+	upload("ab")
+	e := entry()
+	expectEqual(t, e.Size, int64(2), "size after the first upload")
+	if e.CreatedAt == 0 {
+		t.Fatal("the page is missing the metadata")
+	}
+
+	upload("abcdef")
+	expectEqual(t, entry().Size, int64(6), "size after the second upload")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [{"op": "delete_section", "uuid": "`+file.String()+`", "section": "data"}]}`))
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, entry().Size, int64(0), "size after deleting the data")
+}
+
+func TestListHidesMetaOfUnreadableChildren(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	dir := mkdirHelper(t, srv, token, root, "album")
+	private := touchHelper(t, srv, token, dir, "private.jpg")
+	public := touchHelper(t, srv, token, dir, "public.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+dir.String()+`", "user": "ema", "perms": 2},
+		{"op": "set_perms", "uuid": "`+public.String()+`", "user": "ema", "perms": 2}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	for _, query := range []string{"", "sort=created"} {
+		res = hitAuth(srv, http.MethodGet, "/api/v1/fs/list/"+dir.String()+"?"+query, emaToken, nil)
+		expectStatusCode(t, res, http.StatusOK)
+		for _, e := range decodeResponse[listResponse](t, res).Data.Entries {
+			switch e.UUID {
+			case private:
+				expectEqual(t, e.CreatedAt, uint64(0), "created_at of the unreadable child")
+			case public:
+				if e.CreatedAt == 0 {
+					t.Error("created_at of the readable child is missing")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+// POST /api/v1/locks/{uuid}?mode=exclusive|shared&ttl=5m  acquires a lease
+// POST /api/v1/locks/renew/{id}?ttl=5m                    renews it
+// POST /api/v1/locks/release/{id}                         releases it
+//
+// While a file has a lease, the endpoints that change the file or remove it
+// from a directory reject users who don't hold one of its leases with 423
+// Locked. Both kinds of leases need the write permission.
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultLeaseTTL = 5 * time.Minute
+
+func sendLeaseError(log *slog.Logger, w http.ResponseWriter, e error) {
+	switch {
+	case errors.Is(e, lease.ErrNotFound):
+		sendError(log, w, http.StatusNotFound, e.Error())
+	case errors.Is(e, lease.ErrConflict), errors.Is(e, lease.ErrLocked):
+		sendError(log, w, http.StatusLocked, e.Error())
+	default:
+		sendError(log, w, http.StatusBadRequest, e.Error())
+	}
+}
+
+// checkUnlocked sends 423 and returns false unless the user may change all
+// the files
+func checkUnlocked(log *slog.Logger, w http.ResponseWriter, locks *lease.Store, username string, ids ...uuid.UUID) bool {
+	for _, id := range ids {
+		if e := locks.CheckWrite(id, username); e != nil {
+			sendLeaseError(log, w, e)
+			return false
+		}
+	}
+	return true
+}
+
+func parseLeaseTTL(r *http.Request) (time.Duration, error) {
+	ttl := r.URL.Query().Get("ttl")
+	if ttl == "" {
+		return defaultLeaseTTL, nil
+	}
+	return time.ParseDuration(ttl)
+}
+
+func handleLockAcquire(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		mode := lease.Mode(r.URL.Query().Get("mode"))
+		if mode == "" {
+			mode = lease.Exclusive
+		}
+
+		ttl, e := parseLeaseTTL(r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse ttl: %v", e))
+			return
+		}
+
+		// every lease keeps others from writing, so only writers may
+		// take one
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		locks.PurgeExpired()
+
+		l, e := locks.Acquire(username, apiKeyID(r), id, mode, ttl)
+		if e != nil {
+			sendLeaseError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, l)
+	})
+}
+
+// getOwnLease returns the lease only if it belongs to the logged in user.
+// Leases of other users are reported as not found
+func getOwnLease(secret []signingKey, locks *lease.Store, r *http.Request) (lease.Lease, error) {
+	l, e := locks.Get(r.PathValue("id"))
+	if e != nil {
+		return l, e
+	}
+
+	if l.Owner != getUsername(r, secret) || !keyMayUse(r, l.KeyID) {
+		return lease.Lease{}, lease.ErrNotFound
+	}
+
+	return l, nil
+}
+
+func handleLockRenew(secret []signingKey, log *slog.Logger, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ttl, e := parseLeaseTTL(r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse ttl: %v", e))
+			return
+		}
+
+		l, e := getOwnLease(secret, locks, r)
+		if e != nil {
+			sendLeaseError(log, w, e)
+			return
+		}
+
+		l, e = locks.Renew(l.ID, ttl)
+		if e != nil {
+			sendLeaseError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, l)
+	})
+}
+
+func handleLockRelease(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, e := locks.Get(r.PathValue("id"))
+		if e != nil {
+			sendLeaseError(log, w, e)
+			return
+		}
+
+		// owners of the file can break leases left behind by others
+		username := getUsername(r, secret)
+		if !keyMayUse(r, l.KeyID) || (l.Owner != username && checkPerm(files, l.File, username, fs.PermOwner) != nil) {
+			sendLeaseError(log, w, lease.ErrNotFound)
+			return
+		}
+
+		if e = locks.Release(l.ID); e != nil {
+			sendLeaseError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archiiv/lease"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type leaseResponse struct {
+	Ok   bool        `json:"ok"`
+	Data lease.Lease `json:"data"`
+}
+
+func TestLocks(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	file := touchHelper(t, srv, token, root, "doc.txt")
+	// let ema write too
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [{"op": "set_perms", "uuid": "`+file.String()+`", "user": "ema", "perms": 7}]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+file.String()+"?ttl=1m", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	l := decodeResponse[leaseResponse](t, res).Data
+	expectEqual(t, l.Mode, lease.Exclusive, "default mode")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+file.String()+"?mode=shared", emaToken, nil)
+	expectStatusCode(t, res, http.StatusLocked)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", emaToken, strings.NewReader("ema"))
+	expectStatusCode(t, res, http.StatusLocked)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/rename/"+file.String()+"/x", emaToken, nil)
+	expectStatusCode(t, res, http.StatusLocked)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", token, strings.NewReader("marek"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+file.String(), emaToken, nil)
+	st := decodeResponse[struct {
+		Ok   bool     `json:"ok"`
+		Data fileStat `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(st.Locks), 1, "locks in stat")
+	expectEqual(t, st.Locks[0].Owner, "marek", "lock owner")
+
+	// only the holder can renew
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/renew/"+l.ID, emaToken, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/renew/"+l.ID+"?ttl=2h", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	renewed := decodeResponse[leaseResponse](t, res).Data
+	if renewed.Expires.After(time.Now().Add(time.Hour + time.Minute)) {
+		t.Error("the ttl was not capped")
+	}
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/release/"+l.ID, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", emaToken, strings.NewReader("ema"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	// shared leases let all holders write
+	for _, tok := range []string{token, emaToken} {
+		res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+file.String()+"?mode=shared", tok, nil)
+		expectStatusCode(t, res, http.StatusOK)
+	}
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+file.String(), token, nil)
+	expectStatusCode(t, res, http.StatusLocked)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", emaToken, strings.NewReader("shared"))
+	expectStatusCode(t, res, http.StatusOK)
+}
+
+func TestLockExpiry(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	dir := mkdirHelper(t, srv, token, root, "shared")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [{"op": "set_perms", "uuid": "`+dir.String()+`", "user": "ema", "perms": 7}]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+dir.String()+"?ttl=50ms", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+dir.String()+"/a", emaToken, nil)
+	expectStatusCode(t, res, http.StatusLocked)
+
+	time.Sleep(100 * time.Millisecond)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+dir.String()+"/a", emaToken, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+dir.String(), token, nil)
+	expectEqual(t, len(decodeResponse[struct {
+		Ok   bool     `json:"ok"`
+		Data fileStat `json:"data"`
+	}](t, res).Data.Locks), 0, "locks after expiry")
+}
+
+func TestLocksNeedWritersAndProtectRemoval(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	dir := mkdirHelper(t, srv, token, root, "shared")
+	file := touchHelper(t, srv, token, dir, "doc.txt")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+dir.String()+`", "user": "ema", "perms": 7},
+		{"op": "set_perms", "uuid": "`+file.String()+`", "user": "ema", "perms": 2}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	// a reader can't keep the writers out with a shared lease
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+file.String()+"?mode=shared", emaToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	// a locked file can't be removed from its directory by others
+	res = hitAuth(srv, http.MethodPost, "/api/v1/locks/"+file.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/unmount/"+dir.String()+"/"+file.String(), emaToken, nil)
+	expectStatusCode(t, res, http.StatusLocked)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/delete/"+dir.String()+"/"+file.String(), emaToken, nil)
+	expectStatusCode(t, res, http.StatusLocked)
+	expectEqual(t, len(lsHelper(t, srv, token, dir)), 1, "files in the directory")
+}
@@ -1,21 +1,45 @@
 package main
 
 import (
+	"archiiv/apikey"
 	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/oidc"
+	"archiiv/session"
+	"archiiv/share"
+	"archiiv/snapshot"
+	"archiiv/trash"
+	"archiiv/upload"
 	"archiiv/user"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:], os.Getenv, os.Stdout); err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	log := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
 	srv, conf, err := createServer(log, os.Args[1:], os.Getenv)
@@ -24,6 +48,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the users file is reloaded when it changes but an explicit reload
+	// is handy after editing it by hand
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("reloading users")
+			user.RequestReload()
+		}
+	}()
+
 	err = run(log, srv, conf)
 	if err != nil {
 		fmt.Printf("error from run: %s\n", err)
@@ -37,7 +72,7 @@ func createServer(log *slog.Logger, args []string, env func(string) string) (htt
 		return nil, config{}, fmt.Errorf("get config: %w", err)
 	}
 
-	users, err := user.LoadUsers(conf.usersPath)
+	users, err := user.LoadUsers(conf.usersPath, conf.hashParams)
 	if err != nil {
 		return nil, config{}, fmt.Errorf("load users: %w", err)
 	}
@@ -47,6 +82,53 @@ func createServer(log *slog.Logger, args []string, env func(string) string) (htt
 		return nil, config{}, fmt.Errorf("new fs: %w", err)
 	}
 
+	uploads, err := upload.NewStore(conf.uploadsPath, conf.uploadExpiry, conf.uploadMaxSize)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("new upload store: %w", err)
+	}
+
+	bin, dropped, err := trash.Load(conf.trashPath, time.Duration(conf.trashDays)*24*time.Hour, files)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("load trash: %w", err)
+	}
+	for _, e := range dropped {
+		log.Error("dropped trash entry of a missing file", "uuid", e.UUID, "user", e.DeletedBy)
+	}
+
+	// the trash purges itself when used, an idle server needs a nudge
+	go func() {
+		for range time.Tick(trashPurgeInterval) {
+			if err := bin.PurgeExpired(); err != nil {
+				log.Error("purge trash", "error", err)
+			}
+		}
+	}()
+
+	snaps, err := snapshot.NewStore(conf.snapshotsPath, files)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("new snapshot store: %w", err)
+	}
+
+	sessions, err := session.Load(conf.sessionsPath)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("load sessions: %w", err)
+	}
+
+	shares, err := share.Load(conf.sharesPath)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("load shares: %w", err)
+	}
+
+	keys, err := apikey.Load(conf.apiKeysPath)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("load API keys: %w", err)
+	}
+
+	var provider *oidc.Provider
+	if conf.oidc.Issuer != "" {
+		provider = oidc.New(conf.oidc)
+	}
+
 	mux := http.NewServeMux()
 	addRoutes(
 		mux,
@@ -54,20 +136,51 @@ func createServer(log *slog.Logger, args []string, env func(string) string) (htt
 		conf.secret,
 		users,
 		files,
+		uploads,
+		newJobStore(),
+		bin,
+		snaps,
+		lease.NewStore(conf.lockMaxTTL),
+		sessions,
+		shares,
+		keys,
+		provider,
+		conf.oidcUsernameClaim,
+		conf.oidcAutoProvision,
+		conf.uploadsPath,
+		conf.expandLimit,
 	)
 	var srv http.Handler = mux
+	srv = rejectRevokedTokens(conf.secret, log, sessions, srv)
+	srv = acceptAPIKeys(log, keys, users, files, srv)
 	srv = logAccesses(log, srv)
 
 	return srv, conf, nil
 }
 
 type config struct {
-	host      string
-	port      string
-	secret    string
-	usersPath string
-	fsRoot    string
-	rootUUID  uuid.UUID
+	host          string
+	port          string
+	secret        []signingKey
+	usersPath     string
+	fsRoot        string
+	uploadsPath   string
+	uploadExpiry  time.Duration
+	uploadMaxSize int64
+	trashPath     string
+	trashDays     int
+	sessionsPath  string
+	sharesPath    string
+	apiKeysPath   string
+	snapshotsPath string
+	expandLimit   int64
+	lockMaxTTL    time.Duration
+	hashParams    user.HashParams
+	rootUUID      uuid.UUID
+	// the login through OpenID Connect is off without oidc.Issuer
+	oidc              oidc.Config
+	oidcUsernameClaim string
+	oidcAutoProvision bool
 }
 
 func getConfig(args []string, env func(string) string) (conf config, err error) {
@@ -77,6 +190,28 @@ func getConfig(args []string, env func(string) string) (conf config, err error)
 	flags.StringVar(&conf.port, "port", "8275", "")
 	flags.StringVar(&conf.fsRoot, "fs_root", "", "")
 	flags.StringVar(&conf.usersPath, "users_path", "", "")
+	flags.StringVar(&conf.uploadsPath, "uploads_path", "", "defaults to uploads next to fs_root")
+	flags.DurationVar(&conf.uploadExpiry, "upload_expiry", 24*time.Hour, "")
+	flags.Int64Var(&conf.uploadMaxSize, "upload_max_size", 0, "max bytes of one resumable upload, 0 means no limit")
+	flags.StringVar(&conf.trashPath, "trash_path", "", "defaults to trash.json next to users_path")
+	flags.IntVar(&conf.trashDays, "trash_days", 30, "days after which deleted files are purged")
+	flags.StringVar(&conf.sessionsPath, "sessions_path", "", "defaults to sessions.json next to users_path")
+	flags.StringVar(&conf.sharesPath, "shares_path", "", "defaults to shares.json next to users_path")
+	flags.StringVar(&conf.apiKeysPath, "api_keys_path", "", "defaults to api_keys.json next to users_path")
+	flags.StringVar(&conf.snapshotsPath, "snapshots_path", "", "defaults to snapshots next to fs_root")
+	flags.Int64Var(&conf.expandLimit, "expand_limit", 0, "max bytes unpacked from one uploaded archive, 0 means no limit")
+	flags.DurationVar(&conf.lockMaxTTL, "lock_max_ttl", time.Hour, "longest time a lock is held without renewal")
+	var argonTime, argonMemory, argonThreads uint
+	flags.UintVar(&argonTime, "argon2_time", uint(user.DefaultHashParams.Time), "argon2id passes for new password hashes")
+	flags.UintVar(&argonMemory, "argon2_memory", uint(user.DefaultHashParams.Memory), "KiB of memory for new password hashes")
+	flags.UintVar(&argonThreads, "argon2_threads", uint(user.DefaultHashParams.Threads), "")
+	flags.StringVar(&conf.oidc.Issuer, "oidc_issuer", "", "URL of the OpenID Connect provider, empty turns the login through it off")
+	flags.StringVar(&conf.oidc.ClientID, "oidc_client_id", "", "")
+	flags.StringVar(&conf.oidc.RedirectURL, "oidc_redirect_url", "", "URL of /api/v1/oidc/callback as the browser sees it")
+	var oidcScopes string
+	flags.StringVar(&oidcScopes, "oidc_scopes", "openid profile email", "")
+	flags.StringVar(&conf.oidcUsernameClaim, "oidc_username_claim", "preferred_username", "claim of the ID token used as the username")
+	flags.BoolVar(&conf.oidcAutoProvision, "oidc_auto_provision", false, "create users that log in through OpenID Connect for the first time")
 	var rootUUIDString string
 	flags.StringVar(&rootUUIDString, "root_uuid", "", "")
 
@@ -96,7 +231,84 @@ func getConfig(args []string, env func(string) string) (conf config, err error)
 		return
 	}
 
-	conf.secret = env("ARCHIIV_SECRET")
+	if argonTime < 1 || argonTime > math.MaxUint32 || argonThreads < 1 || argonThreads > math.MaxUint8 ||
+		argonMemory < 8*argonThreads || argonMemory > math.MaxUint32 {
+		err = errors.New("argon2 parameters out of range")
+		return
+	}
+	conf.hashParams = user.HashParams{Time: uint32(argonTime), Memory: uint32(argonMemory), Threads: uint8(argonThreads)}
+
+	if conf.uploadsPath == "" {
+		conf.uploadsPath = filepath.Join(filepath.Dir(conf.fsRoot), "uploads")
+	}
+
+	if !filepath.IsAbs(conf.uploadsPath) {
+		err = fmt.Errorf("uploads path must be absolute path (is %#v)", conf.uploadsPath)
+		return
+	}
+
+	if conf.trashPath == "" {
+		conf.trashPath = filepath.Join(filepath.Dir(conf.usersPath), "trash.json")
+	}
+
+	if !filepath.IsAbs(conf.trashPath) {
+		err = fmt.Errorf("trash path must be absolute path (is %#v)", conf.trashPath)
+		return
+	}
+
+	if conf.sessionsPath == "" {
+		conf.sessionsPath = filepath.Join(filepath.Dir(conf.usersPath), "sessions.json")
+	}
+
+	if !filepath.IsAbs(conf.sessionsPath) {
+		err = fmt.Errorf("sessions path must be absolute path (is %#v)", conf.sessionsPath)
+		return
+	}
+
+	if conf.sharesPath == "" {
+		conf.sharesPath = filepath.Join(filepath.Dir(conf.usersPath), "shares.json")
+	}
+
+	if !filepath.IsAbs(conf.sharesPath) {
+		err = fmt.Errorf("shares path must be absolute path (is %#v)", conf.sharesPath)
+		return
+	}
+
+	if conf.apiKeysPath == "" {
+		conf.apiKeysPath = filepath.Join(filepath.Dir(conf.usersPath), "api_keys.json")
+	}
+
+	if !filepath.IsAbs(conf.apiKeysPath) {
+		err = fmt.Errorf("API keys path must be absolute path (is %#v)", conf.apiKeysPath)
+		return
+	}
+
+	if conf.snapshotsPath == "" {
+		conf.snapshotsPath = filepath.Join(filepath.Dir(conf.fsRoot), "snapshots")
+	}
+
+	if !filepath.IsAbs(conf.snapshotsPath) {
+		err = fmt.Errorf("snapshots path must be absolute path (is %#v)", conf.snapshotsPath)
+		return
+	}
+
+	if conf.secret, err = secretToKeys(env("ARCHIIV_SECRET")); err != nil {
+		err = fmt.Errorf("ARCHIIV_SECRET: %w", err)
+		return
+	}
+
+	if conf.oidc.Issuer != "" {
+		if conf.oidc.ClientID == "" || conf.oidc.RedirectURL == "" {
+			err = errors.New("oidc_issuer needs oidc_client_id and oidc_redirect_url")
+			return
+		}
+		conf.oidc.Scopes = strings.Fields(oidcScopes)
+		if !slices.Contains(conf.oidc.Scopes, "openid") {
+			err = errors.New("oidc_scopes must contain openid")
+			return
+		}
+		conf.oidc.ClientSecret = env("ARCHIIV_OIDC_CLIENT_SECRET")
+	}
 
 	conf.rootUUID, err = uuid.Parse(rootUUIDString)
 	if err != nil {
@@ -3,15 +3,19 @@ package main
 import (
 	"archiiv/fs"
 	"bytes"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/google/uuid"
 )
 
 func newTestServer(t *testing.T) http.Handler {
@@ -19,8 +23,27 @@ func newTestServer(t *testing.T) http.Handler {
 }
 
 func newTestServerWithUsers(t *testing.T, users map[string][64]byte) http.Handler {
-	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	srv, _ := newTestServerWithRoot(t, users)
+	return srv
+}
+
+func newTestServerWithRoot(t *testing.T, users map[string][64]byte) (http.Handler, uuid.UUID) {
+	env := newTestEnv(t, users)
+	return env.srv, env.root
+}
+
+type testEnv struct {
+	srv    http.Handler
+	root   uuid.UUID
+	secret string
+	// the secret parsed, to sign tokens
+	keys []signingKey
+	dir  string
+}
 
+// newTestEnv creates a server in a fresh directory. extraArgs are appended to
+// the command line arguments
+func newTestEnv(t *testing.T, users map[string][64]byte, extraArgs ...string) testEnv {
 	dir := t.TempDir()
 	rootUUID, err := fs.InitFsDir(dir, users)
 	if err != nil {
@@ -28,12 +51,24 @@ func newTestServerWithUsers(t *testing.T, users map[string][64]byte) http.Handle
 	}
 
 	secret := generateSecret()
+	srv := startTestServer(t, dir, rootUUID, secret, extraArgs...)
 
-	srv, _, err := createServer(log, []string{
+	return testEnv{srv: srv, root: rootUUID, secret: secret, keys: mustKeys(t, secret), dir: dir}
+}
+
+// startTestServer creates a server over the files in dir, also to simulate a
+// restart of the server of a testEnv
+func startTestServer(t *testing.T, dir string, rootUUID uuid.UUID, secret string, extraArgs ...string) http.Handler {
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	srv, _, err := createServer(log, append([]string{
 		"--fs_root", filepath.Join(dir, "fs"),
 		"--users_path", filepath.Join(dir, "users.json"),
 		"--root_uuid", rootUUID.String(),
-	}, func(s string) string {
+		// the tests log in a lot
+		"--argon2_time", "1",
+		"--argon2_memory", "64",
+	}, extraArgs...), func(s string) string {
 		if s == "ARCHIIV_SECRET" {
 			return secret
 		}
@@ -47,6 +82,27 @@ func newTestServerWithUsers(t *testing.T, users map[string][64]byte) http.Handle
 	return srv
 }
 
+// renameOnDisk changes the name in the stored record, bypassing the checks of
+// the fs. The servers of the env only see the name after a restart
+func renameOnDisk(t *testing.T, env testEnv, id uuid.UUID, name string) {
+	p := filepath.Join(env.dir, "fs", id.String())
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	rec["name"] = name
+	if b, err = json.Marshal(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func decodeResponse[T any](t *testing.T, r *http.Response) (v T) {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
@@ -87,19 +143,23 @@ func expectFail(t *testing.T, res *http.Response, statusCode int, errorMessage s
 }
 
 func expectStringLooksLikeToken(t *testing.T, token string) {
-	data, err := base64.URLEncoding.DecodeString(token)
+	version, rest, ok := strings.Cut(token, ".")
+	if !ok || version != tokenVersion {
+		t.Errorf("string does not look like token: version %#v", version)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(rest)
 	if err != nil {
 		t.Errorf("string does not look like token: base64 decode: %v", err)
 	}
 
-	ft, err := gobDecode[fullToken](data)
-	if err != nil {
-		t.Errorf("string does not look like token: gob decode %v", err)
+	if len(data) < ed25519.SignatureSize {
+		t.Fatalf("string does not look like token: too short")
 	}
 
-	_, err = payloadToBytes(ft.Data)
+	_, err = decodePayload(data[:len(data)-ed25519.SignatureSize])
 	if err != nil {
-		t.Errorf("string does not look like token: payload to bytes: %v", err)
+		t.Errorf("string does not look like token: decode payload: %v", err)
 	}
 }
 
@@ -121,6 +181,42 @@ func hitPost(t *testing.T, srv http.Handler, target string, body any) *http.Resp
 	return hit(srv, http.MethodPost, "/api/v1/login", &buf)
 }
 
+func hitAuth(srv http.Handler, method, target, token string, body io.Reader) *http.Response {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func touchHelper(t *testing.T, srv http.Handler, token string, parent uuid.UUID, name string) uuid.UUID {
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+parent.String()+"/"+name, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	tr := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			NewFileUUID uuid.UUID `json:"new_file_uuid"`
+		} `json:"data"`
+	}](t, res)
+
+	return tr.Data.NewFileUUID
+}
+
+func mkdirHelper(t *testing.T, srv http.Handler, token string, parent uuid.UUID, name string) uuid.UUID {
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/mkdir/"+parent.String()+"/"+name, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	mr := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			NewDirUUID uuid.UUID `json:"new_dir_uuid"`
+		} `json:"data"`
+	}](t, res)
+
+	return mr.Data.NewDirUUID
+}
+
 func hitGet(srv http.Handler, target string) *http.Response {
 	req := httptest.NewRequest(http.MethodGet, target, strings.NewReader(""))
 	w := httptest.NewRecorder()
@@ -129,17 +225,18 @@ func hitGet(srv http.Handler, target string) *http.Response {
 }
 
 type loginRequest struct {
-	Username string   `json:"username"`
-	Password [64]byte `json:"password"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 func loginHelper(t *testing.T, srv http.Handler, username, pwd string) string {
-	res := hitPost(t, srv, "/api/v1/login", loginRequest{Username: username, Password: hashPassword(pwd)})
+	res := hitPost(t, srv, "/api/v1/login", loginRequest{Username: username, Password: pwd})
 
 	type LoginResponse struct {
 		Ok   bool `json:"ok"`
 		Data struct {
-			Token string `json:"token"`
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
 		} `json:"data"`
 	}
 
@@ -171,15 +268,16 @@ func TestLogin(t *testing.T) {
 		"prokop": hashPassword("catboy123"),
 	})
 
-	expectFail(t, hitPost(t, srv, "/api/v1/login", loginRequest{Username: "prokop", Password: hashPassword("eek")}), http.StatusForbidden, "wrong name or password")
-	expectFail(t, hitPost(t, srv, "/api/v1/login", loginRequest{Username: "prokop", Password: hashPassword("uuhk")}), http.StatusForbidden, "wrong name or password")
-	expectFail(t, hitPost(t, srv, "/api/v1/login", loginRequest{Username: "marek", Password: hashPassword("catboy123")}), http.StatusForbidden, "wrong name or password")
-	res := hitPost(t, srv, "/api/v1/login", loginRequest{Username: "prokop", Password: hashPassword("catboy123")})
+	expectFail(t, hitPost(t, srv, "/api/v1/login", loginRequest{Username: "prokop", Password: "eek"}), http.StatusForbidden, "wrong name or password")
+	expectFail(t, hitPost(t, srv, "/api/v1/login", loginRequest{Username: "prokop", Password: "uuhk"}), http.StatusForbidden, "wrong name or password")
+	expectFail(t, hitPost(t, srv, "/api/v1/login", loginRequest{Username: "marek", Password: "catboy123"}), http.StatusForbidden, "wrong name or password")
+	res := hitPost(t, srv, "/api/v1/login", loginRequest{Username: "prokop", Password: "catboy123"})
 	expectStatusCode(t, res, http.StatusOK)
 	response := decodeResponse[struct {
 		Ok   bool `json:"ok"`
 		Data struct {
-			Token string `json:"token"`
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
 		} `json:"data"`
 	}](t, res)
 	expectEqual(t, response.Ok, true, "ok field of the response")
@@ -201,3 +299,229 @@ func TestWhoami(t *testing.T) {
 	expectStatusCode(t, res, http.StatusOK)
 	expectBody(t, res, "{\"ok\":true,\"data\":{\"name\":\"matúš\"}}\n")
 }
+
+type statResponse struct {
+	Ok   bool     `json:"ok"`
+	Data fileStat `json:"data"`
+}
+
+func TestStat(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek":  hashPassword("heslo"),
+		"prokop": hashPassword("catboy123"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	other := loginHelper(t, srv, "prokop", "catboy123")
+	file := touchHelper(t, srv, token, root, "pozdrav.txt")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", token, strings.NewReader("ahoj"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+file.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	st := decodeResponse[statResponse](t, res).Data
+
+	expectEqual(t, st.UUID, file, "uuid")
+	expectEqual(t, st.Name, "pozdrav.txt", "name")
+	expectEqual(t, st.IsDir, false, "is dir")
+	expectEqual(t, st.Refs, 1, "refs")
+	expectEqual(t, st.Perms, fs.PermAll, "perms of the creator")
+	if st.Meta == nil {
+		t.Fatal("meta is missing")
+	}
+	expectEqual(t, st.Meta.CreatedBy, "marek", "creator")
+	expectEqual(t, len(st.Sections), 2, "number of sections")
+	expectEqual(t, st.Sections[0].Name, "data", "first section")
+	expectEqual(t, st.Sections[0].Size, 4, "data size")
+	expectEqual(t, st.Sections[0].SHA256, "3f3b08eca62c21d76256e6e1d0b8bf99f4efbe376f64335b72f4163a8fc50dba", "data hash")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+file.String(), other, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	otherSt := decodeResponse[statResponse](t, res).Data
+	expectEqual(t, otherSt.Perms, 0, "perms of other user")
+	expectEqual(t, otherSt.Name, "", "name seen by other user")
+	if otherSt.Meta != nil || len(otherSt.Sections) != 0 {
+		t.Errorf("stat leaks the file to a user who can't read it: %+v", otherSt)
+	}
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+root.String()+"?stat=true", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	ls := decodeResponse[struct {
+		Ok   bool       `json:"ok"`
+		Data []fileStat `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(ls), 1, "number of children")
+	expectEqual(t, ls[0].Name, "pozdrav.txt", "child name")
+}
+
+func lsHelper(t *testing.T, srv http.Handler, token string, dir uuid.UUID) []uuid.UUID {
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+dir.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	return decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data []uuid.UUID `json:"data"`
+	}](t, res).Data
+}
+
+func TestRenameAndMove(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek":  hashPassword("heslo"),
+		"prokop": hashPassword("catboy123"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	sub := mkdirHelper(t, srv, token, album, "sub")
+	file := touchHelper(t, srv, token, root, "a.jpg")
+	touchHelper(t, srv, token, album, "b.jpg")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/rename/"+file.String()+"/b.jpg", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+root.String()+"/"+file.String()+"/"+album.String(), token, nil)
+	expectFail(t, res, http.StatusConflict, "name already exists in the directory")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/rename/"+file.String()+"/c.jpg", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+root.String()+"/"+file.String()+"/"+album.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 1, "children of root")
+	expectEqual(t, len(lsHelper(t, srv, token, album)), 3, "children of album")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+file.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	st := decodeResponse[statResponse](t, res).Data
+	expectEqual(t, st.Name, "c.jpg", "name after rename")
+	expectEqual(t, st.Refs, 1, "refs after move")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+root.String()+"/"+album.String()+"/"+sub.String(), token, nil)
+	expectStatusCode(t, res, http.StatusInternalServerError)
+
+	other := loginHelper(t, srv, "prokop", "catboy123")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+album.String()+"/"+file.String()+"/"+sub.String(), other, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	// writing both directories is not enough to move a file one can't read
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+album.String()+`", "user": "prokop", "perms": 4},
+		{"op": "set_perms", "uuid": "`+sub.String()+`", "user": "prokop", "perms": 4}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+album.String()+"/"+file.String()+"/"+sub.String(), other, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/rename/"+file.String()+"/d.jpg", other, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
+
+// TestMoveFinishedAfterCrash writes what a move leaves behind when the server
+// stops right after its commit point and checks that the next start finishes
+// it, but never replaces a record by an older version
+func TestMoveFinishedAfterCrash(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, env.srv, "marek", "heslo")
+
+	a := mkdirHelper(t, env.srv, token, env.root, "a")
+	b := mkdirHelper(t, env.srv, token, env.root, "b")
+	file := touchHelper(t, env.srv, token, a, "f")
+	touchHelper(t, env.srv, token, b, "g")
+
+	fsDir := filepath.Join(env.dir, "fs")
+	type journalEntry struct {
+		Tmp    string    `json:"tmp"`
+		Record uuid.UUID `json:"record"`
+	}
+	var journal []journalEntry
+	// change the record as the move would have and leave it in .tmp
+	stage := func(id uuid.UUID, change func(children []uuid.UUID) []uuid.UUID, version uint64) {
+		b, err := os.ReadFile(filepath.Join(fsDir, id.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec map[string]any
+		if err := json.Unmarshal(b, &rec); err != nil {
+			t.Fatal(err)
+		}
+		var children []uuid.UUID
+		for _, c := range rec["children"].([]any) {
+			children = append(children, uuid.MustParse(c.(string)))
+		}
+		rec["children"] = change(children)
+		rec["version"] = rec["version"].(float64) + float64(version)
+		b, err = json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := id.String() + ".staged"
+		if err := os.WriteFile(filepath.Join(fsDir, ".tmp", name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		journal = append(journal, journalEntry{Tmp: name, Record: id})
+	}
+	stage(a, func([]uuid.UUID) []uuid.UUID { return []uuid.UUID{} }, 1)
+	stage(b, func(ch []uuid.UUID) []uuid.UUID { return append(ch, file) }, 1)
+	// a journal left behind by an older write must not undo later ones
+	stage(env.root, func([]uuid.UUID) []uuid.UUID { return []uuid.UUID{} }, 0)
+
+	jb, err := json.Marshal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fsDir, ".tmp", "move.journal"), jb, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := startTestServer(t, env.dir, env.root, env.secret)
+	expectEqual(t, len(lsHelper(t, srv, token, a)), 0, "children of the source")
+	expectEqual(t, len(lsHelper(t, srv, token, b)), 2, "children of the target")
+	expectEqual(t, len(lsHelper(t, srv, token, env.root)), 2, "children of the root")
+
+	res := hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+file.String(), token, nil)
+	expectEqual(t, decodeResponse[statResponse](t, res).Data.Refs, 1, "refs of the moved file")
+}
+
+func TestBadNames(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	file := touchHelper(t, srv, token, root, "a.jpg")
+
+	const msg = "a name can't be empty, '.' or '..' and can't contain '/'"
+	for _, name := range []string{"a%2Fb", "%2E", "%2E%2E"} {
+		res := hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+root.String()+"/"+name, token, nil)
+		expectFail(t, res, http.StatusBadRequest, msg)
+		res = hitAuth(srv, http.MethodPost, "/api/v1/fs/mkdir/"+root.String()+"/"+name, token, nil)
+		expectFail(t, res, http.StatusBadRequest, msg)
+		res = hitAuth(srv, http.MethodPost, "/api/v1/fs/rename/"+file.String()+"/"+name, token, nil)
+		expectFail(t, res, http.StatusBadRequest, msg)
+	}
+
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 1, "children of root")
+}
+
+func TestBadSecretFailsStartup(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	rootUUID, err := fs.InitFsDir(dir, map[string][64]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	_, _, err = createServer(log, []string{
+		"--fs_root", filepath.Join(dir, "fs"),
+		"--users_path", filepath.Join(dir, "users.json"),
+		"--root_uuid", rootUUID.String(),
+	}, func(s string) string {
+		if s == "ARCHIIV_SECRET" {
+			return "nonsense"
+		}
+		return ""
+	})
+	if err == nil || !strings.Contains(err.Error(), "ARCHIIV_SECRET") {
+		t.Fatalf("expected a secret error, got %v", err)
+	}
+}
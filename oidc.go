@@ -0,0 +1,116 @@
+package main
+
+// GET /api/v1/oidc/login     redirects to the OpenID Connect provider
+// GET /api/v1/oidc/callback  the provider redirects back here, the response
+//                            has the same tokens as /api/v1/login
+//
+// Users log in as the user linked to their subject at the provider. Root links
+// existing users with POST /api/v1/users/update/{name} {"oidc_subject": ...}.
+// With --oidc_auto_provision a subject that isn't linked yet gets a new user
+// with a random password, named by a claim of the ID token
+// (--oidc_username_claim). A name that is already taken is refused.
+
+import (
+	"archiiv/oidc"
+	"archiiv/user"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+func handleOIDCLogin(log *slog.Logger, provider *oidc.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, e := provider.AuthCodeURL(r.Context())
+		if e != nil {
+			sendError(log, w, http.StatusBadGateway, fmt.Sprintf("start login: %v", e))
+			return
+		}
+
+		http.Redirect(w, r, u, http.StatusFound)
+	})
+}
+
+// oidcUser returns the user linked to the subject of the claims. Users are
+// linked by an admin, or when they are created on their first login with
+// auto provisioning. The username claim is used only to name new users
+// because the user may be able to change it at the provider
+func oidcUser(userStore *user.UserStore, claims oidc.Claims, usernameClaim string, autoProvision bool) (string, error) {
+	name, e := userStore.ByOIDCSubject(claims.Subject())
+	if errors.Is(e, user.ErrNotFound) {
+		if !autoProvision {
+			return "", errors.New("no user is linked to the account at the provider")
+		}
+		name, e = provisionOIDCUser(userStore, claims, usernameClaim)
+	}
+	if e != nil {
+		return "", e
+	}
+
+	if !userStore.Active(name) {
+		return "", errors.New("the user is disabled")
+	}
+
+	return name, nil
+}
+
+// provisionOIDCUser creates a user linked to the subject of the claims. An
+// existing user is never taken over
+func provisionOIDCUser(userStore *user.UserStore, claims oidc.Claims, usernameClaim string) (string, error) {
+	name := claims.String(usernameClaim)
+	if e := checkUsername(name); e != nil {
+		return "", fmt.Errorf("claim %#v is not a valid username: %w", usernameClaim, e)
+	}
+
+	b := make([]byte, 32)
+	if _, e := rand.Read(b); e != nil {
+		panic(e)
+	}
+
+	e := userStore.CreateUser(name, base64.RawURLEncoding.EncodeToString(b), user.Profile{
+		DisplayName: claims.String("name"),
+		Email:       claims.String("email"),
+		OIDCSubject: claims.Subject(),
+	})
+	if errors.Is(e, user.ErrExists) {
+		return "", fmt.Errorf("username %#v is taken by an account that isn't linked to the provider", name)
+	}
+	if e != nil {
+		return "", e
+	}
+
+	return name, nil
+}
+
+func handleOIDCCallback(secret []signingKey, log *slog.Logger, provider *oidc.Provider, userStore *user.UserStore, usernameClaim string, autoProvision bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("error") != "" {
+			sendError(log, w, http.StatusUnauthorized, fmt.Sprintf("provider: %s %s", q.Get("error"), q.Get("error_description")))
+			return
+		}
+
+		claims, e := provider.Exchange(r.Context(), q.Get("state"), q.Get("code"))
+		if e != nil {
+			sendError(log, w, http.StatusUnauthorized, fmt.Sprintf("finish login: %v", e))
+			return
+		}
+
+		name, e := oidcUser(userStore, claims, usernameClaim, autoProvision)
+		if e != nil {
+			log.Info("OpenID Connect login refused", "subject", claims.Subject(), "error", e)
+			sendError(log, w, http.StatusForbidden, e.Error())
+			return
+		}
+
+		tokens, e := issueTokens(name, secret)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sign tokens: %v", e))
+			return
+		}
+
+		sendOK(log, w, tokens)
+	})
+}
@@ -0,0 +1,473 @@
+// Package oidc logs users in through an OpenID Connect provider with the
+// authorization code flow and PKCE. Only what archiiv needs is implemented:
+// discovery, the token endpoint and ID tokens signed with RS256 or ES256 by a
+// key from the JWKS of the provider
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrState = errors.New("unknown or expired login")
+	ErrToken = errors.New("invalid ID token")
+)
+
+const (
+	// how long the user has to log in at the provider
+	loginTTL = 10 * time.Minute
+	// allowed difference between the clocks of the provider and ours
+	clockSkew = time.Minute
+)
+
+type Config struct {
+	// Issuer is the URL of the provider, the discovery document is
+	// at <Issuer>/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the user back with the code
+	RedirectURL string
+	Scopes      []string
+	// Client makes the requests to the provider, nil means
+	// http.DefaultClient
+	Client *http.Client
+}
+
+// metadata is the part of the discovery document that is used
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// login is a login that was started and not finished yet
+type login struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+type Provider struct {
+	conf Config
+
+	lock sync.Mutex
+	// nil until the discovery document is fetched
+	meta *metadata
+	// key id to the key from the JWKS
+	keys map[string]crypto.PublicKey
+	// state to the login
+	logins map[string]login
+}
+
+// New returns a provider. Nothing is fetched until the first login so the
+// server starts even when the provider is down
+func New(conf Config) *Provider {
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+	return &Provider{
+		conf:   conf,
+		keys:   map[string]crypto.PublicKey{},
+		logins: map[string]login{},
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.conf.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", u, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the discovery document, fetching it the first time
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.lock.Lock()
+	meta := p.meta
+	p.lock.Unlock()
+	if meta != nil {
+		return *meta, nil
+	}
+
+	var m metadata
+	err := p.getJSON(ctx, strings.TrimSuffix(p.conf.Issuer, "/")+"/.well-known/openid-configuration", &m)
+	if err != nil {
+		return metadata{}, fmt.Errorf("discovery: %w", err)
+	}
+
+	if m.Issuer != p.conf.Issuer {
+		return metadata{}, fmt.Errorf("discovery: issuer is %#v, expected %#v", m.Issuer, p.conf.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return metadata{}, errors.New("discovery: missing endpoints")
+	}
+
+	p.lock.Lock()
+	p.meta = &m
+	p.lock.Unlock()
+
+	return m, nil
+}
+
+// AuthCodeURL starts a login and returns the URL of the provider the user has
+// to be sent to
+func (p *Provider) AuthCodeURL(ctx context.Context) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("parse authorization endpoint: %w", err)
+	}
+
+	state := randomString()
+	l := login{
+		verifier: randomString(),
+		nonce:    randomString(),
+		expires:  time.Now().Add(loginTTL),
+	}
+	challenge := sha256.Sum256([]byte(l.verifier))
+
+	p.lock.Lock()
+	now := time.Now()
+	for s, old := range p.logins {
+		if now.After(old.expires) {
+			delete(p.logins, s)
+		}
+	}
+	p.logins[state] = l
+	p.lock.Unlock()
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.conf.ClientID)
+	q.Set("redirect_uri", p.conf.RedirectURL)
+	q.Set("scope", strings.Join(p.conf.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", l.nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Claims of a verified ID token
+type Claims map[string]any
+
+// String returns the claim if it is a string
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// Exchange finishes the login with the state and code the provider sent back
+// and returns the claims of the verified ID token. Every login can be
+// finished only once
+func (p *Provider) Exchange(ctx context.Context, state, code string) (Claims, error) {
+	p.lock.Lock()
+	l, ok := p.logins[state]
+	delete(p.logins, state)
+	p.lock.Unlock()
+
+	if !ok || time.Now().After(l.expires) {
+		return nil, ErrState
+	}
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.conf.RedirectURL},
+		"client_id":     {p.conf.ClientID},
+		"code_verifier": {l.verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.conf.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.conf.ClientID), url.QueryEscape(p.conf.ClientSecret))
+	}
+
+	res, err := p.conf.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer res.Body.Close()
+
+	var tr struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	if tr.Error != "" {
+		return nil, fmt.Errorf("token request: %s %s", tr.Error, tr.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || tr.IDToken == "" {
+		return nil, fmt.Errorf("token request: %s without an ID token", res.Status)
+	}
+
+	return p.verify(ctx, meta, tr.IDToken, l.nonce)
+}
+
+// key returns the key with the id from the JWKS. The JWKS is fetched again
+// when the key isn't known, the provider may have rotated its keys
+func (p *Provider) key(ctx context.Context, meta metadata, kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	k, ok := p.keys[kid]
+	p.lock.Unlock()
+	if ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, raw := range set.Keys {
+		id, k, err := parseJWK(raw)
+		if err != nil {
+			// keys of other types don't matter
+			continue
+		}
+		keys[id] = k
+	}
+
+	p.lock.Lock()
+	p.keys = keys
+	p.lock.Unlock()
+
+	k, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %#v", ErrToken, kid)
+	}
+	return k, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parseJWK reads an RSA or P-256 signing key
+func parseJWK(raw []byte) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, errors.New("not a signing key")
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return "", nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 || n.BitLen() < 2048 {
+			return "", nil, errors.New("unsupported RSA key")
+		}
+		return jwk.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return "", nil, errors.New("unsupported curve")
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return "", nil, errors.New("point is not on the curve")
+		}
+		return jwk.Kid, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return "", nil, errors.New("unsupported key type")
+}
+
+func checkSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 needs an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("ES256 needs a P-256 key and a 64 byte signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("signature is invalid")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %#v", alg)
+}
+
+// verify checks the signature and the claims of the ID token
+func (p *Provider) verify(ctx context.Context, meta metadata, token, nonce string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWS", ErrToken)
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode header: %v", ErrToken, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: decode header: %v", ErrToken, err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode signature: %v", ErrToken, err)
+	}
+
+	key, err := p.key(ctx, meta, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrToken, err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode payload: %v", ErrToken, err)
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("%w: decode payload: %v", ErrToken, err)
+	}
+
+	if c.String("iss") != meta.Issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrToken)
+	}
+
+	var aud []string
+	switch a := c["aud"].(type) {
+	case string:
+		aud = []string{a}
+	case []any:
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+	}
+	if !slices.Contains(aud, p.conf.ClientID) {
+		return nil, fmt.Errorf("%w: wrong audience", ErrToken)
+	}
+	if azp := c.String("azp"); len(aud) > 1 && azp != p.conf.ClientID {
+		return nil, fmt.Errorf("%w: wrong authorized party", ErrToken)
+	}
+
+	exp, ok := c["exp"].(float64)
+	if !ok || time.Now().Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: expired", ErrToken)
+	}
+	if iat, ok := c["iat"].(float64); ok && time.Unix(int64(iat), 0).After(time.Now().Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrToken)
+	}
+
+	if c.String("nonce") != nonce {
+		return nil, fmt.Errorf("%w: wrong nonce", ErrToken)
+	}
+	if c.Subject() == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrToken)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	mockClientID    = "archiiv"
+	mockRedirectURL = "http://archiiv.test/api/v1/oidc/callback"
+)
+
+// mockProvider is a minimal OpenID Connect provider. Whoever is sent to its
+// authorization endpoint is logged in with the claims of the provider
+type mockProvider struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	lock sync.Mutex
+	// claims put into the next ID tokens besides the standard ones
+	claims map[string]any
+	// audience of the next ID tokens
+	audience string
+	// code to the request that got it
+	codes map[string]url.Values
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{key: key, audience: mockClientID, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != mockClientID || q.Get("redirect_uri") != mockRedirectURL ||
+			q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			t.Error(err)
+		}
+		code := base64.RawURLEncoding.EncodeToString(b)
+		m.lock.Lock()
+		m.codes[code] = q
+		m.lock.Unlock()
+
+		http.Redirect(w, r, mockRedirectURL+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		m.lock.Lock()
+		auth, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.lock.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || auth.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) ||
+			r.FormValue("redirect_uri") != mockRedirectURL {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token":     m.idToken(t, auth.Get("nonce")),
+		})
+	})
+
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockProvider) set(audience string, claims map[string]any) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.audience = audience
+	m.claims = claims
+}
+
+func (m *mockProvider) idToken(t *testing.T, nonce string) string {
+	m.lock.Lock()
+	claims := map[string]any{
+		"iss":   m.srv.URL,
+		"aud":   m.audience,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	m.lock.Unlock()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock", "typ": "JWT"})
+	if err != nil {
+		t.Error(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcLoginHelper goes through the whole flow and returns the response of the
+// callback
+func oidcLoginHelper(t *testing.T, srv http.Handler) *http.Response {
+	res := hit(srv, http.MethodGet, "/api/v1/oidc/login", nil)
+	expectStatusCode(t, res, http.StatusFound)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	authRes, err := client.Get(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authRes.Body.Close()
+	expectStatusCode(t, authRes, http.StatusFound)
+
+	callback, err := url.Parse(authRes.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hit(srv, http.MethodGet, callback.RequestURI(), nil)
+}
+
+func newOIDCTestEnv(t *testing.T, m *mockProvider, extraArgs ...string) testEnv {
+	return newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")}, append([]string{
+		"--oidc_issuer", m.srv.URL,
+		"--oidc_client_id", mockClientID,
+		"--oidc_redirect_url", mockRedirectURL,
+	}, extraArgs...)...)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Parallel()
+	m := newMockProvider(t)
+	env := newOIDCTestEnv(t, m)
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a matching username claim is not enough to log into an account
+	m.set(mockClientID, map[string]any{"sub": "1234", "preferred_username": "marek"})
+	res := oidcLoginHelper(t, env.srv)
+	expectFail(t, res, http.StatusForbidden, "no user is linked to the account at the provider")
+
+	res = hitAuth(env.srv, http.MethodPost, "/api/v1/users/update/marek", rootToken, strings.NewReader(`{"oidc_subject":"1234"}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = oidcLoginHelper(t, env.srv)
+	expectStatusCode(t, res, http.StatusOK)
+	tokens := decodeResponse[tokensResponse](t, res).Data
+
+	res = hitAuth(env.srv, http.MethodGet, "/api/v1/whoami", tokens.Token, nil)
+	expectBody(t, res, `{"ok":true,"data":{"name":"marek"}}`+"\n")
+	res = refreshHelper(env.srv, tokens.RefreshToken)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// the subject decides, not the username claim
+	m.set(mockClientID, map[string]any{"sub": "5678", "preferred_username": "marek"})
+	res = oidcLoginHelper(t, env.srv)
+	expectFail(t, res, http.StatusForbidden, "no user is linked to the account at the provider")
+	m.set(mockClientID, map[string]any{"sub": "1234", "preferred_username": "jana"})
+	res = oidcLoginHelper(t, env.srv)
+	expectStatusCode(t, res, http.StatusOK)
+
+	m.set("someone-else", map[string]any{"sub": "1234", "preferred_username": "marek"})
+	res = oidcLoginHelper(t, env.srv)
+	expectFail(t, res, http.StatusUnauthorized, "finish login: invalid ID token: wrong audience")
+
+	// a state can't be used without starting a login
+	res = hit(env.srv, http.MethodGet, "/api/v1/oidc/callback?state=nonsense&code=nonsense", nil)
+	expectFail(t, res, http.StatusUnauthorized, "finish login: unknown or expired login")
+}
+
+func TestOIDCAutoProvision(t *testing.T) {
+	t.Parallel()
+	m := newMockProvider(t)
+	env := newOIDCTestEnv(t, m, "--oidc_auto_provision", "--oidc_username_claim", "email")
+
+	m.set(mockClientID, map[string]any{"sub": "5678", "email": "jana@example.com", "name": "Jana"})
+	res := oidcLoginHelper(t, env.srv)
+	expectStatusCode(t, res, http.StatusOK)
+	tokens := decodeResponse[tokensResponse](t, res).Data
+
+	res = hitAuth(env.srv, http.MethodGet, "/api/v1/profile", tokens.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	info := decodeResponse[userInfoResponse](t, res).Data
+	expectEqual(t, info.Name, "jana@example.com", "username")
+	expectEqual(t, info.DisplayName, "Jana", "display name")
+
+	res = oidcLoginHelper(t, env.srv)
+	expectStatusCode(t, res, http.StatusOK)
+
+	m.set(mockClientID, map[string]any{"sub": "9999", "email": "root"})
+	res = oidcLoginHelper(t, env.srv)
+	expectStatusCode(t, res, http.StatusForbidden)
+}
+
+func TestOIDCAutoProvisionKeepsLocalAccounts(t *testing.T) {
+	t.Parallel()
+	m := newMockProvider(t)
+	env := newOIDCTestEnv(t, m, "--oidc_auto_provision")
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone who named themselves marek at the provider
+	m.set(mockClientID, map[string]any{"sub": "6666", "preferred_username": "marek"})
+	res := oidcLoginHelper(t, env.srv)
+	expectFail(t, res, http.StatusForbidden, `username "marek" is taken by an account that isn't linked to the provider`)
+
+	// the password account is untouched
+	res = hitAuth(env.srv, http.MethodGet, "/api/v1/users", rootToken, nil)
+	users := decodeResponse[struct {
+		Ok   bool       `json:"ok"`
+		Data []userInfo `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(users), 1, "number of users")
+	expectEqual(t, users[0].OIDCSubject, "", "subject of marek")
+	loginHelper(t, env.srv, "marek", "heslo")
+
+	m.set(mockClientID, map[string]any{"sub": "7777", "preferred_username": "jana"})
+	res = oidcLoginHelper(t, env.srv)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// a subject can't be linked to a second user
+	res = hitAuth(env.srv, http.MethodPost, "/api/v1/users/update/marek", rootToken, strings.NewReader(`{"oidc_subject":"7777"}`))
+	expectFail(t, res, http.StatusConflict, "linkOIDC: the account at the provider is linked to another user")
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	res := hit(srv, http.MethodGet, "/api/v1/oidc/login", nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+}
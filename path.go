@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// startUUID returns the directory paths are resolved from, which is the root
+// unless the `from` query parameter says otherwise
+func startUUID(r *http.Request) (uuid.UUID, error) {
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		return uuid.Nil, nil
+	}
+	return uuid.Parse(from)
+}
+
+// setSectionFromQuery passes the `section` query parameter (default 'data') to
+// the uuid based handlers
+func setSectionFromQuery(r *http.Request) {
+	section := r.URL.Query().Get("section")
+	if section == "" {
+		section = "data"
+	}
+	r.SetPathValue("section", section)
+}
+
+// resolvePath resolves the {path...} wildcard and stores the uuid it points to
+// as the {uuid} path value so that the uuid based handler can serve the
+// request
+func resolvePath(fs *fs.Fs, log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, e := startUUID(r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		id, e := fs.Resolve(start, r.PathValue("path"))
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("resolve path: %v", e))
+			return
+		}
+
+		r.SetPathValue("uuid", id.String())
+		setSectionFromQuery(r)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code the wrapped handler sent
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// resolveOrTouchPath is like resolvePath but creates the file when only the
+// last name of the path doesn't exist. The created file is unmounted again if
+// the wrapped handler fails
+func resolveOrTouchPath(secret []signingKey, files *fs.Fs, log *slog.Logger, locks *lease.Store, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, e := startUUID(r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		id, e := files.Resolve(start, r.PathValue("path"))
+		if errors.Is(e, fs.ErrPathNotFound) {
+			dir, name, e2 := files.ResolveParent(start, r.PathValue("path"))
+			if e2 != nil {
+				sendError(log, w, http.StatusNotFound, fmt.Sprintf("resolve path: %v", e2))
+				return
+			}
+
+			username := getUsername(r, secret)
+			if e2 = checkPerm(files, dir, username, fs.PermWrite); e2 != nil {
+				sendError(log, w, http.StatusForbidden, "403 forbidden")
+				return
+			}
+
+			if !checkUnlocked(log, w, locks, username, dir) {
+				return
+			}
+
+			// If-Match never matches a file that doesn't exist yet
+			if r.Header.Get("If-Match") != "" {
+				sendPreconditionFailed(log, w)
+				return
+			}
+
+			id, e = files.Touch(dir, name)
+			if errors.Is(e, fs.ErrBadName) {
+				sendError(log, w, http.StatusBadRequest, e.Error())
+				return
+			}
+			if errors.Is(e, fs.ErrNameExists) {
+				sendError(log, w, http.StatusConflict, e.Error())
+				return
+			}
+			if e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("touch: %v", e))
+				return
+			}
+
+			e = fs.WriteFileMeta(files, id, fs.NewFileMeta(id, username))
+			if e != nil {
+				_ = files.Unmount(dir, id)
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("write meta: %v", e))
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w}
+			r.SetPathValue("uuid", id.String())
+			setSectionFromQuery(r)
+			h.ServeHTTP(rec, r)
+
+			if rec.status >= http.StatusBadRequest {
+				if e = files.Unmount(dir, id); e != nil {
+					log.Error("unmount file after failed upload", "uuid", id, "error", e)
+				}
+			}
+			return
+		} else if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("resolve path: %v", e))
+			return
+		}
+
+		r.SetPathValue("uuid", id.String())
+		setSectionFromQuery(r)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func handlePaths(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuidArg := r.PathValue("uuid")
+
+		id, e := uuid.Parse(uuidArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		if e = checkPerm(files, id, getUsername(r, secret), fs.PermRead); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		paths, e := files.Paths(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		sendOK(log, w, paths)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPathAddressing(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	photos := mkdirHelper(t, srv, token, root, "photos")
+	year := mkdirHelper(t, srv, token, photos, "2024")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/path/upload/photos/2024/trip.txt", token, strings.NewReader("výlet"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/path/cat/photos/2024/trip.txt", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectBody(t, res, "výlet")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/path/cat/2024/trip.txt?from="+photos.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectBody(t, res, "výlet")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/path/ls/photos/2024", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	trip := decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data []uuid.UUID `json:"data"`
+	}](t, res).Data[0]
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/mount/"+root.String()+"/"+trip.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/paths/"+trip.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	paths := decodeResponse[struct {
+		Ok   bool     `json:"ok"`
+		Data []string `json:"data"`
+	}](t, res).Data
+	expectEqual(t, strings.Join(paths, ","), "/photos/2024/trip.txt,/trip.txt", "paths of multiply mounted file")
+
+	// names are unique within a directory
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/touch/"+year.String()+"/trip.txt", token, nil)
+	expectStatusCode(t, res, http.StatusConflict)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/mkdir/"+year.String()+"/trip.txt", token, nil)
+	expectStatusCode(t, res, http.StatusConflict)
+	expectEqual(t, len(lsHelper(t, srv, token, year)), 1, "children after the collisions")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/path/cat/photos/2023/trip.txt", token, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+}
+
+func TestPathUploadLeavesNothingOnFailure(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/fs/path/upload/a.txt", strings.NewReader("a"))
+	req.Header.Add("Authorization", token)
+	req.Header.Add("If-Match", `"s1"`)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	expectStatusCode(t, w.Result(), http.StatusPreconditionFailed)
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/path/upload/b.txt?section=a/b", token, strings.NewReader("b"))
+	if res.StatusCode < http.StatusBadRequest {
+		t.Fatalf("upload into an invalid section succeeded with %d", res.StatusCode)
+	}
+
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 0, "children of the root")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"archiiv/fs"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var errPermissionDenied = errors.New("permission denied")
+
+// checkPerm fails unless the user has all the permission bits in perm for the
+// file. Files without metadata are accessible only to root
+func checkPerm(files *fs.Fs, id uuid.UUID, username string, perm uint8) error {
+	fm, err := fs.ReadFileMeta(files, id)
+	if err != nil {
+		fm = fs.FileMeta{}
+	}
+
+	if fm.EffectivePerms(username)&perm != perm {
+		return errPermissionDenied
+	}
+
+	return nil
+}
+
+// sectionWritePerm returns the permission needed to write the section. The
+// meta section holds the permissions so only owners may replace it
+func sectionWritePerm(section string) uint8 {
+	if section == "meta" {
+		return fs.PermWrite | fs.PermOwner
+	}
+	return fs.PermWrite
+}
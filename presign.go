@@ -0,0 +1,120 @@
+package main
+
+// POST /api/v1/fs/presign/{uuid}/{section}?method=GET|POST&ttl=1h  makes a URL
+//
+// A pre-signed URL lets whoever has it cat (GET) or upload (POST) one section
+// of one file as the user who made it, without the Authorization header, so
+// it can be put into an <img> tag or handed to another program. The perms of
+// the user are checked when the URL is made and again every time it is used.
+// Logging out of all sessions invalidates the URLs too.
+
+import (
+	"archiiv/fs"
+	"archiiv/session"
+	"archiiv/user"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPresignTTL = time.Hour
+	maxPresignTTL     = 7 * 24 * time.Hour
+)
+
+func handlePresign(secret []signingKey, files *fs.Fs, log *slog.Logger) http.Handler {
+	type OkResponse struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+		section := r.PathValue("section")
+
+		ttl := defaultPresignTTL
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			if ttl, e = time.ParseDuration(s); e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse ttl: %v", e))
+				return
+			}
+		}
+		if ttl <= 0 || ttl > maxPresignTTL {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("ttl must be positive and at most %v", maxPresignTTL))
+			return
+		}
+
+		var path string
+		var perm uint8
+		method := r.URL.Query().Get("method")
+		switch method {
+		case http.MethodGet, "":
+			method = http.MethodGet
+			path = "/api/v1/fs/cat/"
+			perm = fs.PermRead
+		case http.MethodPost:
+			path = "/api/v1/fs/upload/"
+			perm = sectionWritePerm(section)
+		default:
+			sendError(log, w, http.StatusBadRequest, "method must be GET or POST")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, perm); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		expires := time.Now().Add(ttl)
+		sig, e := signURL(username, secret, method, id, section, expires)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sign url: %v", e))
+			return
+		}
+
+		u := path + id.String() + "/" + url.PathEscape(section) + "?" + url.Values{"sig": {sig}}.Encode()
+		sendOK(log, w, OkResponse{URL: u, Expires: expires.UTC()})
+	})
+}
+
+// allowPresigned serves requests with a valid `sig` query parameter as the
+// user who signed the URL. Requests with the Authorization header or without
+// a signature go on to h as usual
+func allowPresigned(secret []signingKey, log *slog.Logger, userStore *user.UserStore, sessions *session.Store, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig := r.URL.Query().Get("sig")
+		if sig == "" || getSessionToken(r) != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+
+		p, e := verifyURL(sig, secret, method, id, r.PathValue("section"))
+		if e != nil || sessions.IsRevoked(p.Username, p.Nonce, p.Issued) ||
+			(p.Username != fs.UserRoot && !userStore.Active(p.Username)) {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		h.ServeHTTP(w, withUsername(r, p.Username))
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type presignResponse struct {
+	Ok   bool `json:"ok"`
+	Data struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	} `json:"data"`
+}
+
+func presignHelper(t *testing.T, srv http.Handler, token string, id uuid.UUID, section, query string) string {
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/presign/"+id.String()+"/"+section+"?"+query, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	return decodeResponse[presignResponse](t, res).Data.URL
+}
+
+func TestPresignedURLs(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	photo := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("babička"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	// only what the user may do can be signed
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/presign/"+photo.String()+"/data", emaToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/presign/"+photo.String()+"/data?ttl=720h", token, nil)
+	expectStatusCode(t, res, http.StatusBadRequest)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/presign/"+photo.String()+"/data?method=DELETE", token, nil)
+	expectFail(t, res, http.StatusBadRequest, "method must be GET or POST")
+
+	catURL := presignHelper(t, srv, token, photo, "data", "")
+	res = hit(srv, http.MethodGet, catURL, nil)
+	expectBody(t, res, "babička")
+
+	// the signature is bound to the method, the file and the section
+	res = hit(srv, http.MethodPost, strings.Replace(catURL, "/cat/", "/upload/", 1), strings.NewReader("x"))
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+	other := touchHelper(t, srv, token, root, "other.jpg")
+	res = hit(srv, http.MethodGet, strings.Replace(catURL, photo.String(), other.String(), 1), nil)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+	res = hit(srv, http.MethodGet, strings.Replace(catURL, "/data?", "/meta?", 1), nil)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+
+	uploadURL := presignHelper(t, srv, token, photo, "data", "method=POST&ttl=10m")
+	res = hit(srv, http.MethodPost, uploadURL, strings.NewReader("dědeček"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hit(srv, http.MethodGet, catURL, nil)
+	expectBody(t, res, "dědeček")
+
+	expired := presignHelper(t, srv, token, photo, "data", "ttl=1ns")
+	res = hit(srv, http.MethodGet, expired, nil)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+
+	// logging out everywhere takes the URLs with it
+	res = hitAuth(srv, http.MethodPost, "/api/v1/logout-all", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hit(srv, http.MethodGet, catURL, nil)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+}
+
+func TestPresignedURLChecksPermsOnUse(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	photo := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("babička"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+photo.String()+`", "user": "ema", "perms": 2}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	catURL := presignHelper(t, srv, emaToken, photo, "data", "")
+	res = hit(srv, http.MethodGet, catURL, nil)
+	expectBody(t, res, "babička")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+photo.String()+`", "user": "ema", "perms": 0}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hit(srv, http.MethodGet, catURL, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
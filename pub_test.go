@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPubAccess(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	photo := touchHelper(t, srv, token, album, "photo.jpg")
+	private := touchHelper(t, srv, token, album, "private.jpg")
+	for _, id := range []string{photo.String(), private.String()} {
+		res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+id+"/data", token, strings.NewReader("babička"))
+		expectStatusCode(t, res, http.StatusOK)
+	}
+
+	// nothing is public by default
+	res := hit(srv, http.MethodGet, "/api/v1/fs/ls/"+album.String(), nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+album.String()+`", "user": "pub", "perms": 2},
+		{"op": "set_perms", "uuid": "`+photo.String()+`", "user": "pub", "perms": 2}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	expectEqual(t, len(lsHelper(t, srv, "", album)), 2, "children seen by pub")
+	res = hit(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", nil)
+	expectBody(t, res, "babička")
+	res = hit(srv, http.MethodGet, "/api/v1/fs/path/cat/photo.jpg?from="+album.String(), nil)
+	expectBody(t, res, "babička")
+	res = hit(srv, http.MethodGet, "/api/v1/fs/cat/"+private.String()+"/data", nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hit(srv, http.MethodGet, "/api/v1/fs/stat/"+photo.String(), nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, decodeResponse[statResponse](t, res).Data.Perms, 2, "perms of pub")
+	res = hit(srv, http.MethodGet, "/api/v1/fs/stat/"+private.String(), nil)
+	expectEqual(t, decodeResponse[statResponse](t, res).Data.Meta == nil, true, "meta hidden from pub")
+
+	// writes stay locked
+	res = hit(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", strings.NewReader("x"))
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hit(srv, http.MethodPost, "/api/v1/fs/touch/"+album.String()+"/new.jpg", nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hit(srv, http.MethodPost, "/api/v1/fs/unmount/"+album.String()+"/"+photo.String(), nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	// endpoints tied to an account still need one
+	res = hit(srv, http.MethodGet, "/api/v1/trash", nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	// a bad token is an error, not a fallback to pub
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/ls/"+album.String(), "v1.nonsense", nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+}
+
+func TestPubUploadBox(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	inbox := mkdirHelper(t, srv, token, root, "inbox")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+inbox.String()+`", "user": "pub", "perms": 4}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hit(srv, http.MethodPost, "/api/v1/fs/path/upload/dopis.txt?from="+inbox.String(), strings.NewReader("ahoj"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	// pub can't see what was dropped in
+	res = hit(srv, http.MethodGet, "/api/v1/fs/ls/"+inbox.String(), nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	ch := lsHelper(t, srv, token, inbox)
+	expectEqual(t, len(ch), 1, "files in the inbox")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+ch[0].String()+"/data", token, nil)
+	expectBody(t, res, "ahoj")
+}
+
+func TestMetaSectionNeedsOwner(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	file := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/batch", token, strings.NewReader(`{"ops": [
+		{"op": "set_perms", "uuid": "`+file.String()+`", "user": "ema", "perms": 6}
+	]}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", emaToken, strings.NewReader("x"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/meta", emaToken, strings.NewReader(`{"perms": {"ema": 7}}`))
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"archiiv/apikey"
 	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/oidc"
+	"archiiv/session"
+	"archiiv/share"
+	"archiiv/snapshot"
+	"archiiv/trash"
+	"archiiv/upload"
 	"archiiv/user"
 	"log/slog"
 	"net/http"
@@ -10,21 +18,102 @@ import (
 func addRoutes(
 	mux *http.ServeMux,
 	log *slog.Logger,
-	secret string,
-	userStore user.UserStore,
+	secret []signingKey,
+	userStore *user.UserStore,
 	fileStore *fs.Fs,
+	uploads *upload.Store,
+	jobs *jobStore,
+	bin *trash.Trash,
+	snaps *snapshot.Store,
+	locks *lease.Store,
+	sessions *session.Store,
+	shares *share.Store,
+	keys *apikey.Store,
+	provider *oidc.Provider,
+	oidcUsernameClaim string,
+	oidcAutoProvision bool,
+	tmpDir string,
+	expandLimit int64,
 ) {
 	mux.Handle("POST /api/v1/login", handleLogin(secret, log, userStore))
-	//mux.Handle("POST /api/v1/refresh-token", handleSessionTokenRefresh(secret, log, userStore))
+	if provider != nil {
+		mux.Handle("GET /api/v1/oidc/login", handleOIDCLogin(log, provider))
+		mux.Handle("GET /api/v1/oidc/callback", handleOIDCCallback(secret, log, provider, userStore, oidcUsernameClaim, oidcAutoProvision))
+	}
+	mux.Handle("POST /api/v1/refresh-token", handleSessionTokenRefresh(secret, log, userStore, sessions))
+	mux.Handle("POST /api/v1/logout", requireLogin(secret, log, handleLogout(secret, log, userStore, sessions)))
+	mux.Handle("POST /api/v1/logout-all", requireLogin(secret, log, handleLogoutAll(secret, log, sessions)))
 	mux.Handle("GET /api/v1/whoami", requireLogin(secret, log, handleWhoami(secret, log)))
+	mux.Handle("GET /api/v1/profile", requireLogin(secret, log, handleProfile(secret, log, userStore)))
+	mux.Handle("POST /api/v1/profile", requireLogin(secret, log, handleProfileUpdate(secret, log, userStore)))
+	mux.Handle("POST /api/v1/passwd", requireLogin(secret, log, handlePasswordChange(secret, log, userStore, sessions)))
 
-	mux.Handle("GET /api/v1/fs/ls/{uuid}", requireLogin(secret, log, handleLs(fileStore, log)))
-	mux.Handle("GET /api/v1/fs/cat/{uuid}/{section}", requireLogin(secret, log, handleCat(fileStore, log)))
-	mux.Handle("POST /api/v1/fs/upload/{uuid}/{section}", requireLogin(secret, log, handleUpload(log, fileStore)))
-	mux.Handle("POST /api/v1/fs/touch/{uuid}/{name}", requireLogin(secret, log, handleTouch(fileStore, log)))
-	mux.Handle("POST /api/v1/fs/mkdir/{uuid}/{name}", requireLogin(secret, log, handleMkdir(fileStore, log)))
-	mux.Handle("POST /api/v1/fs/mount/{parentUUID}/{childUUID}", requireLogin(secret, log, handleMount(fileStore, log)))
-	mux.Handle("POST /api/v1/fs/unmount/{parentUUID}/{childUUID}", requireLogin(secret, log, handleUnmount(fileStore, log)))
+	mux.Handle("GET /api/v1/keys", requireLogin(secret, log, rejectAPIKeys(log, handleAPIKeyList(secret, log, keys))))
+	mux.Handle("POST /api/v1/keys/create", requireLogin(secret, log, rejectAPIKeys(log, handleAPIKeyCreate(secret, fileStore, log, keys))))
+	mux.Handle("POST /api/v1/keys/revoke/{id}", requireLogin(secret, log, rejectAPIKeys(log, handleAPIKeyRevoke(secret, log, keys))))
+
+	mux.Handle("GET /api/v1/users", requireRoot(secret, log, handleUserList(log, userStore)))
+	mux.Handle("POST /api/v1/users/create", requireRoot(secret, log, handleUserCreate(log, userStore)))
+	mux.Handle("POST /api/v1/users/delete/{name}", requireRoot(secret, log, handleUserDelete(log, userStore, sessions, keys)))
+	mux.Handle("POST /api/v1/users/passwd/{name}", requireRoot(secret, log, handleUserPasswd(log, userStore, sessions)))
+	mux.Handle("POST /api/v1/users/update/{name}", requireRoot(secret, log, handleUserUpdate(log, userStore, sessions)))
+
+	mux.Handle("GET /api/v1/fs/ls/{uuid}", allowPub(secret, log, handleLs(secret, fileStore, log)))
+	mux.Handle("GET /api/v1/fs/list/{uuid}", allowPub(secret, log, handleList(secret, fileStore, log)))
+	mux.Handle("GET /api/v1/fs/stat/{uuid}", allowPub(secret, log, handleStat(secret, fileStore, log, locks)))
+	mux.Handle("GET /api/v1/fs/cat/{uuid}/{section}", allowPresigned(secret, log, userStore, sessions, allowPub(secret, log, handleCat(secret, fileStore, log))))
+	mux.Handle("POST /api/v1/fs/upload/{uuid}/{section}", allowPresigned(secret, log, userStore, sessions, allowPub(secret, log, handleUpload(secret, log, fileStore, locks))))
+	mux.Handle("POST /api/v1/fs/presign/{uuid}/{section}", requireLogin(secret, log, handlePresign(secret, fileStore, log)))
+	mux.Handle("POST /api/v1/fs/touch/{uuid}/{name}", allowPub(secret, log, handleTouch(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/fs/mkdir/{uuid}/{name}", allowPub(secret, log, handleMkdir(secret, fileStore, log, locks)))
+	mux.Handle("GET /api/v1/fs/path/ls/{path...}", allowPub(secret, log, resolvePath(fileStore, log, handleLs(secret, fileStore, log))))
+	mux.Handle("GET /api/v1/fs/path/cat/{path...}", allowPub(secret, log, resolvePath(fileStore, log, handleCat(secret, fileStore, log))))
+	mux.Handle("POST /api/v1/fs/path/upload/{path...}", allowPub(secret, log, resolveOrTouchPath(secret, fileStore, log, locks, handleUpload(secret, log, fileStore, locks))))
+	mux.Handle("GET /api/v1/fs/paths/{uuid}", allowPub(secret, log, handlePaths(secret, fileStore, log)))
+	mux.Handle("POST /api/v1/fs/mount/{parentUUID}/{childUUID}", allowPub(secret, log, handleMount(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/fs/unmount/{parentUUID}/{childUUID}", allowPub(secret, log, handleUnmount(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/fs/delete/{parentUUID}/{childUUID}", requireLogin(secret, log, handleDelete(secret, fileStore, log, bin, locks)))
+	mux.Handle("POST /api/v1/fs/rename/{uuid}/{name}", allowPub(secret, log, handleRename(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/fs/move/{fromUUID}/{uuid}/{toUUID}", allowPub(secret, log, handleMove(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/fs/copy/{uuid}/{parentUUID}", requireLogin(secret, log, handleCopy(secret, fileStore, log, jobs, locks)))
+	mux.Handle("GET /api/v1/fs/download/{uuid}", allowPub(secret, log, handleDownload(secret, fileStore, log)))
+	mux.Handle("POST /api/v1/fs/batch", requireLogin(secret, log, handleBatch(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/fs/expand/{uuid}", requireLogin(secret, log, handleExpand(secret, fileStore, log, tmpDir, expandLimit, locks)))
+	mux.Handle("GET /api/v1/fs/export/{uuid}", requireLogin(secret, log, handleExport(secret, fileStore, log)))
+	mux.Handle("POST /api/v1/fs/import/{parentUUID}", requireLogin(secret, log, handleImport(secret, fileStore, log, userStore, locks)))
+
+	mux.Handle("GET /api/v1/trash", requireLogin(secret, log, handleTrashList(secret, log, bin)))
+	mux.Handle("POST /api/v1/trash/restore/{uuid}", requireLogin(secret, log, handleTrashRestore(secret, fileStore, log, bin, locks)))
+	mux.Handle("POST /api/v1/trash/purge/{uuid}", requireLogin(secret, log, handleTrashPurge(secret, log, bin)))
+
+	mux.Handle("GET /api/v1/snapshots", requireLogin(secret, log, handleSnapshotList(log, snaps)))
+	mux.Handle("POST /api/v1/snapshots/create", requireRoot(secret, log, handleSnapshotCreate(log, snaps)))
+	mux.Handle("POST /api/v1/snapshots/delete/{snapshot}", requireRoot(secret, log, handleSnapshotDelete(log, snaps)))
+	mux.Handle("GET /api/v1/snapshots/{snapshot}/fs/ls/{uuid}", allowPub(secret, log, inSnapshot(log, snaps, func(files *fs.Fs) http.Handler { return handleLs(secret, files, log) })))
+	mux.Handle("GET /api/v1/snapshots/{snapshot}/fs/stat/{uuid}", allowPub(secret, log, inSnapshot(log, snaps, func(files *fs.Fs) http.Handler { return handleStat(secret, files, log, nil) })))
+	mux.Handle("GET /api/v1/snapshots/{snapshot}/fs/cat/{uuid}/{section}", allowPub(secret, log, inSnapshot(log, snaps, func(files *fs.Fs) http.Handler { return handleCat(secret, files, log) })))
+	mux.Handle("POST /api/v1/snapshots/{snapshot}/restore/{uuid}/{parentUUID}", requireLogin(secret, log, handleSnapshotRestore(secret, fileStore, log, snaps, jobs, locks)))
+
+	mux.Handle("GET /api/v1/shares", requireLogin(secret, log, handleShareList(secret, log, shares)))
+	mux.Handle("POST /api/v1/shares/create/{uuid}", requireLogin(secret, log, handleShareCreate(secret, fileStore, log, shares, userStore)))
+	mux.Handle("GET /api/v1/shares/file/{uuid}", requireLogin(secret, log, handleShareFileList(secret, fileStore, log, shares)))
+	mux.Handle("POST /api/v1/shares/revoke/{token}", requireLogin(secret, log, handleShareRevoke(secret, fileStore, log, shares)))
+	mux.Handle("GET /api/v1/s/{token}", handleShareInfo(fileStore, log, shares))
+	mux.Handle("GET /api/v1/s/{token}/ls/{uuid}", handleShareLs(fileStore, log, shares))
+	mux.Handle("GET /api/v1/s/{token}/cat/{uuid}/{section}", handleShareCat(fileStore, log, shares))
+	mux.Handle("POST /api/v1/s/{token}/upload/{name}", handleShareUpload(fileStore, log, shares, locks))
+
+	mux.Handle("POST /api/v1/locks/{uuid}", requireLogin(secret, log, handleLockAcquire(secret, fileStore, log, locks)))
+	mux.Handle("POST /api/v1/locks/renew/{id}", requireLogin(secret, log, handleLockRenew(secret, log, locks)))
+	mux.Handle("POST /api/v1/locks/release/{id}", requireLogin(secret, log, handleLockRelease(secret, fileStore, log, locks)))
+
+	mux.Handle("GET /api/v1/jobs/{id}", requireLogin(secret, log, handleJob(secret, log, jobs)))
+
+	mux.Handle("OPTIONS /api/v1/fs/tus/{uuid}/{section}", handleTusOptions(uploads))
+	mux.Handle("POST /api/v1/fs/tus/{uuid}/{section}", requireTus(log, requireLogin(secret, log, handleTusCreate(secret, log, fileStore, uploads, locks))))
+	mux.Handle("HEAD /api/v1/tus/{id}", requireTus(log, requireLogin(secret, log, handleTusHead(secret, log, uploads))))
+	mux.Handle("PATCH /api/v1/tus/{id}", requireTus(log, requireLogin(secret, log, handleTusPatch(secret, log, fileStore, uploads, locks))))
+	mux.Handle("DELETE /api/v1/tus/{id}", requireTus(log, requireLogin(secret, log, handleTusDelete(secret, log, uploads))))
 
 	mux.Handle("/", http.NotFoundHandler())
 }
@@ -0,0 +1,104 @@
+// Package session keeps track of revoked tokens. Tokens are stateless so
+// logging out is done by remembering the nonce of the token until the token
+// would expire anyway. Logging out of all sessions remembers the time before
+// which all tokens of the user are invalid
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type state struct {
+	// nonce of a revoked token to the time the token expires
+	Revoked map[int64]time.Time `json:"revoked"`
+	// username to the time before which all their tokens are revoked
+	NotBefore map[string]time.Time `json:"not_before"`
+}
+
+type Store struct {
+	lock  sync.Mutex
+	state state
+	path  string
+}
+
+// Load reads the sessions file. A missing file means that no token was
+// revoked yet
+func Load(path string) (*Store, error) {
+	s := &Store{
+		state: state{Revoked: map[int64]time.Time{}, NotBefore: map[string]time.Time{}},
+		path:  path,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, fmt.Errorf("decode sessions file: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// has to be called with s.lock held
+func (s *Store) syncToDisk() error {
+	// tokens that expired can't be used anyway
+	now := time.Now()
+	for nonce, expires := range s.state.Revoked {
+		if now.After(expires) {
+			delete(s.state.Revoked, nonce)
+		}
+	}
+
+	b, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// Revoke invalidates the token with the nonce. expires is when the token
+// would stop being valid on its own
+func (s *Store) Revoke(nonce int64, expires time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.Revoked[nonce] = expires.UTC()
+	return s.syncToDisk()
+}
+
+// RevokeAll invalidates all tokens of the user issued until now
+func (s *Store) RevokeAll(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.NotBefore[username] = time.Now().UTC()
+	return s.syncToDisk()
+}
+
+// IsRevoked reports whether the token of the user with the nonce, issued at
+// the time, was revoked
+func (s *Store) IsRevoked(username string, nonce int64, issued time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.state.Revoked[nonce]; ok {
+		return true
+	}
+
+	nb, ok := s.state.NotBefore[username]
+	return ok && !issued.After(nb)
+}
@@ -0,0 +1,226 @@
+// Package share keeps capability links to files. Whoever knows the token of a
+// share can use the file (or the tree under a directory) without an account,
+// either for reading or, for directories, only for dropping in new files
+package share
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound  = errors.New("share not found")
+	ErrExpired   = errors.New("the share expired")
+	ErrExhausted = errors.New("the share was downloaded too many times")
+)
+
+type Mode string
+
+const (
+	// Read lets the holder list and download
+	Read Mode = "read"
+	// Upload lets the holder only add files to a directory
+	Upload Mode = "upload"
+)
+
+type Share struct {
+	Token     string    `json:"token"`
+	File      uuid.UUID `json:"file"`
+	Mode      Mode      `json:"mode"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	// zero means that the share never expires
+	Expires time.Time `json:"expires"`
+	// hash of the password, empty for shares without one
+	Password     string `json:"password,omitempty"`
+	Downloads    int    `json:"downloads"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+// Live reports whether the share can still be used at the time
+func (s Share) Live(now time.Time) error {
+	if !s.Expires.IsZero() && now.After(s.Expires) {
+		return ErrExpired
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return ErrExhausted
+	}
+	return nil
+}
+
+type Store struct {
+	lock sync.Mutex
+	// token to the share
+	shares map[string]Share
+	path   string
+}
+
+// Load reads the shares file. A missing file means no shares
+func Load(path string) (*Store, error) {
+	s := &Store{
+		shares: map[string]Share{},
+		path:   path,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.shares); err != nil {
+			return nil, fmt.Errorf("decode shares file: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// has to be called with s.lock held
+func (s *Store) syncToDisk() error {
+	b, err := json.Marshal(s.shares)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func newToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Create adds the share and returns it with a new token
+func (s *Store) Create(sh Share) (Share, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sh.Token = newToken()
+	sh.Created = time.Now().UTC()
+	sh.Downloads = 0
+	s.shares[sh.Token] = sh
+
+	if err := s.syncToDisk(); err != nil {
+		delete(s.shares, sh.Token)
+		return Share{}, err
+	}
+
+	return sh, nil
+}
+
+// Get returns the share whether it is live or not
+func (s *Store) Get(token string) (Share, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sh, ok := s.shares[token]
+	if !ok {
+		return Share{}, ErrNotFound
+	}
+	return sh, nil
+}
+
+// List returns the shares matching the filter, the newest first
+func (s *Store) List(filter func(Share) bool) []Share {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	shares := []Share{}
+	for _, sh := range s.shares {
+		if filter(sh) {
+			shares = append(shares, sh)
+		}
+	}
+
+	slices.SortFunc(shares, func(a, b Share) int { return b.Created.Compare(a.Created) })
+	return shares
+}
+
+// CountDownload records one download of the share unless it can't be used
+// anymore
+func (s *Store) CountDownload(token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sh, ok := s.shares[token]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := sh.Live(time.Now()); err != nil {
+		return err
+	}
+
+	sh.Downloads++
+	s.shares[token] = sh
+
+	if err := s.syncToDisk(); err != nil {
+		sh.Downloads--
+		s.shares[token] = sh
+		return err
+	}
+
+	return nil
+}
+
+// RefundDownload takes back a download counted by CountDownload that didn't
+// get the whole file after all
+func (s *Store) RefundDownload(token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sh, ok := s.shares[token]
+	if !ok {
+		return ErrNotFound
+	}
+	if sh.Downloads == 0 {
+		return nil
+	}
+
+	sh.Downloads--
+	s.shares[token] = sh
+
+	if err := s.syncToDisk(); err != nil {
+		sh.Downloads++
+		s.shares[token] = sh
+		return err
+	}
+
+	return nil
+}
+
+// Revoke deletes the share
+func (s *Store) Revoke(token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sh, ok := s.shares[token]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.shares, token)
+
+	if err := s.syncToDisk(); err != nil {
+		s.shares[token] = sh
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/share"
+	"archiiv/user"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// shareInfo is a share as its owners see it
+type shareInfo struct {
+	Token        string     `json:"token"`
+	File         uuid.UUID  `json:"file"`
+	Mode         share.Mode `json:"mode"`
+	CreatedBy    string     `json:"created_by"`
+	Created      time.Time  `json:"created"`
+	Expires      time.Time  `json:"expires"`
+	HasPassword  bool       `json:"has_password"`
+	Downloads    int        `json:"downloads"`
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+func newShareInfo(sh share.Share) shareInfo {
+	return shareInfo{
+		Token:        sh.Token,
+		File:         sh.File,
+		Mode:         sh.Mode,
+		CreatedBy:    sh.CreatedBy,
+		Created:      sh.Created,
+		Expires:      sh.Expires,
+		HasPassword:  sh.Password != "",
+		Downloads:    sh.Downloads,
+		MaxDownloads: sh.MaxDownloads,
+	}
+}
+
+func newShareInfos(shares []share.Share) []shareInfo {
+	infos := make([]shareInfo, 0, len(shares))
+	for _, sh := range shares {
+		infos = append(infos, newShareInfo(sh))
+	}
+	return infos
+}
+
+func sendShareError(log *slog.Logger, w http.ResponseWriter, e error) {
+	switch {
+	case errors.Is(e, share.ErrNotFound):
+		sendError(log, w, http.StatusNotFound, e.Error())
+	case errors.Is(e, share.ErrExpired), errors.Is(e, share.ErrExhausted):
+		sendError(log, w, http.StatusGone, e.Error())
+	default:
+		sendError(log, w, http.StatusInternalServerError, e.Error())
+	}
+}
+
+// handleShareCreate creates a share of a file the user owns. Upload-only
+// shares are possible only for directories
+func handleShareCreate(secret []signingKey, files *fs.Fs, log *slog.Logger, shares *share.Store, users *user.UserStore) http.Handler {
+	type Request struct {
+		Mode         share.Mode `json:"mode"`
+		Expires      time.Time  `json:"expires"`
+		Password     string     `json:"password"`
+		MaxDownloads int        `json:"max_downloads"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		if req.Mode == "" {
+			req.Mode = share.Read
+		}
+		if req.Mode != share.Read && req.Mode != share.Upload {
+			sendError(log, w, http.StatusBadRequest, "mode must be read or upload")
+			return
+		}
+		if req.MaxDownloads < 0 {
+			sendError(log, w, http.StatusBadRequest, "max_downloads can't be negative")
+			return
+		}
+		if !req.Expires.IsZero() && req.Expires.Before(time.Now()) {
+			sendError(log, w, http.StatusBadRequest, "expires is in the past")
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, fs.PermOwner); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		entry, e := files.GetEntry(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+		if req.Mode == share.Upload && !entry.IsDir {
+			sendError(log, w, http.StatusBadRequest, "only directories can be shared for upload")
+			return
+		}
+
+		sh := share.Share{
+			File:         id,
+			Mode:         req.Mode,
+			CreatedBy:    username,
+			Expires:      req.Expires.UTC(),
+			MaxDownloads: req.MaxDownloads,
+		}
+
+		if req.Password != "" {
+			if sh.Password, e = users.HashPassword(req.Password); e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("hash password: %v", e))
+				return
+			}
+		}
+
+		sh, e = shares.Create(sh)
+		if e != nil {
+			sendShareError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, newShareInfo(sh))
+	})
+}
+
+// handleShareList lists the shares the user created
+func handleShareList(secret []signingKey, log *slog.Logger, shares *share.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := getUsername(r, secret)
+		sendOK(log, w, newShareInfos(shares.List(func(sh share.Share) bool { return sh.CreatedBy == username })))
+	})
+}
+
+// handleShareFileList lists all shares of a file to its owners
+func handleShareFileList(secret []signingKey, files *fs.Fs, log *slog.Logger, shares *share.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		if e = checkPerm(files, id, getUsername(r, secret), fs.PermOwner); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		sendOK(log, w, newShareInfos(shares.List(func(sh share.Share) bool { return sh.File == id })))
+	})
+}
+
+// handleShareRevoke deletes a share. Its creator and the owners of the file
+// may do that
+func handleShareRevoke(secret []signingKey, files *fs.Fs, log *slog.Logger, shares *share.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.PathValue("token")
+
+		sh, e := shares.Get(token)
+		if e != nil {
+			sendShareError(log, w, e)
+			return
+		}
+
+		username := getUsername(r, secret)
+		if sh.CreatedBy != username && checkPerm(files, sh.File, username, fs.PermOwner) != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if e = shares.Revoke(token); e != nil {
+			sendShareError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// openShare returns the live share of the {token} if the request carries its
+// password in the X-Share-Password header. A share stops working when its
+// creator isn't an owner of the file anymore
+func openShare(log *slog.Logger, w http.ResponseWriter, r *http.Request, files *fs.Fs, shares *share.Store, mode share.Mode) (share.Share, bool) {
+	sh, e := shares.Get(r.PathValue("token"))
+	if e == nil {
+		e = sh.Live(time.Now())
+	}
+	if e != nil {
+		sendShareError(log, w, e)
+		return share.Share{}, false
+	}
+
+	if sh.Password != "" && !user.CheckPasswordHash(sh.Password, r.Header.Get("X-Share-Password")) {
+		sendError(log, w, http.StatusUnauthorized, "wrong share password")
+		return share.Share{}, false
+	}
+
+	if checkPerm(files, sh.File, sh.CreatedBy, fs.PermOwner) != nil {
+		sendShareError(log, w, share.ErrNotFound)
+		return share.Share{}, false
+	}
+
+	if mode != "" && sh.Mode != mode {
+		sendError(log, w, http.StatusForbidden, fmt.Sprintf("the share is not for %s", mode))
+		return share.Share{}, false
+	}
+
+	return sh, true
+}
+
+// inTree reports whether the record is the root or somewhere below it
+func inTree(files *fs.Fs, root, id uuid.UUID) bool {
+	seen := map[uuid.UUID]bool{}
+	queue := []uuid.UUID{id}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if cur == root {
+			return true
+		}
+		if seen[cur] {
+			continue
+		}
+		seen[cur] = true
+
+		parents, err := files.Parents(cur)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, parents...)
+	}
+
+	return false
+}
+
+// sharedRecord parses the {uuid} and checks that it belongs to the share.
+// The share gives no more than its creator may read
+func sharedRecord(log *slog.Logger, w http.ResponseWriter, r *http.Request, files *fs.Fs, sh share.Share) (uuid.UUID, bool) {
+	id, e := uuid.Parse(r.PathValue("uuid"))
+	if e != nil {
+		sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+		return uuid.Nil, false
+	}
+
+	if !inTree(files, sh.File, id) || checkPerm(files, id, sh.CreatedBy, fs.PermRead) != nil {
+		sendError(log, w, http.StatusForbidden, "403 forbidden")
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// handleShareInfo describes the shared file. Shares that can't read get only
+// its name and type
+func handleShareInfo(files *fs.Fs, log *slog.Logger, shares *share.Store) http.Handler {
+	type Response struct {
+		Mode    share.Mode `json:"mode"`
+		Expires time.Time  `json:"expires"`
+		Name    string     `json:"name"`
+		Type    string     `json:"type"`
+		File    *fs.Stat   `json:"file,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh, ok := openShare(log, w, r, files, shares, "")
+		if !ok {
+			return
+		}
+
+		st, e := files.Stat(sh.File)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		res := Response{Mode: sh.Mode, Expires: sh.Expires, Name: st.Name}
+		if fm, e := fs.ReadFileMeta(files, sh.File); e == nil {
+			res.Type = fm.Type
+		}
+		if sh.Mode == share.Read {
+			res.File = &st
+		}
+
+		sendOK(log, w, res)
+	})
+}
+
+func handleShareLs(files *fs.Fs, log *slog.Logger, shares *share.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh, ok := openShare(log, w, r, files, shares, share.Read)
+		if !ok {
+			return
+		}
+
+		id, ok := sharedRecord(log, w, r, files, sh)
+		if !ok {
+			return
+		}
+
+		entries, e := files.GetEntries(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		readable := make([]fs.Entry, 0, len(entries))
+		for _, en := range entries {
+			if checkPerm(files, en.UUID, sh.CreatedBy, fs.PermRead) == nil {
+				readable = append(readable, en)
+			}
+		}
+
+		sendOK(log, w, readable)
+	})
+}
+
+// rangesCover reports whether the ranges of the Range header cover the whole
+// section of the size. The header is parsed the way http.ServeContent parses
+// it, an invalid header covers nothing
+func rangesCover(header string, size int64) bool {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false
+	}
+
+	type span struct{ start, end int64 }
+	var spans []span
+	for _, ra := range strings.Split(spec, ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(ra, "-")
+		if !ok {
+			return false
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+
+		var sp span
+		if first == "" {
+			// the last n bytes
+			if last == "" || last[0] == '-' {
+				return false
+			}
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			sp = span{start: max(size-n, 0), end: size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return false
+			}
+			if start >= size {
+				// doesn't overlap the content, ServeContent skips it
+				continue
+			}
+			sp = span{start: start, end: size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || start > end {
+					return false
+				}
+				sp.end = min(end+1, size)
+			}
+		}
+		spans = append(spans, sp)
+	}
+
+	slices.SortFunc(spans, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+
+	var covered int64
+	for _, sp := range spans {
+		if sp.start > covered {
+			return false
+		}
+		covered = max(covered, sp.end)
+	}
+	return covered >= size
+}
+
+// handleShareCat serves a section of a shared file. Every GET that sends the
+// whole data section counts as a download, also when it is split into ranges.
+// Probes and resumed downloads don't count
+func handleShareCat(files *fs.Fs, log *slog.Logger, shares *share.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh, ok := openShare(log, w, r, files, shares, share.Read)
+		if !ok {
+			return
+		}
+
+		id, ok := sharedRecord(log, w, r, files, sh)
+		if !ok {
+			return
+		}
+
+		section := r.PathValue("section")
+		if section == "meta" {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		f, e := files.OpenSection(id, section)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("open section: %v", e))
+			return
+		}
+		defer f.Close()
+
+		if section != "data" || r.Method != http.MethodGet {
+			serveSection(log, w, r, files, id, section, f)
+			return
+		}
+
+		fi, e := f.Stat()
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("stat section: %v", e))
+			return
+		}
+
+		// the download is counted up front so that the limit holds for
+		// concurrent downloads, and taken back if the whole section wasn't
+		// sent after all
+		if e = shares.CountDownload(sh.Token); e != nil {
+			sendShareError(log, w, e)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		serveSection(log, rec, r, files, id, section, f)
+
+		full := rec.status == http.StatusOK ||
+			rec.status == http.StatusPartialContent && rangesCover(r.Header.Get("Range"), fi.Size())
+		if !full {
+			if e = shares.RefundDownload(sh.Token); e != nil {
+				log.Error("refund share download", "error", e)
+			}
+		}
+	})
+}
+
+// handleShareUpload adds a file to a directory shared for upload. The file
+// is owned by the creator of the share
+func handleShareUpload(files *fs.Fs, log *slog.Logger, shares *share.Store, locks *lease.Store) http.Handler {
+	type OkResponse struct {
+		NewFileUUID uuid.UUID `json:"new_file_uuid"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh, ok := openShare(log, w, r, files, shares, share.Upload)
+		if !ok {
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, sh.CreatedBy, sh.File) {
+			return
+		}
+
+		id, e := files.Touch(sh.File, r.PathValue("name"))
+		if errors.Is(e, fs.ErrBadName) {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if errors.Is(e, fs.ErrNameExists) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("touch: %v", e))
+			return
+		}
+
+		// a failed upload leaves nothing behind
+		ok = false
+		defer func() {
+			if !ok {
+				_ = files.Unmount(sh.File, id)
+			}
+		}()
+
+		if e = fs.WriteFileMeta(files, id, fs.NewFileMeta(id, sh.CreatedBy)); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("write meta: %v", e))
+			return
+		}
+
+		sw, e := files.CreateSection(id, "data")
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("create section: %v", e))
+			return
+		}
+		defer sw.Abort()
+
+		if _, e = io.Copy(sw, r.Body); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("io copy: %v", e))
+			return
+		}
+		if e = sw.Close(); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("close section: %v", e))
+			return
+		}
+
+		ok = true
+		sendOK(log, w, OkResponse{NewFileUUID: id})
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archiiv/fs"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type shareResponse struct {
+	Ok   bool      `json:"ok"`
+	Data shareInfo `json:"data"`
+}
+
+type shareListResponse struct {
+	Ok   bool        `json:"ok"`
+	Data []shareInfo `json:"data"`
+}
+
+func createShareHelper(t *testing.T, srv http.Handler, token string, id uuid.UUID, body string) shareInfo {
+	res := hitAuth(srv, http.MethodPost, "/api/v1/shares/create/"+id.String(), token, strings.NewReader(body))
+	expectStatusCode(t, res, http.StatusOK)
+	return decodeResponse[shareResponse](t, res).Data
+}
+
+func hitShare(srv http.Handler, method, target, password string, body io.Reader) *http.Response {
+	req := httptest.NewRequest(method, target, body)
+	if password != "" {
+		req.Header.Set("X-Share-Password", password)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestReadShare(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	emaToken := loginHelper(t, srv, "ema", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	trip := mkdirHelper(t, srv, token, album, "trip")
+	photo := touchHelper(t, srv, token, trip, "photo.jpg")
+	other := touchHelper(t, srv, token, root, "other.jpg")
+	for _, id := range []uuid.UUID{photo, other} {
+		res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+id.String()+"/data", token, strings.NewReader("babička"))
+		expectStatusCode(t, res, http.StatusOK)
+	}
+
+	// only owners share
+	res := hitAuth(srv, http.MethodPost, "/api/v1/shares/create/"+album.String(), emaToken, strings.NewReader(`{}`))
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	sh := createShareHelper(t, srv, token, album, `{"mode":"read","max_downloads":2}`)
+	expectEqual(t, len(sh.Token) > 20, true, "token length")
+	expectEqual(t, sh.HasPassword, false, "has password")
+
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/ls/"+trip.String(), nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+photo.String()+"/data", nil)
+	expectBody(t, res, "babička")
+
+	// the share covers only the tree under the shared directory
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+other.String()+"/data", nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+photo.String()+"/meta", nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hit(srv, http.MethodPost, "/api/v1/s/"+sh.Token+"/upload/new.jpg", strings.NewReader("x"))
+	expectFail(t, res, http.StatusForbidden, "the share is not for upload")
+
+	// probes and resumed downloads are free
+	res = hit(srv, http.MethodHead, "/api/v1/s/"+sh.Token+"/cat/"+photo.String()+"/data", nil)
+	expectStatusCode(t, res, http.StatusOK)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+photo.String()+"/data", nil)
+	req.Header.Set("Range", "bytes=3-")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	expectBody(t, w.Result(), "ička")
+
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+photo.String()+"/data", nil)
+	expectBody(t, res, "babička")
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+photo.String()+"/data", nil)
+	expectFail(t, res, http.StatusGone, "the share was downloaded too many times")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/shares", token, nil)
+	shares := decodeResponse[shareListResponse](t, res).Data
+	expectEqual(t, len(shares), 1, "listed shares")
+	expectEqual(t, shares[0].Downloads, 2, "downloads")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/shares", emaToken, nil)
+	expectEqual(t, len(decodeResponse[shareListResponse](t, res).Data), 0, "shares of ema")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/shares/file/"+album.String(), emaToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/shares/file/"+album.String(), token, nil)
+	expectEqual(t, len(decodeResponse[shareListResponse](t, res).Data), 1, "shares of the album")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/shares/revoke/"+sh.Token, emaToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/shares/revoke/"+sh.Token, token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token, nil)
+	expectFail(t, res, http.StatusNotFound, "share not found")
+}
+
+func TestShareExpiryAndPassword(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	photo := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("babička"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/shares/create/"+photo.String(), token, strings.NewReader(`{"expires":"2001-01-01T00:00:00Z"}`))
+	expectFail(t, res, http.StatusBadRequest, "expires is in the past")
+	res = hitAuth(srv, http.MethodPost, "/api/v1/shares/create/"+photo.String(), token, strings.NewReader(`{"mode":"upload"}`))
+	expectFail(t, res, http.StatusBadRequest, "only directories can be shared for upload")
+
+	sh := createShareHelper(t, srv, token, photo, `{"password":"tajné","expires":"2999-01-01T00:00:00Z"}`)
+	expectEqual(t, sh.HasPassword, true, "has password")
+
+	target := "/api/v1/s/" + sh.Token + "/cat/" + photo.String() + "/data"
+	res = hitShare(srv, http.MethodGet, target, "", nil)
+	expectFail(t, res, http.StatusUnauthorized, "wrong share password")
+	res = hitShare(srv, http.MethodGet, target, "špatné", nil)
+	expectFail(t, res, http.StatusUnauthorized, "wrong share password")
+	res = hitShare(srv, http.MethodGet, target, "tajné", nil)
+	expectBody(t, res, "babička")
+
+	// the hash never leaves the server
+	res = hitAuth(srv, http.MethodGet, "/api/v1/shares", token, nil)
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "argon2") {
+		t.Errorf("share list leaks the password hash: %s", b)
+	}
+}
+
+func TestUploadShare(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	inbox := mkdirHelper(t, srv, token, root, "inbox")
+	sh := createShareHelper(t, srv, token, inbox, `{"mode":"upload"}`)
+
+	res := hit(srv, http.MethodPost, "/api/v1/s/"+sh.Token+"/upload/dopis.txt", strings.NewReader("ahoj"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	// the holder can't look inside
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/ls/"+inbox.String(), nil)
+	expectFail(t, res, http.StatusForbidden, "the share is not for read")
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	info := decodeResponse[struct {
+		Ok   bool           `json:"ok"`
+		Data map[string]any `json:"data"`
+	}](t, res).Data
+	expectEqual(t, info["name"], any("inbox"), "name of the shared directory")
+	if _, ok := info["file"]; ok {
+		t.Fatalf("upload share describes the directory: %v", info)
+	}
+
+	ch := lsHelper(t, srv, token, inbox)
+	expectEqual(t, len(ch), 1, "files in the inbox")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+ch[0].String()+"/data", token, nil)
+	expectBody(t, res, "ahoj")
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+ch[0].String(), token, nil)
+	expectEqual(t, decodeResponse[statResponse](t, res).Data.Perms, 7, "perms of the share creator")
+}
+
+func TestShareHidesUnreadable(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	srv := env.srv
+	token := loginHelper(t, srv, "marek", "heslo")
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	album := mkdirHelper(t, srv, token, env.root, "album")
+	photo := touchHelper(t, srv, token, album, "photo.jpg")
+	// root's file in marek's directory, marek can't read it
+	secret := touchHelper(t, srv, rootToken, album, "secret.txt")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+secret.String()+"/data", rootToken, strings.NewReader("tajné"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	sh := createShareHelper(t, srv, token, album, `{}`)
+
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/ls/"+album.String(), nil)
+	entries := decodeResponse[struct {
+		Ok   bool       `json:"ok"`
+		Data []fs.Entry `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(entries), 1, "listed entries")
+	expectEqual(t, entries[0].UUID, photo, "listed entry")
+
+	res = hit(srv, http.MethodGet, "/api/v1/s/"+sh.Token+"/cat/"+secret.String()+"/data", nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
+
+func TestShareCountsRangesCoveringTheFile(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	photo := touchHelper(t, srv, token, root, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("0123456789"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	sh := createShareHelper(t, srv, token, photo, `{"max_downloads":2}`)
+	target := "/api/v1/s/" + sh.Token + "/cat/" + photo.String() + "/data"
+
+	get := func(rng string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Range", rng)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// a small probe is free
+	res = get("bytes=0-1")
+	expectStatusCode(t, res, http.StatusPartialContent)
+	expectBody(t, res, "01")
+
+	// ranges that add up to the whole file are a download
+	res = get("bytes=-100")
+	expectStatusCode(t, res, http.StatusPartialContent)
+	expectBody(t, res, "0123456789")
+	expectStatusCode(t, get("bytes=5-,0-4"), http.StatusPartialContent)
+
+	res = get("bytes=0-1")
+	expectFail(t, res, http.StatusGone, "the share was downloaded too many times")
+}
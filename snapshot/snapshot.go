@@ -0,0 +1,182 @@
+// Package snapshot manages point-in-time, read-only copies of the whole fs.
+// Every snapshot is saved as
+//
+// $snapshots/$name/       hard links of all records and sections
+// $snapshots/$name.json   the Info struct
+package snapshot
+
+import (
+	"archiiv/fs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound = errors.New("snapshot not found")
+	ErrExists   = errors.New("snapshot already exists")
+
+	nameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+type Info struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Root    uuid.UUID `json:"root"`
+}
+
+type Store struct {
+	lock sync.Mutex
+	dir  string
+	live *fs.Fs
+	// snapshots opened so far
+	opened map[string]*fs.Fs
+}
+
+func NewStore(dir string, live *fs.Fs) (*Store, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create snapshots dir: %w", err)
+	}
+
+	return &Store{dir: dir, live: live, opened: map[string]*fs.Fs{}}, nil
+}
+
+func (s *Store) infoPath(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// DefaultName returns a name derived from the current time
+func DefaultName() string {
+	return time.Now().UTC().Format("20060102T150405Z")
+}
+
+// Create takes a snapshot of the live fs
+func (s *Store) Create(name string) (Info, error) {
+	if !nameRegex.MatchString(name) {
+		return Info{}, errors.New("invalid snapshot name")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := os.Stat(s.infoPath(name)); err == nil {
+		return Info{}, ErrExists
+	}
+
+	info := Info{Name: name, Created: time.Now().UTC(), Root: s.live.GetRoot()}
+
+	if err := s.live.Snapshot(filepath.Join(s.dir, name)); err != nil {
+		return Info{}, fmt.Errorf("snapshot fs: %w", err)
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return Info{}, err
+	}
+
+	// the info file is written last, a snapshot without it is incomplete
+	if err := os.WriteFile(s.infoPath(name), b, 0600); err != nil {
+		_ = os.RemoveAll(filepath.Join(s.dir, name))
+		return Info{}, err
+	}
+
+	return info, nil
+}
+
+func (s *Store) readInfo(name string) (Info, error) {
+	if !nameRegex.MatchString(name) {
+		return Info{}, ErrNotFound
+	}
+
+	b, err := os.ReadFile(s.infoPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+
+	var info Info
+	if err := json.Unmarshal(b, &info); err != nil {
+		return Info{}, fmt.Errorf("decode snapshot info: %w", err)
+	}
+
+	return info, nil
+}
+
+// List returns all snapshots, the oldest first
+func (s *Store) List() ([]Info, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []Info{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		info, err := s.readInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b Info) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	return infos, nil
+}
+
+// Open returns the read-only fs of the snapshot
+func (s *Store) Open(name string) (*fs.Fs, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f, ok := s.opened[name]; ok {
+		return f, nil
+	}
+
+	info, err := s.readInfo(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.OpenReadOnly(info.Root, filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("open snapshot: %w", err)
+	}
+
+	s.opened[name] = f
+	return f, nil
+}
+
+func (s *Store) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.readInfo(name); err != nil {
+		return err
+	}
+
+	delete(s.opened, name)
+
+	if err := os.Remove(s.infoPath(name)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(s.dir, name))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/snapshot"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// requireRoot only lets through requests made as root. Root can't log in with
+// a password; its tokens are signed by whoever has the server secret, e.g. the
+// archiiv command line tool
+func requireRoot(secret []signingKey, log *slog.Logger, h http.Handler) http.Handler {
+	return requireLogin(secret, log, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getUsername(r, secret) != fs.UserRoot {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+func sendSnapshotError(log *slog.Logger, w http.ResponseWriter, e error) {
+	switch {
+	case errors.Is(e, snapshot.ErrNotFound):
+		sendError(log, w, http.StatusNotFound, e.Error())
+	case errors.Is(e, snapshot.ErrExists):
+		sendError(log, w, http.StatusConflict, e.Error())
+	default:
+		sendError(log, w, http.StatusInternalServerError, e.Error())
+	}
+}
+
+// inSnapshot serves the request with a handler that works on the read-only fs
+// of the {snapshot} instead of the live one
+func inSnapshot(log *slog.Logger, snaps *snapshot.Store, h func(*fs.Fs) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, e := snaps.Open(r.PathValue("snapshot"))
+		if e != nil {
+			sendSnapshotError(log, w, e)
+			return
+		}
+
+		h(files).ServeHTTP(w, r)
+	})
+}
+
+func handleSnapshotList(log *slog.Logger, snaps *snapshot.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos, e := snaps.List()
+		if e != nil {
+			sendSnapshotError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, infos)
+	})
+}
+
+func handleSnapshotCreate(log *slog.Logger, snaps *snapshot.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = snapshot.DefaultName()
+		}
+
+		info, e := snaps.Create(name)
+		if e != nil {
+			sendSnapshotError(log, w, e)
+			return
+		}
+
+		log.Info("created snapshot", "name", info.Name)
+		sendOK(log, w, info)
+	})
+}
+
+func handleSnapshotDelete(log *slog.Logger, snaps *snapshot.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := snaps.Delete(r.PathValue("snapshot")); e != nil {
+			sendSnapshotError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// handleSnapshotRestore copies a file or a subtree from the snapshot into a
+// directory of the live fs. The copy gets new uuids and the metadata from the
+// snapshot
+func handleSnapshotRestore(secret []signingKey, files *fs.Fs, log *slog.Logger, snaps *snapshot.Store, jobs *jobStore, locks *lease.Store) http.Handler {
+	type OkResponse struct {
+		JobID uuid.UUID `json:"job_id"`
+	}
+
+	type Result struct {
+		NewUUID uuid.UUID `json:"new_uuid"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap, e := snaps.Open(r.PathValue("snapshot"))
+		if e != nil {
+			sendSnapshotError(log, w, e)
+			return
+		}
+
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		parentID, e := uuid.Parse(r.PathValue("parentUUID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		username := getUsername(r, secret)
+		if checkPerm(snap, id, username, fs.PermRead) != nil || checkPerm(files, parentID, username, fs.PermWrite) != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentID) {
+			return
+		}
+
+		total, e := snap.CountTree(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		jobID := jobs.start(log, username, apiKeyID(r), "restore", total, func(progress func(int)) (any, error) {
+			mapping, err := files.CopyFrom(snap, id, parentID, fs.CopyOptions{
+				Include: func(u uuid.UUID) bool {
+					return checkPerm(snap, u, username, fs.PermRead) == nil
+				},
+				Progress: progress,
+				Meta:     copyMeta(snap, username, true),
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{NewUUID: mapping[id]}, nil
+		})
+
+		w.Header().Set("Location", "/api/v1/jobs/"+jobID.String())
+		sendAccepted(log, w, OkResponse{JobID: jobID})
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func runCLI(t *testing.T, env testEnv, args ...string) (string, error) {
+	ts := httptest.NewServer(env.srv)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = commands[args[0]](append([]string{"--host", host, "--port", port}, args[1:]...), func(s string) string {
+		if s == "ARCHIIV_SECRET" {
+			return env.secret
+		}
+		return ""
+	}, &out)
+
+	return out.String(), err
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	srv, root := env.srv, env.root
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	file := touchHelper(t, srv, token, root, "notes.txt")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", token, strings.NewReader("v1"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	out, err := runCLI(t, env, "snapshot", "create", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, out, "before\n", "created snapshot name")
+
+	_, err = runCLI(t, env, "snapshot", "create", "before")
+	expectEqual(t, err.Error(), "server: snapshot already exists", "duplicate snapshot")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+file.String()+"/data", token, strings.NewReader("v2"))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/delete/"+root.String()+"/"+file.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/trash/purge/"+file.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/snapshots/before/fs/ls/"+root.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/snapshots/before/fs/cat/"+file.String()+"/data", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectBody(t, res, "v1")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/snapshots/before/restore/"+file.String()+"/"+root.String(), token, nil)
+	expectStatusCode(t, res, http.StatusAccepted)
+	j := waitForJob(t, srv, token, res.Header.Get("Location"))
+	expectEqual(t, j.State, jobDone, "restore job state")
+	restored := uuid.MustParse(j.Result.(map[string]any)["new_uuid"].(string))
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+restored.String()+"/data", token, nil)
+	expectBody(t, res, "v1")
+
+	out, err = runCLI(t, env, "snapshot", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "before  ") {
+		t.Errorf("unexpected snapshot list %#v", out)
+	}
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/snapshots/create", token, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	if _, err = runCLI(t, env, "snapshot", "delete", "before"); err != nil {
+		t.Fatal(err)
+	}
+	res = hitAuth(srv, http.MethodGet, "/api/v1/snapshots/before/fs/ls/"+root.String(), token, nil)
+	expectFail(t, res, http.StatusNotFound, "snapshot not found")
+}
+
+func TestSnapshotsSeeWholeMoves(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	srv, root := env.srv, env.root
+	token := loginHelper(t, srv, "marek", "heslo")
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := mkdirHelper(t, srv, token, root, "a")
+	b := mkdirHelper(t, srv, token, root, "b")
+	file := touchHelper(t, srv, token, a, "notes.txt")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dirs := []uuid.UUID{a, b}
+		for i := 0; i < 200; i++ {
+			from, to := dirs[i%2], dirs[(i+1)%2]
+			res := hitAuth(srv, http.MethodPost, "/api/v1/fs/move/"+from.String()+"/"+file.String()+"/"+to.String(), token, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("move %d: %s", i, res.Status)
+				return
+			}
+		}
+	}()
+
+	var names []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("s%d", i)
+		res := hitAuth(srv, http.MethodPost, "/api/v1/snapshots/create?name="+name, rootToken, nil)
+		expectStatusCode(t, res, http.StatusOK)
+		names = append(names, name)
+	}
+	<-done
+
+	// a snapshot taken in the middle of a move would have the file in
+	// both directories
+	for _, name := range names {
+		n := 0
+		for _, dir := range []uuid.UUID{a, b} {
+			res := hitAuth(srv, http.MethodGet, "/api/v1/snapshots/"+name+"/fs/ls/"+dir.String(), token, nil)
+			n += len(decodeResponse[struct {
+				Ok   bool        `json:"ok"`
+				Data []uuid.UUID `json:"data"`
+			}](t, res).Data)
+		}
+		expectEqual(t, n, 1, "copies of the file in snapshot "+name)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/trash"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how often expired files are purged from the trash of an idle server
+const trashPurgeInterval = time.Hour
+
+func handleDelete(secret []signingKey, files *fs.Fs, log *slog.Logger, bin *trash.Trash, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentUUID, e := uuid.Parse(r.PathValue("parentUUID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		childUUID, e := uuid.Parse(r.PathValue("childUUID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, parentUUID, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, parentUUID, childUUID) {
+			return
+		}
+
+		version, e := recordIfMatch(r, files, parentUUID)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
+
+		e = bin.DeleteIf(username, parentUUID, childUUID, version)
+		if isVersionMismatch(e) {
+			sendPreconditionFailed(log, w)
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("delete: %v", e))
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+func handleTrashList(secret []signingKey, log *slog.Logger, bin *trash.Trash) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries, e := bin.List(getUsername(r, secret))
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("list trash: %v", e))
+			return
+		}
+
+		sendOK(log, w, entries)
+	})
+}
+
+func sendTrashError(log *slog.Logger, w http.ResponseWriter, e error) {
+	if errors.Is(e, trash.ErrNotInTrash) {
+		sendError(log, w, http.StatusNotFound, e.Error())
+	} else if errors.Is(e, fs.ErrNameExists) {
+		sendError(log, w, http.StatusConflict, e.Error())
+	} else {
+		sendError(log, w, http.StatusInternalServerError, e.Error())
+	}
+}
+
+// handleTrashRestore mounts the file back where it was deleted from. The
+// `to` query parameter restores it into a different directory
+func handleTrashRestore(secret []signingKey, files *fs.Fs, log *slog.Logger, bin *trash.Trash, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		username := getUsername(r, secret)
+
+		entry, e := bin.Get(username, id)
+		if e != nil {
+			sendTrashError(log, w, e)
+			return
+		}
+
+		to := entry.Parent
+		if toArg := r.URL.Query().Get("to"); toArg != "" {
+			to, e = uuid.Parse(toArg)
+			if e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+				return
+			}
+		}
+
+		if e = checkPerm(files, to, username, fs.PermWrite); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		if !checkUnlocked(log, w, locks, username, to) {
+			return
+		}
+
+		if e = bin.Restore(username, id, to); e != nil {
+			sendTrashError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+func handleTrashPurge(secret []signingKey, log *slog.Logger, bin *trash.Trash) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := uuid.Parse(r.PathValue("uuid"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		if e = bin.Purge(getUsername(r, secret), id); e != nil {
+			sendTrashError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
@@ -0,0 +1,280 @@
+// Package trash keeps deleted files recoverable for a while. A deleted file is
+// unmounted from its parent and pinned in the fs so it survives with no
+// parent. The trash remembers where it was so it can be restored
+package trash
+
+import (
+	"archiiv/fs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNotInTrash = errors.New("file is not in the trash")
+
+type Entry struct {
+	UUID      uuid.UUID `json:"uuid"`
+	Name      string    `json:"name"`
+	Parent    uuid.UUID `json:"parent"`
+	DeletedBy string    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type Trash struct {
+	lock sync.Mutex
+	// username to the files they deleted
+	entries   map[string][]Entry
+	path      string
+	retention time.Duration
+	fs        *fs.Fs
+}
+
+// Load reads the trash file and pins all files in the trash. A missing trash
+// file means an empty trash. Entries whose files can't be pinned, for example
+// because they are gone, are dropped from the trash and returned
+func Load(path string, retention time.Duration, files *fs.Fs) (*Trash, []Entry, error) {
+	t := &Trash{
+		entries:   map[string][]Entry{},
+		path:      path,
+		retention: retention,
+		fs:        files,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &t.entries); err != nil {
+			return nil, nil, fmt.Errorf("decode trash file: %w", err)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var dropped []Entry
+	for user, es := range t.entries {
+		kept := es[:0]
+		for _, e := range es {
+			if err := files.Pin(e.UUID); err != nil {
+				dropped = append(dropped, e)
+				continue
+			}
+			kept = append(kept, e)
+		}
+
+		if len(kept) == 0 {
+			delete(t.entries, user)
+		} else {
+			t.entries[user] = kept
+		}
+	}
+
+	if len(dropped) > 0 {
+		if err := t.syncToDisk(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return t, dropped, t.purge()
+}
+
+// has to be called with t.lock held
+func (t *Trash) syncToDisk() error {
+	b, err := json.Marshal(t.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, t.path)
+}
+
+// PurgeExpired deletes the files that have been in the trash longer than the
+// retention for good. The trash does that whenever it is used, this is for
+// servers that sit idle
+func (t *Trash) PurgeExpired() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.purge()
+}
+
+// has to be called with t.lock held
+func (t *Trash) purge() error {
+	deadline := time.Now().Add(-t.retention)
+	changed := false
+
+	for user, es := range t.entries {
+		kept := es[:0]
+		for _, e := range es {
+			if e.DeletedAt.After(deadline) {
+				kept = append(kept, e)
+				continue
+			}
+			if err := t.fs.Unpin(e.UUID); err != nil {
+				return fmt.Errorf("purge %s: %w", e.UUID, err)
+			}
+			changed = true
+		}
+
+		if len(kept) == 0 {
+			delete(t.entries, user)
+		} else {
+			t.entries[user] = kept
+		}
+	}
+
+	if changed {
+		return t.syncToDisk()
+	}
+	return nil
+}
+
+// Delete moves the file from the parent into the user's trash
+func (t *Trash) Delete(user string, parent, id uuid.UUID) error {
+	return t.DeleteIf(user, parent, id, 0)
+}
+
+// DeleteIf is Delete that fails with fs.ErrVersionMismatch unless the parent
+// is at the version. Version 0 matches any version
+func (t *Trash) DeleteIf(user string, parent, id uuid.UUID, version uint64) error {
+	st, err := t.fs.Stat(id)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.purge(); err != nil {
+		return err
+	}
+
+	// pin and record the file before unmounting so it is never
+	// unreferenced nor missing from the trash file after a crash
+	if err := t.fs.Pin(id); err != nil {
+		return err
+	}
+
+	t.entries[user] = append(t.entries[user], Entry{
+		UUID:      id,
+		Name:      st.Name,
+		Parent:    parent,
+		DeletedBy: user,
+		DeletedAt: time.Now().UTC(),
+	})
+
+	err = t.syncToDisk()
+	if err == nil {
+		err = t.fs.UnmountIf(parent, id, version)
+	}
+	if err != nil {
+		_, _ = t.remove(user, id)
+		_ = t.fs.Unpin(id)
+		_ = t.syncToDisk()
+		return err
+	}
+
+	return nil
+}
+
+// List returns the files in the user's trash, the most recently deleted first
+func (t *Trash) List(user string) ([]Entry, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.purge(); err != nil {
+		return nil, err
+	}
+
+	es := slices.Clone(t.entries[user])
+	slices.Reverse(es)
+	return es, nil
+}
+
+// Get returns the most recent trash entry of the user for the file
+func (t *Trash) Get(user string, id uuid.UUID) (Entry, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	es := t.entries[user]
+	for i := len(es) - 1; i >= 0; i-- {
+		if es[i].UUID == id {
+			return es[i], nil
+		}
+	}
+
+	return Entry{}, ErrNotInTrash
+}
+
+// has to be called with t.lock held
+func (t *Trash) remove(user string, id uuid.UUID) (Entry, error) {
+	es := t.entries[user]
+	for i := len(es) - 1; i >= 0; i-- {
+		if es[i].UUID == id {
+			e := es[i]
+			t.entries[user] = slices.Delete(es, i, i+1)
+			if len(t.entries[user]) == 0 {
+				delete(t.entries, user)
+			}
+			return e, nil
+		}
+	}
+
+	return Entry{}, ErrNotInTrash
+}
+
+// Restore mounts the file back into the directory it was deleted from, or into
+// to if it isn't nil
+func (t *Trash) Restore(user string, id uuid.UUID, to uuid.UUID) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	e, err := t.remove(user, id)
+	if err != nil {
+		return err
+	}
+
+	if to == uuid.Nil {
+		to = e.Parent
+	}
+
+	if err := t.fs.Mount(to, id); err != nil {
+		t.entries[user] = append(t.entries[user], e)
+		return err
+	}
+
+	if err := t.fs.Unpin(id); err != nil {
+		return err
+	}
+
+	return t.syncToDisk()
+}
+
+// Purge deletes the file from the trash for good
+func (t *Trash) Purge(user string, id uuid.UUID) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, err := t.remove(user, id); err != nil {
+		return err
+	}
+
+	if err := t.fs.Unpin(id); err != nil {
+		return err
+	}
+
+	return t.syncToDisk()
+}
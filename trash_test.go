@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archiiv/trash"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeleteAndRestore(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	album := mkdirHelper(t, srv, token, root, "album")
+	photo := touchHelper(t, srv, token, album, "photo.jpg")
+	res := hitAuth(srv, http.MethodPost, "/api/v1/fs/upload/"+photo.String()+"/data", token, strings.NewReader("babička"))
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/delete/"+root.String()+"/"+album.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, len(lsHelper(t, srv, token, root)), 0, "children of root after delete")
+
+	// still there, just not reachable
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+photo.String()+"/data", token, nil)
+	expectBody(t, res, "babička")
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/trash", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	entries := decodeResponse[struct {
+		Ok   bool          `json:"ok"`
+		Data []trash.Entry `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(entries), 1, "trash entries")
+	expectEqual(t, entries[0].UUID, album, "trashed uuid")
+	expectEqual(t, entries[0].Parent, root, "original parent")
+	expectEqual(t, entries[0].Name, "album", "trashed name")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/trash/restore/"+album.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, lsHelper(t, srv, token, root)[0], album, "restored child")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/trash/restore/"+album.String(), token, nil)
+	expectFail(t, res, http.StatusNotFound, "file is not in the trash")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/fs/delete/"+album.String()+"/"+photo.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/trash/purge/"+photo.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/stat/"+photo.String(), token, nil)
+	expectStatusCode(t, res, http.StatusNotFound)
+}
+
+func TestTrashDropsMissingFilesOnLoad(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, env.srv, "marek", "heslo")
+
+	photo := touchHelper(t, env.srv, token, env.root, "photo.jpg")
+	res := hitAuth(env.srv, http.MethodPost, "/api/v1/fs/delete/"+env.root.String()+"/"+photo.String(), token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+
+	// an entry whose file disappeared, e.g. restored from an older backup
+	path := filepath.Join(env.dir, "trash.json")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries map[string][]trash.Entry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+	entries["marek"] = append(entries["marek"], trash.Entry{UUID: uuid.New(), Name: "gone", Parent: env.root, DeletedBy: "marek", DeletedAt: time.Now()})
+	if b, err = json.Marshal(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := startTestServer(t, env.dir, env.root, env.secret)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/trash", token, nil)
+	listed := decodeResponse[struct {
+		Ok   bool          `json:"ok"`
+		Data []trash.Entry `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(listed), 1, "trash entries after restart")
+	expectEqual(t, listed[0].UUID, photo, "kept entry")
+}
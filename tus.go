@@ -0,0 +1,297 @@
+package main
+
+// Resumable uploads using the tus protocol (https://tus.io/protocols/resumable-upload)
+//
+// POST   /api/v1/fs/tus/{uuid}/{section}  creates an upload into the section
+// HEAD   /api/v1/tus/{id}                 returns the offset of the upload
+// PATCH  /api/v1/tus/{id}                 appends bytes to the upload
+// DELETE /api/v1/tus/{id}                 terminates the upload
+//
+// Once all bytes are received the upload replaces the section in the fs.
+
+import (
+	"archiiv/fs"
+	"archiiv/lease"
+	"archiiv/upload"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// requireTus rejects requests made with an unsupported version of the
+// protocol and adds the headers that every tus response must have
+func requireTus(log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			sendError(log, w, http.StatusPreconditionFailed, "unsupported tus version")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func handleTusOptions(uploads *upload.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if max := uploads.MaxSize(); max > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// parseTusMetadata parses the Upload-Metadata header, which is a comma
+// separated list of `key base64(value)` pairs
+func parseTusMetadata(h string) (map[string]string, error) {
+	m := map[string]string{}
+	if h == "" {
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(h, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %w", key, err)
+		}
+
+		m[key] = string(v)
+	}
+
+	return m, nil
+}
+
+func setTusUploadHeaders(w http.ResponseWriter, u upload.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func sendUploadError(log *slog.Logger, w http.ResponseWriter, e error) {
+	switch {
+	case errors.Is(e, upload.ErrNotFound):
+		sendError(log, w, http.StatusNotFound, "upload not found")
+	case errors.Is(e, upload.ErrOffsetMismatch):
+		sendError(log, w, http.StatusConflict, "upload offset mismatch")
+	case errors.Is(e, upload.ErrTooLarge):
+		sendError(log, w, http.StatusRequestEntityTooLarge, "upload exceeds its length")
+	case errors.Is(e, upload.ErrMaxSize):
+		sendError(log, w, http.StatusRequestEntityTooLarge, "upload is larger than the maximum size")
+	case errors.Is(e, upload.ErrBusy):
+		sendError(log, w, http.StatusLocked, "upload is locked")
+	case isVersionMismatch(e):
+		sendPreconditionFailed(log, w)
+	default:
+		sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("upload: %v", e))
+	}
+}
+
+// getOwnUpload returns the upload only if it belongs to the logged in user.
+// Uploads of other users are reported as not found
+func getOwnUpload(secret []signingKey, uploads *upload.Store, r *http.Request) (upload.Upload, error) {
+	u, e := uploads.Get(r.PathValue("id"))
+	if e != nil {
+		return u, e
+	}
+
+	if u.Owner != getUsername(r, secret) || !keyMayUse(r, u.KeyID) {
+		return upload.Upload{}, upload.ErrNotFound
+	}
+
+	return u, nil
+}
+
+// finishUpload moves the complete upload into its section
+func finishUpload(fs *fs.Fs, uploads *upload.Store, u upload.Upload) error {
+	err := uploads.Finish(u.ID, func(r io.Reader) error {
+		sw, e := fs.CreateSectionIf(u.File, u.Section, u.IfVersion)
+		if e != nil {
+			return fmt.Errorf("create section: %w", e)
+		}
+		defer sw.Abort()
+
+		if _, e = io.Copy(sw, r); e != nil {
+			return fmt.Errorf("io copy: %w", e)
+		}
+
+		return sw.Close()
+	})
+
+	// the section changed during the upload so it can never succeed
+	if isVersionMismatch(err) {
+		_ = uploads.Remove(u.ID)
+	}
+
+	return err
+}
+
+func handleTusCreate(secret []signingKey, log *slog.Logger, files *fs.Fs, uploads *upload.Store, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuidArg := r.PathValue("uuid")
+		sectionArg := r.PathValue("section")
+
+		id, e := uuid.Parse(uuidArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse uuid: %v", e))
+			return
+		}
+
+		username := getUsername(r, secret)
+		if e = checkPerm(files, id, username, sectionWritePerm(sectionArg)); e != nil {
+			sendError(log, w, http.StatusForbidden, "403 forbidden")
+			return
+		}
+
+		length, e := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if e != nil || length < 0 {
+			sendError(log, w, http.StatusBadRequest, "invalid Upload-Length")
+			return
+		}
+		if max := uploads.MaxSize(); max > 0 && length > max {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+			sendUploadError(log, w, upload.ErrMaxSize)
+			return
+		}
+
+		metadata, e := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("invalid Upload-Metadata: %v", e))
+			return
+		}
+
+		// the lock and the version are checked again once the upload is
+		// complete
+		if !checkUnlocked(log, w, locks, username, id) {
+			return
+		}
+
+		version, e := sectionIfMatch(r, files, id, sectionArg)
+		if e != nil {
+			sendPreconditionFailed(log, w)
+			return
+		}
+
+		// fail early instead of after the whole upload
+		sw, e := files.CreateSection(id, sectionArg)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("create section: %v", e))
+			return
+		}
+		sw.Abort()
+
+		uploads.PurgeExpired()
+
+		u, e := uploads.Create(getUsername(r, secret), apiKeyID(r), id, sectionArg, length, metadata, version)
+		if e != nil {
+			sendUploadError(log, w, e)
+			return
+		}
+
+		// an empty upload is complete right away
+		if u.Done() {
+			if e = finishUpload(files, uploads, u); e != nil {
+				sendUploadError(log, w, e)
+				return
+			}
+		}
+
+		w.Header().Set("Location", "/api/v1/tus/"+u.ID)
+		setTusUploadHeaders(w, u)
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+func handleTusHead(secret []signingKey, log *slog.Logger, uploads *upload.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, e := getOwnUpload(secret, uploads, r)
+		if e != nil {
+			sendUploadError(log, w, e)
+			return
+		}
+
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		setTusUploadHeaders(w, u)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func handleTusPatch(secret []signingKey, log *slog.Logger, fs *fs.Fs, uploads *upload.Store, locks *lease.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			sendError(log, w, http.StatusUnsupportedMediaType, "content type must be application/offset+octet-stream")
+			return
+		}
+
+		offset, e := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if e != nil || offset < 0 {
+			sendError(log, w, http.StatusBadRequest, "invalid Upload-Offset")
+			return
+		}
+
+		u, e := getOwnUpload(secret, uploads, r)
+		if e != nil {
+			sendUploadError(log, w, e)
+			return
+		}
+
+		u, e = uploads.Append(u.ID, offset, r.Body)
+		if e != nil {
+			// u is empty when the append didn't start
+			log.Info("upload append failed", "upload", r.PathValue("id"), "offset", offset, "error", e)
+			sendUploadError(log, w, e)
+			return
+		}
+
+		if u.Done() {
+			// the upload stays so that it can be finished once the
+			// file is unlocked
+			if !checkUnlocked(log, w, locks, u.Owner, u.File) {
+				return
+			}
+			if e = finishUpload(fs, uploads, u); e != nil {
+				sendUploadError(log, w, e)
+				return
+			}
+		}
+
+		setTusUploadHeaders(w, u)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleTusDelete(secret []signingKey, log *slog.Logger, uploads *upload.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, e := getOwnUpload(secret, uploads, r)
+		if e != nil {
+			sendUploadError(log, w, e)
+			return
+		}
+
+		if e = uploads.Remove(u.ID); e != nil {
+			sendUploadError(log, w, e)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func hitTus(srv http.Handler, method, target, token string, body string, headers map[string]string) *http.Response {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Add("Authorization", token)
+	req.Header.Add("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestTusUpload(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	file := touchHelper(t, srv, token, root, "video.mp4")
+
+	res := hitTus(srv, http.MethodPost, "/api/v1/fs/tus/"+file.String()+"/data", token, "", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename dmlkZW8ubXA0",
+	})
+	expectStatusCode(t, res, http.StatusCreated)
+	location := res.Header.Get("Location")
+	if !strings.HasPrefix(location, "/api/v1/tus/") {
+		t.Fatalf("unexpected location %#v", location)
+	}
+	expectEqual(t, res.Header.Get("Upload-Offset"), "0", "offset after creation")
+
+	patch := func(offset, body string) *http.Response {
+		return hitTus(srv, http.MethodPatch, location, token, body, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		})
+	}
+
+	res = patch("0", "hello")
+	expectStatusCode(t, res, http.StatusNoContent)
+	expectEqual(t, res.Header.Get("Upload-Offset"), "5", "offset after first patch")
+
+	// the section is not there until the upload is complete
+	expectStatusCode(t, hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+file.String()+"/data", token, nil), http.StatusNotFound)
+
+	expectStatusCode(t, patch("3", " world"), http.StatusConflict)
+
+	res = hitTus(srv, http.MethodHead, location, token, "", nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, res.Header.Get("Upload-Offset"), "5", "offset from HEAD")
+	expectEqual(t, res.Header.Get("Upload-Length"), "11", "length from HEAD")
+
+	res = patch("5", " world")
+	expectStatusCode(t, res, http.StatusNoContent)
+	expectEqual(t, res.Header.Get("Upload-Offset"), "11", "offset after last patch")
+
+	expectStatusCode(t, hitTus(srv, http.MethodHead, location, token, "", nil), http.StatusNotFound)
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/fs/cat/"+file.String()+"/data", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectBody(t, res, "hello world")
+}
+
+func TestTusRejectsOverflowAndOtherUsers(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"marek":  hashPassword("heslo"),
+		"prokop": hashPassword("catboy123"),
+	})
+	token := loginHelper(t, srv, "marek", "heslo")
+	other := loginHelper(t, srv, "prokop", "catboy123")
+	file := touchHelper(t, srv, token, root, "a")
+
+	res := hitTus(srv, http.MethodPost, "/api/v1/fs/tus/"+file.String()+"/data", token, "", map[string]string{"Upload-Length": "3"})
+	expectStatusCode(t, res, http.StatusCreated)
+	location := res.Header.Get("Location")
+
+	expectStatusCode(t, hitTus(srv, http.MethodHead, location, other, "", nil), http.StatusNotFound)
+
+	res = hitTus(srv, http.MethodPatch, location, token, "abcd", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	expectStatusCode(t, res, http.StatusRequestEntityTooLarge)
+
+	expectStatusCode(t, hitTus(srv, http.MethodDelete, location, token, "", nil), http.StatusNoContent)
+	expectStatusCode(t, hitTus(srv, http.MethodHead, location, token, "", nil), http.StatusNotFound)
+}
+
+func TestTusNeedsVersion(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	res := hit(srv, http.MethodPost, "/api/v1/fs/tus/00000000-0000-0000-0000-000000000000/data", nil)
+	expectFail(t, res, http.StatusPreconditionFailed, "unsupported tus version")
+	expectEqual(t, res.Header.Get("Tus-Version"), tusVersion, "Tus-Version header")
+}
+
+func TestTusMaxSize(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")}, "--upload_max_size", "10")
+	token := loginHelper(t, env.srv, "marek", "heslo")
+	file := touchHelper(t, env.srv, token, env.root, "a")
+
+	res := hit(env.srv, http.MethodOptions, "/api/v1/fs/tus/"+file.String()+"/data", nil)
+	expectStatusCode(t, res, http.StatusNoContent)
+	expectEqual(t, res.Header.Get("Tus-Max-Size"), "10", "Tus-Max-Size header")
+
+	res = hitTus(env.srv, http.MethodPost, "/api/v1/fs/tus/"+file.String()+"/data", token, "", map[string]string{"Upload-Length": "11"})
+	expectFail(t, res, http.StatusRequestEntityTooLarge, "upload is larger than the maximum size")
+
+	res = hitTus(env.srv, http.MethodPost, "/api/v1/fs/tus/"+file.String()+"/data", token, "", map[string]string{"Upload-Length": "10"})
+	expectStatusCode(t, res, http.StatusCreated)
+}
+
+func TestTusHeadDuringPatch(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+	file := touchHelper(t, srv, token, root, "a")
+
+	res := hitTus(srv, http.MethodPost, "/api/v1/fs/tus/"+file.String()+"/data", token, "", map[string]string{"Upload-Length": "6"})
+	expectStatusCode(t, res, http.StatusCreated)
+	location := res.Header.Get("Location")
+
+	// the body blocks until the test writes into it so the patch stays in
+	// progress
+	body, bodyWriter := io.Pipe()
+	done := make(chan *http.Response)
+	go func() {
+		req := httptest.NewRequest(http.MethodPatch, location, body)
+		req.Header.Add("Authorization", token)
+		req.Header.Add("Tus-Resumable", tusVersion)
+		req.Header.Add("Content-Type", "application/offset+octet-stream")
+		req.Header.Add("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		done <- w.Result()
+	}()
+	if _, err := bodyWriter.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	res = hitTus(srv, http.MethodHead, location, token, "", nil)
+	expectStatusCode(t, res, http.StatusOK)
+	expectEqual(t, res.Header.Get("Upload-Offset"), "0", "offset during the patch")
+
+	bodyWriter.Close()
+	res = <-done
+	expectStatusCode(t, res, http.StatusNoContent)
+	expectEqual(t, res.Header.Get("Upload-Offset"), "3", "offset after the patch")
+}
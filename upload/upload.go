@@ -0,0 +1,374 @@
+// Package upload keeps track of partially uploaded sections. It stores the
+// received bytes outside of the fs so that an interrupted upload can be
+// resumed later and only a complete upload ever turns into a section
+package upload
+
+// Each upload is saved as two files in the uploads directory:
+//
+// $uploads/$id       the bytes received so far
+// $uploads/$id.json  the Upload struct
+//
+// Uploads that are not finished before their expiration are deleted.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	ErrTooLarge       = errors.New("upload exceeds its length")
+	ErrBusy           = errors.New("upload is being written to")
+	ErrMaxSize        = errors.New("upload is larger than the maximum size")
+)
+
+// Upload describes one resumable upload into a section of a file
+type Upload struct {
+	ID       string            `json:"id"`
+	Owner    string            `json:"owner"`
+	File     uuid.UUID         `json:"file"`
+	Section  string            `json:"section"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expires  time.Time         `json:"expires"`
+	// the version of the section the upload replaces, 0 for any version
+	IfVersion uint64 `json:"if_version,omitempty"`
+	// the API key the upload was created with, if any
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// Done reports whether all bytes of the upload were received
+func (u Upload) Done() bool {
+	return u.Offset == u.Length
+}
+
+type entry struct {
+	Upload
+	// held by whoever writes or removes the upload
+	mutex sync.Mutex
+	// guards Upload so that it can be read while the upload is written to
+	state sync.Mutex
+}
+
+type Store struct {
+	lock    sync.Mutex
+	uploads map[string]*entry
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+}
+
+// NewStore loads the uploads kept in dir. Uploads longer than maxSize bytes
+// can't be created, 0 means no limit
+func NewStore(dir string, ttl time.Duration, maxSize int64) (*Store, error) {
+	s := &Store{
+		uploads: make(map[string]*entry),
+		dir:     dir,
+		ttl:     ttl,
+		maxSize: maxSize,
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create uploads dir: %w", err)
+	}
+
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("load uploads: %w", err)
+	}
+
+	s.PurgeExpired()
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		if _, err := uuid.Parse(id); err != nil {
+			continue
+		}
+
+		b, err := os.ReadFile(s.infoPath(id))
+		if err != nil {
+			return err
+		}
+
+		u := new(entry)
+		if err := json.Unmarshal(b, &u.Upload); err != nil {
+			return fmt.Errorf("decode %s: %w", e.Name(), err)
+		}
+
+		s.uploads[id] = u
+	}
+
+	return nil
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// has to be called with the entry locked
+func (s *Store) writeInfo(u *entry) error {
+	b, err := json.Marshal(u.Upload)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.infoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.infoPath(u.ID))
+}
+
+// MaxSize returns the length limit of new uploads, 0 if there is none
+func (s *Store) MaxSize() int64 {
+	return s.maxSize
+}
+
+func (s *Store) Create(owner, keyID string, file uuid.UUID, section string, length int64, metadata map[string]string, ifVersion uint64) (Upload, error) {
+	if length < 0 {
+		return Upload{}, errors.New("negative upload length")
+	}
+	if s.maxSize > 0 && length > s.maxSize {
+		return Upload{}, ErrMaxSize
+	}
+
+	u := new(entry)
+	u.Upload = Upload{
+		ID:        uuid.NewString(),
+		Owner:     owner,
+		KeyID:     keyID,
+		File:      file,
+		Section:   section,
+		Length:    length,
+		Metadata:  metadata,
+		Expires:   time.Now().Add(s.ttl).UTC().Truncate(time.Second),
+		IfVersion: ifVersion,
+	}
+
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := f.Close(); err != nil {
+		return Upload{}, err
+	}
+
+	if err := s.writeInfo(u); err != nil {
+		_ = os.Remove(s.dataPath(u.ID))
+		return Upload{}, err
+	}
+
+	s.lock.Lock()
+	s.uploads[u.ID] = u
+	s.lock.Unlock()
+
+	return u.Upload, nil
+}
+
+func (s *Store) get(id string) (*entry, error) {
+	s.lock.Lock()
+	u, ok := s.uploads[id]
+	s.lock.Unlock()
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return u, nil
+}
+
+// Get returns the current state of the upload. It doesn't wait for an append
+// in progress, the offset is the one before it. Expired uploads are reported
+// as not found
+func (s *Store) Get(id string) (Upload, error) {
+	u, err := s.get(id)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	u.state.Lock()
+	defer u.state.Unlock()
+
+	if time.Now().After(u.Expires) {
+		return Upload{}, ErrNotFound
+	}
+
+	return u.Upload, nil
+}
+
+// Append writes the bytes from r at offset, which has to match the current
+// offset of the upload. Bytes that were received before an error occurred are
+// kept so that the client can resume from the new offset
+func (s *Store) Append(id string, offset int64, r io.Reader) (Upload, error) {
+	u, err := s.get(id)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	// two clients appending at once would corrupt the upload
+	if !u.mutex.TryLock() {
+		return Upload{}, ErrBusy
+	}
+	defer u.mutex.Unlock()
+
+	if time.Now().After(u.Expires) {
+		return Upload{}, ErrNotFound
+	}
+
+	if offset != u.Offset {
+		return u.Upload, ErrOffsetMismatch
+	}
+
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		return u.Upload, err
+	}
+	defer f.Close()
+
+	// drop whatever an earlier crashed append left after the offset
+	if err := f.Truncate(u.Offset); err != nil {
+		return u.Upload, err
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return u.Upload, err
+	}
+
+	// read one byte more than allowed to find out that the client sends
+	// too much
+	n, copyErr := io.Copy(f, io.LimitReader(r, u.Length-u.Offset+1))
+	if u.Offset+n > u.Length {
+		n = u.Length - u.Offset
+		copyErr = ErrTooLarge
+		if err := f.Truncate(u.Length); err != nil {
+			return u.Upload, err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return u.Upload, err
+	}
+
+	u.state.Lock()
+	u.Offset += n
+	u.Expires = time.Now().Add(s.ttl).UTC().Truncate(time.Second)
+	u.state.Unlock()
+	if err := s.writeInfo(u); err != nil {
+		return u.Upload, err
+	}
+
+	return u.Upload, copyErr
+}
+
+// Finish passes the content of the complete upload to commit and removes the
+// upload if commit succeeds
+func (s *Store) Finish(id string, commit func(io.Reader) error) error {
+	u, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	if !u.mutex.TryLock() {
+		return ErrBusy
+	}
+	defer u.mutex.Unlock()
+
+	if !u.Done() {
+		return errors.New("upload is not complete")
+	}
+
+	f, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := commit(f); err != nil {
+		return err
+	}
+
+	return s.remove(u)
+}
+
+// Remove terminates the upload and deletes the received bytes
+func (s *Store) Remove(id string) error {
+	u, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	if !u.mutex.TryLock() {
+		return ErrBusy
+	}
+	defer u.mutex.Unlock()
+
+	return s.remove(u)
+}
+
+// has to be called with the entry locked
+func (s *Store) remove(u *entry) error {
+	s.lock.Lock()
+	delete(s.uploads, u.ID)
+	s.lock.Unlock()
+
+	err := os.Remove(s.infoPath(u.ID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(s.dataPath(u.ID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// PurgeExpired deletes all uploads past their expiration
+func (s *Store) PurgeExpired() {
+	s.lock.Lock()
+	all := make([]*entry, 0, len(s.uploads))
+	for _, u := range s.uploads {
+		all = append(all, u)
+	}
+	s.lock.Unlock()
+
+	now := time.Now()
+	for _, u := range all {
+		// busy uploads are being appended to so they are not expired
+		if !u.mutex.TryLock() {
+			continue
+		}
+		if now.After(u.Expires) {
+			_ = s.remove(u)
+		}
+		u.mutex.Unlock()
+	}
+}
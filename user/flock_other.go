@@ -0,0 +1,9 @@
+//go:build !unix
+
+package user
+
+// lockFile does nothing where flock is not available, only writes from
+// within one process are serialised there
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
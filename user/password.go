@@ -0,0 +1,141 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// HashParams are the argon2id parameters used for new password hashes. The
+// parameters are stored with every hash so changing them doesn't break
+// existing passwords
+type HashParams struct {
+	Time uint32
+	// in KiB
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultHashParams is the second recommended option of RFC 9106
+var DefaultHashParams = HashParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+const (
+	saltLen = 16
+	keyLen  = 32
+)
+
+// passwordHash is the string stored in the users file, either
+// `$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>` or
+// `$sha512$<hash>` for entries from before the server hashed passwords
+// itself. Those are upgraded on the next successful login
+type passwordHash string
+
+var errHashFormat = errors.New("malformed password hash")
+
+func hashPassword(pwd string, params HashParams) (passwordHash, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(pwd), salt, params.Time, params.Memory, params.Threads, keyLen)
+
+	return passwordHash(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func legacyHash(sum [64]byte) passwordHash {
+	return passwordHash("$sha512$" + base64.RawStdEncoding.EncodeToString(sum[:]))
+}
+
+// check compares the password with the hash in constant time
+func (h passwordHash) check(pwd string) (bool, error) {
+	parts := strings.Split(string(h), "$")
+	if len(parts) < 3 || parts[0] != "" {
+		return false, errHashFormat
+	}
+
+	switch parts[1] {
+	case "sha512":
+		want, err := base64.RawStdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false, errHashFormat
+		}
+		got := sha512.Sum512([]byte(pwd))
+		return subtle.ConstantTimeCompare(got[:], want) == 1, nil
+
+	case "argon2id":
+		if len(parts) != 6 {
+			return false, errHashFormat
+		}
+
+		var version int
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, errHashFormat
+		}
+
+		var p HashParams
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+			return false, errHashFormat
+		}
+
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, errHashFormat
+		}
+		want, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, errHashFormat
+		}
+
+		got := argon2.IDKey([]byte(pwd), salt, p.Time, p.Memory, p.Threads, uint32(len(want)))
+		return subtle.ConstantTimeCompare(got, want) == 1, nil
+	}
+
+	return false, errHashFormat
+}
+
+// isLegacy reports whether the hash should be replaced by a new one
+func (h passwordHash) isLegacy() bool {
+	return strings.HasPrefix(string(h), "$sha512$")
+}
+
+// UnmarshalJSON also accepts the old format of the users file, where the
+// SHA-512 of the password was stored as an array of 64 numbers
+func (h *passwordHash) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*h = passwordHash(s)
+		return nil
+	}
+
+	var sum [64]byte
+	if err := json.Unmarshal(b, &sum); err != nil {
+		return errHashFormat
+	}
+	*h = legacyHash(sum)
+	return nil
+}
+
+// HashPassword hashes a password that protects something else than an
+// account, with the parameters of the store
+func (us *UserStore) HashPassword(pwd string) (string, error) {
+	h, err := hashPassword(pwd, us.params)
+	return string(h), err
+}
+
+// CheckPasswordHash compares the password with a hash from HashPassword in
+// constant time
+func CheckPasswordHash(hash, pwd string) bool {
+	ok, err := passwordHash(hash).check(pwd)
+	return ok && err == nil
+}
@@ -3,83 +3,385 @@
 package user
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	ErrExists   = errors.New("username already used")
+	ErrNotFound = errors.New("unknown user")
+	ErrLinked   = errors.New("the account at the provider is linked to another user")
+)
+
+// schemaVersion of the users file. Version 1 was a bare object of usernames
+// to password hashes, it is converted on the first write
+const schemaVersion = 2
+
+// Profile is what is known about a user besides the password
+type Profile struct {
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	Created     time.Time `json:"created"`
+	// disabled users can't log in
+	Disabled bool `json:"disabled"`
+	// subject of the user at the OpenID Connect provider, set on the
+	// first login through it
+	OIDCSubject string `json:"oidc_subject,omitempty"`
+}
+
+type entry struct {
+	Password passwordHash `json:"password"`
+	Profile
+}
+
+type usersFile struct {
+	Version int              `json:"version"`
+	Users   map[string]entry `json:"users"`
+}
+
+// reloads counts calls of RequestReload
+var reloads atomic.Uint64
+
+// RequestReload makes all stores read the users file again on their next use,
+// e.g. after SIGHUP. Changes of the file are noticed without it too
+func RequestReload() {
+	reloads.Add(1)
+}
+
+// UserStore caches the users file. The file may be edited by another process
+// (like a second server or an admin with a text editor) so every use checks
+// whether the file changed and every write holds a lock on `<path>.lock`
+// while it reads, modifies and replaces the file
 type UserStore struct {
-	// username to hashed password
-	users map[string][64]byte
+	lock sync.Mutex
+	// username to hashed password and profile
+	users map[string]entry
 	// path of the users file
 	path string
+	// the users file when it was last read or written
+	seen os.FileInfo
+	// value of reloads when the file was last read
+	seenReloads uint64
+	// for hashing new passwords
+	params HashParams
+	// checked against when the user doesn't exist
+	dummy passwordHash
+}
+
+// decodeUsersFile reads any version of the users file
+func decodeUsersFile(b []byte) (map[string]entry, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(b, &top); err != nil {
+		return nil, err
+	}
+
+	// version 1 has no version field. A user called "version" would have
+	// a password hash there, not a number
+	var version int
+	if v, ok := top["version"]; !ok || json.Unmarshal(v, &version) != nil {
+		var hashes map[string]passwordHash
+		if err := json.Unmarshal(b, &hashes); err != nil {
+			return nil, err
+		}
+
+		users := make(map[string]entry, len(hashes))
+		for name, h := range hashes {
+			users[name] = entry{Password: h}
+		}
+		return users, nil
+	}
+
+	if version != schemaVersion {
+		return nil, fmt.Errorf("unsupported users file version %d", version)
+	}
+
+	var f usersFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Users == nil {
+		f.Users = map[string]entry{}
+	}
+	return f.Users, nil
+}
+
+func LoadUsers(path string, params HashParams) (*UserStore, error) {
+	us := &UserStore{
+		path:   filepath.Clean(path),
+		params: params,
+	}
+
+	var err error
+	if us.dummy, err = hashPassword("", params); err != nil {
+		return nil, err
+	}
+
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	if err := us.reload(); err != nil {
+		return nil, err
+	}
+
+	return us, nil
 }
 
-func (us UserStore) syncToDisk() error {
-	file, err := os.Create(us.path)
+// has to be called with us.lock held
+func (us *UserStore) reload() error {
+	reloadsNow := reloads.Load()
+
+	f, err := os.Open(us.path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	err = json.NewEncoder(file).Encode(us.users)
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
 
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	users, err := decodeUsersFile(b)
+	if err != nil {
+		return fmt.Errorf("decode users file: %w", err)
+	}
+
+	us.users = users
+	us.seen = fi
+	us.seenReloads = reloadsNow
 	return nil
 }
 
-func LoadUsers(path string) (us UserStore, err error) {
-	us.path = filepath.Clean(path)
+// refresh reloads the users file if it changed since it was last read. Has to
+// be called with us.lock held
+func (us *UserStore) refresh() error {
+	fi, err := os.Stat(us.path)
+	if err != nil {
+		return err
+	}
+
+	if os.SameFile(fi, us.seen) && fi.ModTime().Equal(us.seen.ModTime()) &&
+		fi.Size() == us.seen.Size() && reloads.Load() == us.seenReloads {
+		return nil
+	}
+
+	return us.reload()
+}
 
-	usersFile, err := os.OpenFile(us.path, os.O_RDWR, 0)
+// current returns the users from the freshest users file. A users file that
+// can't be read keeps the last good state. The map is never modified, writes
+// replace it
+func (us *UserStore) current() map[string]entry {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	_ = us.refresh()
+	return us.users
+}
+
+// update applies the change to the freshest users file and replaces it. When
+// the change returns an error or the file can't be written nothing changes
+func (us *UserStore) update(change func(users map[string]entry) error) error {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	unlock, err := lockFile(us.path + ".lock")
+	if err != nil {
+		return fmt.Errorf("lock users file: %w", err)
+	}
+	defer unlock()
+
+	if err := us.refresh(); err != nil {
+		return err
+	}
+
+	users := make(map[string]entry, len(us.users))
+	for name, e := range us.users {
+		users[name] = e
+	}
+
+	if err := change(users); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(usersFile{Version: schemaVersion, Users: users})
 	if err != nil {
-		return
+		return err
 	}
 
-	if err = json.NewDecoder(usersFile).Decode(&us.users); err != nil {
-		err = fmt.Errorf("decode users file: %w", err)
-		return
+	tmp := us.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, us.path); err != nil {
+		return err
 	}
 
-	return
+	fi, err := os.Stat(us.path)
+	if err != nil {
+		return err
+	}
+
+	us.users = users
+	us.seen = fi
+	return nil
 }
 
-func (us UserStore) CheckPassword(name string, pwd [64]byte) bool {
-	return us.users[name] == pwd
+// CheckPassword reports whether the password is right and the user may log
+// in. A legacy hash is replaced by a new one after a successful check
+func (us *UserStore) CheckPassword(name, pwd string) bool {
+	e, ok := us.current()[name]
+
+	if !ok {
+		// take as long as with an existing user so the response time
+		// doesn't tell which usernames exist
+		_, _ = us.dummy.check(pwd)
+		return false
+	}
+
+	if ok, err := e.Password.check(pwd); !ok || err != nil {
+		return false
+	}
+
+	if e.Disabled {
+		return false
+	}
+
+	if e.Password.isLegacy() {
+		// if this fails the old hash still works, try again next time
+		_ = us.SetPassword(name, pwd)
+	}
+
+	return true
 }
 
-func (us UserStore) CreateUser(name string, pwd [64]byte) error {
-	if _, ok := us.users[name]; ok {
-		return errors.New("username already used")
-	} else {
-		us.users[name] = pwd
+// SetPassword replaces the password of the user
+func (us *UserStore) SetPassword(name, pwd string) error {
+	h, err := hashPassword(pwd, us.params)
+	if err != nil {
+		return err
+	}
 
-		err := us.syncToDisk()
-		if err != nil {
-			// undo the insert to keep the table consistent
-			delete(us.users, name)
-			return fmt.Errorf("createUser: %w", err)
+	err = us.update(func(users map[string]entry) error {
+		e, ok := users[name]
+		if !ok {
+			return ErrNotFound
 		}
+		e.Password = h
+		users[name] = e
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("setPassword: %w", err)
+	}
+
+	return nil
+}
+
+func (us *UserStore) Exists(name string) bool {
+	_, ok := us.current()[name]
+	return ok
+}
+
+// Active reports whether the user exists and isn't disabled
+func (us *UserStore) Active(name string) bool {
+	e, ok := us.current()[name]
+	return ok && !e.Disabled
+}
+
+// Get returns the profile of the user
+func (us *UserStore) Get(name string) (Profile, error) {
+	e, ok := us.current()[name]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return e.Profile, nil
+}
 
+// List returns the names of all users, sorted
+func (us *UserStore) List() []string {
+	users := us.current()
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SetProfile replaces the profile of the user. The creation time and the
+// link to the OpenID Connect provider can't be changed, see LinkOIDC
+func (us *UserStore) SetProfile(name string, p Profile) error {
+	err := us.update(func(users map[string]entry) error {
+		e, ok := users[name]
+		if !ok {
+			return ErrNotFound
+		}
+		p.Created = e.Created
+		p.OIDCSubject = e.OIDCSubject
+		e.Profile = p
+		users[name] = e
 		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("setProfile: %w", err)
 	}
+
+	return nil
 }
 
-func (us UserStore) DeleteUser(name string) error {
-	if _, ok := us.users[name]; !ok {
-		return errors.New("deleting unknown user")
+func (us *UserStore) CreateUser(name, pwd string, p Profile) error {
+	h, err := hashPassword(pwd, us.params)
+	if err != nil {
+		return fmt.Errorf("createUser: %w", err)
 	}
 
-	pwd := us.users[name]
-	delete(us.users, name)
+	err = us.update(func(users map[string]entry) error {
+		if _, ok := users[name]; ok {
+			return ErrExists
+		}
+		for _, e := range users {
+			if p.OIDCSubject != "" && e.OIDCSubject == p.OIDCSubject {
+				return ErrLinked
+			}
+		}
+		p.Created = time.Now().UTC()
+		users[name] = entry{Password: h, Profile: p}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("createUser: %w", err)
+	}
+
+	return nil
+}
 
-	err := us.syncToDisk()
+func (us *UserStore) DeleteUser(name string) error {
+	err := us.update(func(users map[string]entry) error {
+		if _, ok := users[name]; !ok {
+			return ErrNotFound
+		}
+		delete(users, name)
+		return nil
+	})
 	if err != nil {
-		// undo the delete to keep the table consistent
-		us.users[name] = pwd
 		return fmt.Errorf("deleteUser: %w", err)
 	}
 
@@ -87,3 +389,41 @@ func (us UserStore) DeleteUser(name string) error {
 
 	return nil
 }
+
+// ByOIDCSubject returns the name of the user linked to the subject at the
+// OpenID Connect provider
+func (us *UserStore) ByOIDCSubject(sub string) (string, error) {
+	if sub == "" {
+		return "", ErrNotFound
+	}
+	for name, e := range us.current() {
+		if e.OIDCSubject == sub {
+			return name, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// LinkOIDC links the user to the subject at the OpenID Connect provider. An
+// empty subject unlinks the user. A subject can be linked to one user only
+func (us *UserStore) LinkOIDC(name, sub string) error {
+	err := us.update(func(users map[string]entry) error {
+		e, ok := users[name]
+		if !ok {
+			return ErrNotFound
+		}
+		for other, oe := range users {
+			if sub != "" && other != name && oe.OIDCSubject == sub {
+				return ErrLinked
+			}
+		}
+		e.OIDCSubject = sub
+		users[name] = e
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("linkOIDC: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archiiv/apikey"
+	"archiiv/fs"
+	"archiiv/session"
+	"archiiv/user"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// userInfo is a user as the API shows it
+type userInfo struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	Created     time.Time `json:"created"`
+	Disabled    bool      `json:"disabled"`
+	OIDCSubject string    `json:"oidc_subject,omitempty"`
+}
+
+func newUserInfo(name string, p user.Profile) userInfo {
+	return userInfo{
+		Name:        name,
+		DisplayName: p.DisplayName,
+		Email:       p.Email,
+		Created:     p.Created,
+		Disabled:    p.Disabled,
+		OIDCSubject: p.OIDCSubject,
+	}
+}
+
+// checkUsername rejects the reserved users and names that would be confusing
+// in the perms of a file
+func checkUsername(name string) error {
+	if name == "" || len(name) > 64 {
+		return errors.New("username must be 1 to 64 bytes long")
+	}
+	if name == fs.UserRoot || name == fs.UserPub {
+		return fmt.Errorf("username %#v is reserved", name)
+	}
+	if strings.ContainsFunc(name, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) || r == '/' }) {
+		return errors.New("username can't contain whitespace or slashes")
+	}
+	return nil
+}
+
+func sendUserError(log *slog.Logger, w http.ResponseWriter, e error) {
+	switch {
+	case errors.Is(e, user.ErrNotFound):
+		sendError(log, w, http.StatusNotFound, e.Error())
+	case errors.Is(e, user.ErrExists), errors.Is(e, user.ErrLinked):
+		sendError(log, w, http.StatusConflict, e.Error())
+	default:
+		sendError(log, w, http.StatusInternalServerError, e.Error())
+	}
+}
+
+func handleUserList(log *slog.Logger, userStore *user.UserStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos := []userInfo{}
+		for _, name := range userStore.List() {
+			p, e := userStore.Get(name)
+			if e != nil {
+				// deleted in the meantime
+				continue
+			}
+			infos = append(infos, newUserInfo(name, p))
+		}
+
+		sendOK(log, w, infos)
+	})
+}
+
+func handleUserCreate(log *slog.Logger, userStore *user.UserStore) http.Handler {
+	type Request struct {
+		Name        string `json:"name"`
+		Password    string `json:"password"`
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		if e = checkUsername(req.Name); e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if req.Password == "" {
+			sendError(log, w, http.StatusBadRequest, "password can't be empty")
+			return
+		}
+
+		e = userStore.CreateUser(req.Name, req.Password, user.Profile{DisplayName: req.DisplayName, Email: req.Email})
+		if e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		p, e := userStore.Get(req.Name)
+		if e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		log.Info("Created user", "user", req.Name)
+		sendOK(log, w, newUserInfo(req.Name, p))
+	})
+}
+
+// handleUserDelete removes the account, its API keys and logs it out
+// everywhere. The files of the user are left alone
+func handleUserDelete(log *slog.Logger, userStore *user.UserStore, sessions *session.Store, keys *apikey.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		if e := userStore.DeleteUser(name); e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		if e := sessions.RevokeAll(name); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke tokens: %v", e))
+			return
+		}
+
+		if e := keys.RevokeAll(name); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke API keys: %v", e))
+			return
+		}
+
+		log.Info("Deleted user", "user", name)
+		sendOK(log, w, nil)
+	})
+}
+
+// handleUserPasswd sets a new password for the user and logs them out
+// everywhere
+func handleUserPasswd(log *slog.Logger, userStore *user.UserStore, sessions *session.Store) http.Handler {
+	type Request struct {
+		Password string `json:"password"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+		if req.Password == "" {
+			sendError(log, w, http.StatusBadRequest, "password can't be empty")
+			return
+		}
+
+		if e = userStore.SetPassword(name, req.Password); e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		if e = sessions.RevokeAll(name); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke tokens: %v", e))
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// profileUpdate changes only the fields that are present
+type profileUpdate struct {
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+}
+
+func (u profileUpdate) apply(p *user.Profile) {
+	if u.DisplayName != nil {
+		p.DisplayName = *u.DisplayName
+	}
+	if u.Email != nil {
+		p.Email = *u.Email
+	}
+}
+
+// handleUserUpdate changes the profile of any user. Disabling a user logs
+// them out everywhere. Setting oidc_subject links the user to that subject at
+// the OpenID Connect provider, an empty one unlinks them
+func handleUserUpdate(log *slog.Logger, userStore *user.UserStore, sessions *session.Store) http.Handler {
+	type Request struct {
+		profileUpdate
+		Disabled    *bool   `json:"disabled"`
+		OIDCSubject *string `json:"oidc_subject"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		p, e := userStore.Get(name)
+		if e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		req.apply(&p)
+		if req.Disabled != nil {
+			p.Disabled = *req.Disabled
+		}
+
+		if e = userStore.SetProfile(name, p); e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		// a disabled user is logged out even if linking fails below
+		if p.Disabled {
+			if e = sessions.RevokeAll(name); e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke tokens: %v", e))
+				return
+			}
+		}
+
+		if req.OIDCSubject != nil {
+			if e = userStore.LinkOIDC(name, *req.OIDCSubject); e != nil {
+				sendUserError(log, w, e)
+				return
+			}
+			p.OIDCSubject = *req.OIDCSubject
+		}
+
+		sendOK(log, w, newUserInfo(name, p))
+	})
+}
+
+func handleProfile(secret []signingKey, log *slog.Logger, userStore *user.UserStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := getUsername(r, secret)
+
+		p, e := userStore.Get(name)
+		if e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, newUserInfo(name, p))
+	})
+}
+
+func handleProfileUpdate(secret []signingKey, log *slog.Logger, userStore *user.UserStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := getUsername(r, secret)
+
+		req, e := decode[profileUpdate](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+
+		p, e := userStore.Get(name)
+		if e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		req.apply(&p)
+
+		if e = userStore.SetProfile(name, p); e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		sendOK(log, w, newUserInfo(name, p))
+	})
+}
+
+// handlePasswordChange lets users change their own password. All their other
+// sessions are logged out and the response carries fresh tokens
+func handlePasswordChange(secret []signingKey, log *slog.Logger, userStore *user.UserStore, sessions *session.Store) http.Handler {
+	type Request struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := getUsername(r, secret)
+
+		req, e := decode[Request](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode request: %v", e))
+			return
+		}
+		if req.NewPassword == "" {
+			sendError(log, w, http.StatusBadRequest, "password can't be empty")
+			return
+		}
+
+		if !userStore.CheckPassword(name, req.OldPassword) {
+			sendError(log, w, http.StatusForbidden, "wrong password")
+			return
+		}
+
+		if e = userStore.SetPassword(name, req.NewPassword); e != nil {
+			sendUserError(log, w, e)
+			return
+		}
+
+		if e = sessions.RevokeAll(name); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("revoke tokens: %v", e))
+			return
+		}
+
+		tokens, e := issueTokens(name, secret)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sign tokens: %v", e))
+			return
+		}
+
+		sendOK(log, w, tokens)
+	})
+}
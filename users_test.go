@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type userInfoResponse struct {
+	Ok   bool     `json:"ok"`
+	Data userInfo `json:"data"`
+}
+
+func TestUserCommand(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+
+	out, err := runCLI(t, env, "user", "add", "-display_name", "Prokop", "-email", "prokop@example.com", "prokop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd := strings.TrimSpace(out)
+	token := loginHelper(t, env.srv, "prokop", pwd)
+
+	res := hitAuth(env.srv, http.MethodGet, "/api/v1/profile", token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	info := decodeResponse[userInfoResponse](t, res).Data
+	expectEqual(t, info.DisplayName, "Prokop", "display name")
+	expectEqual(t, info.Email, "prokop@example.com", "email")
+
+	_, err = runCLI(t, env, "user", "add", "prokop")
+	if err == nil || !strings.Contains(err.Error(), "username already used") {
+		t.Errorf("adding an existing user: %v", err)
+	}
+	_, err = runCLI(t, env, "user", "add", "root")
+	if err == nil {
+		t.Error("adding root should fail")
+	}
+
+	out, err = runCLI(t, env, "user", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	expectEqual(t, len(lines), 2, "listed users")
+	expectEqual(t, strings.Fields(lines[0])[0], "marek", "first listed user")
+	expectEqual(t, strings.Fields(lines[1])[0], "prokop", "second listed user")
+
+	out, err = runCLI(t, env, "user", "passwd", "prokop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPwd := strings.TrimSpace(out)
+
+	// the old sessions are gone with the old password
+	res = hitAuth(env.srv, http.MethodGet, "/api/v1/profile", token, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+	res = hitPost(t, env.srv, "/api/v1/login", loginRequest{Username: "prokop", Password: pwd})
+	expectFail(t, res, http.StatusForbidden, "wrong name or password")
+	token = loginHelper(t, env.srv, "prokop", newPwd)
+
+	if _, err = runCLI(t, env, "user", "del", "prokop"); err != nil {
+		t.Fatal(err)
+	}
+	res = hitAuth(env.srv, http.MethodGet, "/api/v1/profile", token, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+	res = hitPost(t, env.srv, "/api/v1/login", loginRequest{Username: "prokop", Password: newPwd})
+	expectFail(t, res, http.StatusForbidden, "wrong name or password")
+
+	_, err = runCLI(t, env, "user", "del", "prokop")
+	if err == nil || !strings.Contains(err.Error(), "unknown user") {
+		t.Errorf("deleting an unknown user: %v", err)
+	}
+}
+
+func TestUserAdminRequiresRoot(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	token := loginHelper(t, srv, "marek", "heslo")
+
+	res := hitAuth(srv, http.MethodGet, "/api/v1/users", token, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/users/create", token, strings.NewReader(`{"name":"eve","password":"x"}`))
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/users/update/marek", token, strings.NewReader(`{"disabled":false}`))
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
+
+func TestDisableUser(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{
+		"marek": hashPassword("heslo"),
+		"ema":   hashPassword("heslo"),
+	})
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := loginTokensHelper(t, env.srv, "marek", "heslo")
+
+	res := hitAuth(env.srv, http.MethodPost, "/api/v1/users/update/ema", rootToken, strings.NewReader(`{"oidc_subject":"1234"}`))
+	expectStatusCode(t, res, http.StatusOK)
+
+	// the user is logged out even though the subject can't be linked
+	res = hitAuth(env.srv, http.MethodPost, "/api/v1/users/update/marek", rootToken, strings.NewReader(`{"disabled":true,"oidc_subject":"1234"}`))
+	expectStatusCode(t, res, http.StatusConflict)
+	res = hitAuth(env.srv, http.MethodGet, "/api/v1/whoami", tokens.Token, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	res = hitAuth(env.srv, http.MethodPost, "/api/v1/users/update/marek", rootToken, strings.NewReader(`{"disabled":true}`))
+	expectStatusCode(t, res, http.StatusOK)
+	info := decodeResponse[userInfoResponse](t, res).Data
+	expectEqual(t, info.Disabled, true, "disabled")
+	res = refreshHelper(env.srv, tokens.RefreshToken)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+	res = hitPost(t, env.srv, "/api/v1/login", loginRequest{Username: "marek", Password: "heslo"})
+	expectFail(t, res, http.StatusForbidden, "wrong name or password")
+
+	res = hitAuth(env.srv, http.MethodPost, "/api/v1/users/update/marek", rootToken, strings.NewReader(`{"disabled":false}`))
+	expectStatusCode(t, res, http.StatusOK)
+	loginHelper(t, env.srv, "marek", "heslo")
+}
+
+func TestSelfService(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServerWithRoot(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	tokens := loginTokensHelper(t, srv, "marek", "heslo")
+	other := loginTokensHelper(t, srv, "marek", "heslo")
+
+	res := hitAuth(srv, http.MethodPost, "/api/v1/profile", tokens.Token, strings.NewReader(`{"display_name":"Marek"}`))
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodPost, "/api/v1/profile", tokens.Token, strings.NewReader(`{"email":"marek@example.com"}`))
+	expectStatusCode(t, res, http.StatusOK)
+	info := decodeResponse[userInfoResponse](t, res).Data
+	expectEqual(t, info.DisplayName, "Marek", "display name kept")
+	expectEqual(t, info.Email, "marek@example.com", "email")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/passwd", tokens.Token, strings.NewReader(`{"old_password":"hesl","new_password":"nove"}`))
+	expectFail(t, res, http.StatusForbidden, "wrong password")
+
+	res = hitAuth(srv, http.MethodPost, "/api/v1/passwd", tokens.Token, strings.NewReader(`{"old_password":"heslo","new_password":"nove"}`))
+	expectStatusCode(t, res, http.StatusOK)
+	fresh := decodeResponse[tokensResponse](t, res).Data
+
+	res = hitAuth(srv, http.MethodGet, "/api/v1/whoami", fresh.Token, nil)
+	expectStatusCode(t, res, http.StatusOK)
+	res = hitAuth(srv, http.MethodGet, "/api/v1/whoami", other.Token, nil)
+	expectStatusCode(t, res, http.StatusUnauthorized)
+
+	loginHelper(t, srv, "marek", "nove")
+}
+
+func TestConcurrentUserCreate(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	rootToken, err := sign("root", env.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := strings.NewReader(fmt.Sprintf(`{"name":"user%d","password":"heslo"}`, i))
+			res := hitAuth(env.srv, http.MethodPost, "/api/v1/users/create", rootToken, body)
+			expectStatusCode(t, res, http.StatusOK)
+		}()
+	}
+	wg.Wait()
+
+	res := hitAuth(env.srv, http.MethodGet, "/api/v1/users", rootToken, nil)
+	users := decodeResponse[struct {
+		Ok   bool       `json:"ok"`
+		Data []userInfo `json:"data"`
+	}](t, res).Data
+	expectEqual(t, len(users), 21, "number of users")
+
+	// none of the writes got lost on disk either
+	b, err := os.ReadFile(filepath.Join(env.dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f struct {
+		Version int            `json:"version"`
+		Users   map[string]any `json:"users"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, f.Version, 2, "users file version")
+	expectEqual(t, len(f.Users), 21, "users in the file")
+}
+
+func TestUsersFileReload(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, map[string][64]byte{"marek": hashPassword("heslo")})
+	loginHelper(t, env.srv, "marek", "heslo")
+
+	// someone edits the file behind the server's back
+	b, err := json.Marshal(map[string][64]byte{"nový": hashPassword("jiné")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(env.dir, "users.json"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loginHelper(t, env.srv, "nový", "jiné")
+	res := hitPost(t, env.srv, "/api/v1/login", loginRequest{Username: "marek", Password: "heslo"})
+	expectFail(t, res, http.StatusForbidden, "wrong name or password")
+}